@@ -0,0 +1,209 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwoff11/go-resolve/internal/config"
+	"github.com/bwoff11/go-resolve/internal/pause"
+	"github.com/bwoff11/go-resolve/internal/resolver"
+	"github.com/rs/zerolog/log"
+)
+
+var errInvalidMinutes = errors.New("minutes must be a positive integer")
+
+const defaultAddress = "127.0.0.1"
+
+// API serves the administrative HTTP endpoints.
+type API struct {
+	Address  string
+	Pause    *pause.State
+	Resolver *resolver.Resolver
+	token    string
+	mux      *http.ServeMux
+}
+
+// New creates an API bound to the configured address and port.
+func New(cfg *config.API, r *resolver.Resolver) *API {
+	host := cfg.Address
+	if host == "" {
+		host = defaultAddress
+	}
+
+	a := &API{
+		Address:  net.JoinHostPort(host, strconv.Itoa(cfg.Port)),
+		Pause:    r.Pause,
+		Resolver: r,
+		token:    cfg.Token,
+		mux:      http.NewServeMux(),
+	}
+	if a.token == "" {
+		log.Warn().Msg("No admin API token configured, blocking changes through the API are disabled")
+	}
+
+	a.mux.HandleFunc("/blocking", a.handleStatus)
+	a.mux.HandleFunc("/blocking/pause", a.authorized(a.handlePause))
+	a.mux.HandleFunc("/blocking/resume", a.authorized(a.handleResume))
+	a.mux.HandleFunc("/blocking/allow", a.authorized(a.handleAllow))
+	a.mux.HandleFunc("/blocking/explain", a.handleExplain)
+	a.mux.HandleFunc("/blocking/top", a.handleTop)
+
+	return a
+}
+
+// Start serves the API in the background.
+func (a *API) Start() {
+	go func() {
+		log.Info().Str("address", a.Address).Msg("Starting admin API server")
+		if err := http.ListenAndServe(a.Address, a.mux); err != nil {
+			log.Fatal().Err(err).Msg("Failed to start admin API server")
+		}
+	}()
+}
+
+// authorized wraps a handler that changes blocking so that it requires the
+// configured bearer token.
+func (a *API) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.token == "" {
+			http.Error(w, "no api token configured", http.StatusForbidden)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleStatus returns the active pauses and allows.
+func (a *API) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, a.Pause.Status())
+}
+
+// handlePause disables blocking, e.g. POST /blocking/pause?minutes=10&group=kids.
+func (a *API) handlePause(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	d, err := parseMinutes(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	a.Pause.Pause(r.URL.Query().Get("group"), d)
+	writeJSON(w, a.Pause.Status())
+}
+
+// handleResume re-enables blocking, e.g. POST /blocking/resume?group=kids.
+func (a *API) handleResume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	a.Pause.Resume(r.URL.Query().Get("group"))
+	writeJSON(w, a.Pause.Status())
+}
+
+// handleAllow adds (POST) or removes (DELETE) a temporary allow,
+// e.g. POST /blocking/allow?domain=shop.example.com&minutes=30.
+func (a *API) handleAllow(w http.ResponseWriter, r *http.Request) {
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		http.Error(w, "missing domain", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		d, err := parseMinutes(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.Pause.Allow(domain, d)
+	case http.MethodDelete:
+		a.Pause.Revoke(domain)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, a.Pause.Status())
+}
+
+// handleExplain reports every block list entry matching a domain,
+// e.g. GET /blocking/explain?domain=shop.example.com&client=192.168.1.20.
+func (a *API) handleExplain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		http.Error(w, "missing domain", http.StatusBadRequest)
+		return
+	}
+
+	var clientIP net.IP
+	if c := r.URL.Query().Get("client"); c != "" {
+		if clientIP = net.ParseIP(c); clientIP == nil {
+			http.Error(w, "invalid client address", http.StatusBadRequest)
+			return
+		}
+	}
+
+	writeJSON(w, a.Resolver.Explain(domain, clientIP))
+}
+
+// handleTop returns the most blocked domains, e.g. GET /blocking/top?n=10.
+func (a *API) handleTop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	n := 10
+	if value := r.URL.Query().Get("n"); value != "" {
+		var err error
+		if n, err = strconv.Atoi(value); err != nil || n <= 0 {
+			http.Error(w, "n must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	writeJSON(w, a.Resolver.BlockStats.Top(n))
+}
+
+func parseMinutes(r *http.Request) (time.Duration, error) {
+	minutes, err := strconv.Atoi(r.URL.Query().Get("minutes"))
+	if err != nil || minutes <= 0 {
+		return 0, errInvalidMinutes
+	}
+	return time.Duration(minutes) * time.Minute, nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error().Err(err).Msg("failed to write api response")
+	}
+}
@@ -3,8 +3,10 @@ package blocklist
 import (
 	"io"
 	"net/http"
+	"strings"
 	"sync"
 
+	"github.com/miekg/dns"
 	"github.com/rs/zerolog/log"
 	"gopkg.in/yaml.v3"
 )
@@ -12,11 +14,15 @@ import (
 // BlockList is a slice of Block, representing a list of blocked domains and their details.
 type BlockList []Block
 
+// RuleTypeExact is the rule type of entries matching a single domain name.
+const RuleTypeExact = "exact"
+
 // Block represents a single blocked domain with its category and reason for being blocked.
 type Block struct {
 	Domain   string `yaml:"domain"`   // Domain name to be blocked.
 	Category string `yaml:"category"` // Category of the reason for blocking (e.g., advertising).
 	Reason   string `yaml:"reason"`   // Long reason for the domain being blocked.
+	Source   string `yaml:"-"`        // URL of the block list the entry was loaded from.
 }
 
 // New initializes a BlockList from a list of URLs pointing to blocklists.
@@ -53,6 +59,10 @@ func addBlocklist(url string, combinedBlockList *BlockList, mutex *sync.Mutex, w
 		log.Error().Err(err).Str("url", url).Msg("failed to parse block list")
 		return
 	}
+	for i := range *blockList {
+		(*blockList)[i].Domain = Normalize((*blockList)[i].Domain)
+		(*blockList)[i].Source = url
+	}
 
 	mutex.Lock()
 	*combinedBlockList = append(*combinedBlockList, *blockList...)
@@ -79,6 +89,11 @@ func parseBlockList(rawYAML []byte) (*BlockList, error) {
 	return &blockList, err
 }
 
+// Normalize converts a domain to the lower-case, fully qualified form used in queries.
+func Normalize(domain string) string {
+	return strings.ToLower(dns.Fqdn(domain))
+}
+
 // Query checks if a domain is present in the block list and returns the corresponding Block if found.
 func (bl *BlockList) Query(domain string) *Block {
 	for _, block := range *bl {
@@ -89,6 +104,17 @@ func (bl *BlockList) Query(domain string) *Block {
 	return nil
 }
 
+// QueryAll returns every Block for a domain, one per block list that contains it.
+func (bl *BlockList) QueryAll(domain string) []Block {
+	var blocks []Block
+	for _, block := range *bl {
+		if block.Domain == domain {
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks
+}
+
 // Check checks if a domain is present in the block list and returns true if found.
 func (bl *BlockList) Check(domain string) bool {
 	return bl.Query(domain) != nil
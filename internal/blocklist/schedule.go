@@ -0,0 +1,214 @@
+package blocklist
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bwoff11/go-resolve/internal/config"
+	"github.com/rs/zerolog/log"
+)
+
+// Rules decides whether a Block is enforced for a client at a given time.
+// Rules are evaluated per query so schedule boundaries never require
+// the BlockList to be rebuilt.
+type Rules struct {
+	location *time.Location
+	rules    []rule
+}
+
+type rule struct {
+	name       string
+	groups     map[string]bool
+	categories map[string]bool
+	sources    map[string]bool
+	windows    []window
+}
+
+// window is a parsed config.Schedule. Times are minutes since midnight.
+type window struct {
+	days  [7]bool
+	start int
+	end   int
+}
+
+var dayNames = map[string][]time.Weekday{
+	"sun":      {time.Sunday},
+	"mon":      {time.Monday},
+	"tue":      {time.Tuesday},
+	"wed":      {time.Wednesday},
+	"thu":      {time.Thursday},
+	"fri":      {time.Friday},
+	"sat":      {time.Saturday},
+	"weekdays": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekends": {time.Saturday, time.Sunday},
+}
+
+// NewRules parses the blocking configuration. Invalid rules and schedules
+// are logged and skipped.
+func NewRules(cfg *config.Blocking) *Rules {
+	rs := &Rules{location: time.UTC}
+
+	if cfg.TimeZone != "" {
+		loc, err := time.LoadLocation(cfg.TimeZone)
+		if err != nil {
+			log.Error().Err(err).Str("timeZone", cfg.TimeZone).Msg("invalid blocking time zone, using UTC")
+		} else {
+			rs.location = loc
+		}
+	}
+
+	for _, r := range cfg.Rules {
+		parsed := rule{
+			name:       r.Name,
+			groups:     toSet(r.Groups),
+			categories: toSet(r.Categories),
+			sources:    toSet(r.Sources),
+		}
+
+		valid := true
+		for _, s := range r.Schedules {
+			w, err := parseWindow(s)
+			if err != nil {
+				log.Error().Err(err).Str("rule", r.Name).Msg("invalid blocking schedule")
+				valid = false
+				break
+			}
+			parsed.windows = append(parsed.windows, w)
+		}
+		if !valid {
+			continue
+		}
+
+		rs.rules = append(rs.rules, parsed)
+		log.Debug().Str("rule", r.Name).Int("schedules", len(parsed.windows)).Msg("added blocking rule")
+	}
+
+	return rs
+}
+
+// Enforced reports whether a block applies to a client belonging to groups at time t.
+// A block selected by no rule is always enforced; otherwise it is enforced while
+// at least one selecting rule applies to the client and is within its schedule.
+func (rs *Rules) Enforced(b *Block, groups []string, t time.Time) bool {
+	t = t.In(rs.location)
+
+	selected := false
+	for i := range rs.rules {
+		r := &rs.rules[i]
+		if !r.selects(b) {
+			continue
+		}
+		selected = true
+		if r.appliesTo(groups) && r.activeAt(t) {
+			return true
+		}
+	}
+	return !selected
+}
+
+// Selecting returns the names of the rules that select a block.
+func (rs *Rules) Selecting(b *Block) []string {
+	var names []string
+	for i := range rs.rules {
+		if rs.rules[i].selects(b) {
+			names = append(names, rs.rules[i].name)
+		}
+	}
+	return names
+}
+
+func (r *rule) selects(b *Block) bool {
+	if len(r.categories) > 0 && !r.categories[b.Category] {
+		return false
+	}
+	if len(r.sources) > 0 && !r.sources[b.Source] {
+		return false
+	}
+	return true
+}
+
+func (r *rule) appliesTo(groups []string) bool {
+	if len(r.groups) == 0 {
+		return true
+	}
+	for _, g := range groups {
+		if r.groups[g] {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) activeAt(t time.Time) bool {
+	if len(r.windows) == 0 {
+		return true
+	}
+	for _, w := range r.windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w window) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+
+	if w.start <= w.end {
+		return w.days[today] && minute >= w.start && minute < w.end
+	}
+
+	// The window spans midnight.
+	return (w.days[today] && minute >= w.start) || (w.days[yesterday] && minute < w.end)
+}
+
+func parseWindow(s config.Schedule) (window, error) {
+	var w window
+
+	if len(s.Days) == 0 {
+		for i := range w.days {
+			w.days[i] = true
+		}
+	}
+	for _, d := range s.Days {
+		days, ok := dayNames[strings.ToLower(d)]
+		if !ok {
+			return w, fmt.Errorf("invalid day %q", d)
+		}
+		for _, day := range days {
+			w.days[day] = true
+		}
+	}
+
+	var err error
+	if w.start, err = parseClock(s.Start); err != nil {
+		return w, err
+	}
+	if w.end, err = parseClock(s.End); err != nil {
+		return w, err
+	}
+	return w, nil
+}
+
+// parseClock converts HH:MM into minutes since midnight. 24:00 is accepted as end of day.
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		if value == "24:00" {
+			return 24 * 60, nil
+		}
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func toSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
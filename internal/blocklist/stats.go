@@ -0,0 +1,111 @@
+package blocklist
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+)
+
+// statsCapacity is the number of domains tracked by Stats.
+const statsCapacity = 1000
+
+// Stats estimates the most blocked domains with the space-saving algorithm:
+// at most statsCapacity domains are counted, and a newly blocked domain
+// replaces the least blocked one, inheriting its count. The counts of the
+// most blocked domains are exact unless many more domains are blocked about
+// as often; an inherited count overestimates by at most the replaced count.
+type Stats struct {
+	mutex    sync.Mutex
+	counters counterHeap
+	index    map[string]*counter
+}
+
+// DomainCount is the number of times a domain has been blocked.
+type DomainCount struct {
+	Domain string `json:"domain"`
+	Count  uint64 `json:"count"`
+}
+
+type counter struct {
+	domain string
+	count  uint64
+	pos    int // Position in the heap.
+}
+
+func NewStats() *Stats {
+	return &Stats{index: make(map[string]*counter)}
+}
+
+// Record counts a blocked query for domain.
+func (s *Stats) Record(domain string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if c, ok := s.index[domain]; ok {
+		c.count++
+		heap.Fix(&s.counters, c.pos)
+		return
+	}
+
+	if len(s.counters) < statsCapacity {
+		c := &counter{domain: domain, count: 1}
+		heap.Push(&s.counters, c)
+		s.index[domain] = c
+		return
+	}
+
+	// Replace the least blocked domain.
+	c := s.counters[0]
+	delete(s.index, c.domain)
+	c.domain = domain
+	c.count++
+	s.index[domain] = c
+	heap.Fix(&s.counters, 0)
+}
+
+// Top returns the n most blocked domains, most blocked first.
+func (s *Stats) Top(n int) []DomainCount {
+	s.mutex.Lock()
+	top := make([]DomainCount, 0, len(s.counters))
+	for _, c := range s.counters {
+		top = append(top, DomainCount{Domain: c.domain, Count: c.count})
+	}
+	s.mutex.Unlock()
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Domain < top[j].Domain
+	})
+
+	if n > 0 && len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// counterHeap is a min-heap of counters ordered by count.
+type counterHeap []*counter
+
+func (h counterHeap) Len() int           { return len(h) }
+func (h counterHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+
+func (h counterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].pos = i
+	h[j].pos = j
+}
+
+func (h *counterHeap) Push(x any) {
+	c := x.(*counter)
+	c.pos = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *counterHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"net"
 	"sync"
 	"time"
 
@@ -18,6 +19,8 @@ type Record struct {
 	Question *dns.Question
 	Answer   []dns.RR
 	Expiry   time.Time
+	Subnet   *net.IPNet // Client subnet the answer is scoped to (RFC 7871), nil for every client.
+	Secure   bool       // Validated as secure with DNSSEC.
 }
 
 func New() *Cache {
@@ -29,7 +32,17 @@ func New() *Cache {
 	return c
 }
 
-func (c *Cache) Add(q *dns.Question, records []dns.RR) {
+// Add caches the answer to q for clients in subnet, or for every client if subnet is nil.
+func (c *Cache) Add(q *dns.Question, records []dns.RR, subnet *net.IPNet) {
+	c.add(q, records, subnet, false)
+}
+
+// AddSecure caches an answer validated as secure with DNSSEC, like Add.
+func (c *Cache) AddSecure(q *dns.Question, records []dns.RR, subnet *net.IPNet) {
+	c.add(q, records, subnet, true)
+}
+
+func (c *Cache) add(q *dns.Question, records []dns.RR, subnet *net.IPNet, secure bool) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
@@ -39,25 +52,69 @@ func (c *Cache) Add(q *dns.Question, records []dns.RR) {
 		Question: q,
 		Answer:   records,
 		Expiry:   time.Now().Add(ttl),
+		Subnet:   subnet,
+		Secure:   secure,
 	})
 	log.Debug().Str("domain", q.Name).Str("type", dns.TypeToString[q.Qtype]).Msg("added record to cache")
 	metrics.CacheSize.Set(float64(len(c.Records)))
 }
 
-func (c *Cache) Query(q *dns.Question) []dns.RR {
+// Query returns the cached answer to q for a client in subnet. Answers scoped
+// to a client subnet only match clients within it.
+func (c *Cache) Query(q *dns.Question, subnet *net.IPNet) []dns.RR {
+	records, _ := c.Lookup(q, subnet)
+	return records
+}
+
+// Lookup returns the cached answer to q for a client in subnet, like Query,
+// and whether it was validated as secure with DNSSEC. Of the answers in
+// scope, the one scoped to the longest prefix is used.
+func (c *Cache) Lookup(q *dns.Question, subnet *net.IPNet) ([]dns.RR, bool) {
 	c.mutex.RLock()
 	defer c.mutex.RUnlock()
 
-	for _, record := range c.Records {
-		if record.Question.Name == q.Name && record.Question.Qtype == q.Qtype {
-			log.Debug().Str("domain", q.Name).Str("type", dns.TypeToString[q.Qtype]).Msg("found record in cache")
-			metrics.CacheHits.Inc()
-			return record.Answer
+	var best *Record
+	bestBits := -1
+	for i := range c.Records {
+		record := &c.Records[i]
+		if record.Question.Name != q.Name || record.Question.Qtype != q.Qtype || !inScope(record.Subnet, subnet) {
+			continue
 		}
+		if bits := scopeBits(record.Subnet); best == nil || bits > bestBits {
+			best, bestBits = record, bits
+		}
+	}
+	if best != nil {
+		log.Debug().Str("domain", q.Name).Str("type", dns.TypeToString[q.Qtype]).Msg("found record in cache")
+		metrics.CacheHits.Inc()
+		return best.Answer, best.Secure
 	}
 
 	log.Debug().Str("domain", q.Name).Str("type", dns.TypeToString[q.Qtype]).Msg("record not found in cache")
 	metrics.CacheMisses.Inc()
 
-	return []dns.RR{}
+	return []dns.RR{}, false
+}
+
+// scopeBits returns the prefix length of scope, or -1 for answers that apply
+// to every client.
+func scopeBits(scope *net.IPNet) int {
+	if scope == nil {
+		return -1
+	}
+	bits, _ := scope.Mask.Size()
+	return bits
+}
+
+// inScope reports whether an answer scoped to scope applies to a client in subnet.
+func inScope(scope, subnet *net.IPNet) bool {
+	if scope == nil {
+		return true
+	}
+	if subnet == nil || !scope.Contains(subnet.IP) {
+		return false
+	}
+	scopeBits, _ := scope.Mask.Size()
+	subnetBits, _ := subnet.Mask.Size()
+	return scopeBits <= subnetBits
 }
@@ -0,0 +1,110 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+const usage = `usage: go-resolve <command> [flags]
+
+commands:
+  status                           show active pauses and allows
+  pause  -minutes N [-group name]  disable blocking for N minutes
+  resume [-group name]             re-enable blocking now
+  allow  -domain d -minutes N      exempt a domain from blocking for N minutes
+  revoke -domain d                 remove a temporary allow
+  explain -domain d [-client ip]   show why a domain is or is not blocked
+  top [-n N]                       show the most blocked domains
+
+every command accepts -api URL and -token T (or $GO_RESOLVE_TOKEN)
+`
+
+// Run executes a CLI command against a running server's admin API.
+func Run(args []string) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	apiURL := fs.String("api", "http://localhost:8053", "admin API base URL")
+	token := fs.String("token", os.Getenv("GO_RESOLVE_TOKEN"), "admin API token, defaults to $GO_RESOLVE_TOKEN")
+	group := fs.String("group", "", "client group, defaults to all clients")
+	domain := fs.String("domain", "", "domain to allow or revoke")
+	minutes := fs.Int("minutes", 0, "duration in minutes")
+	clientIP := fs.String("client", "", "client address to evaluate client group rules for")
+	n := fs.Int("n", 0, "number of domains to show")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	params := url.Values{}
+	if *group != "" {
+		params.Set("group", *group)
+	}
+	if *domain != "" {
+		params.Set("domain", *domain)
+	}
+	if *minutes > 0 {
+		params.Set("minutes", strconv.Itoa(*minutes))
+	}
+	if *clientIP != "" {
+		params.Set("client", *clientIP)
+	}
+	if *n > 0 {
+		params.Set("n", strconv.Itoa(*n))
+	}
+
+	switch args[0] {
+	case "status":
+		return call(http.MethodGet, *token, *apiURL+"/blocking", params)
+	case "pause":
+		return call(http.MethodPost, *token, *apiURL+"/blocking/pause", params)
+	case "resume":
+		return call(http.MethodPost, *token, *apiURL+"/blocking/resume", params)
+	case "allow":
+		return call(http.MethodPost, *token, *apiURL+"/blocking/allow", params)
+	case "revoke":
+		return call(http.MethodDelete, *token, *apiURL+"/blocking/allow", params)
+	case "explain":
+		return call(http.MethodGet, *token, *apiURL+"/blocking/explain", params)
+	case "top":
+		return call(http.MethodGet, *token, *apiURL+"/blocking/top", params)
+	default:
+		return fmt.Errorf("unknown command %q\n\n%s", args[0], usage)
+	}
+}
+
+// call sends a request to the admin API and copies the response to stdout.
+func call(method, token, endpoint string, params url.Values) error {
+	if len(params) > 0 {
+		endpoint += "?" + params.Encode()
+	}
+
+	req, err := http.NewRequest(method, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, body)
+	}
+
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
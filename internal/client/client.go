@@ -0,0 +1,99 @@
+package client
+
+import (
+	"net"
+
+	"github.com/bwoff11/go-resolve/internal/common"
+	"github.com/bwoff11/go-resolve/internal/config"
+	"github.com/rs/zerolog/log"
+)
+
+// Source is the client a query came from, the transport it arrived on and
+// the local address it was sent to.
+type Source struct {
+	Addr     net.Addr
+	Protocol common.Protocol
+	Local    net.Addr
+}
+
+// Groups resolves client addresses to the names of the groups they belong to.
+type Groups struct {
+	groups []group
+}
+
+type group struct {
+	name       string
+	networks   []*net.IPNet
+	safeSearch bool
+}
+
+// New builds Groups from the configured client groups.
+// Invalid CIDRs are logged and skipped.
+func New(cfg []config.ClientGroup) *Groups {
+	g := &Groups{}
+	for _, cg := range cfg {
+		entry := group{name: cg.Name, safeSearch: cg.SafeSearch}
+		for _, cidr := range cg.CIDRs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				log.Error().Err(err).Str("group", cg.Name).Str("cidr", cidr).Msg("invalid client group cidr")
+				continue
+			}
+			entry.networks = append(entry.networks, network)
+		}
+		g.groups = append(g.groups, entry)
+		log.Debug().Str("group", cg.Name).Int("networks", len(entry.networks)).Msg("added client group")
+	}
+	return g
+}
+
+// Match returns the names of every group containing ip.
+func (g *Groups) Match(ip net.IP) []string {
+	if ip == nil {
+		return nil
+	}
+
+	var names []string
+	for _, entry := range g.groups {
+		for _, network := range entry.networks {
+			if network.Contains(ip) {
+				names = append(names, entry.name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+// SafeSearch reports whether safe search is enforced for any of the named groups.
+func (g *Groups) SafeSearch(names []string) bool {
+	for _, entry := range g.groups {
+		if !entry.safeSearch {
+			continue
+		}
+		for _, name := range names {
+			if entry.name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IP extracts the IP address from a UDP or TCP network address.
+func IP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,8 @@
+package config
+
+type API struct {
+	Enabled bool   `yaml:"enabled"`
+	Address string `yaml:"address"` // 127.0.0.1 if unset
+	Port    int    `yaml:"port"`
+	Token   string `yaml:"token"` // Bearer token required to change blocking; changes are refused if unset
+}
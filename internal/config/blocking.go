@@ -0,0 +1,26 @@
+package config
+
+// Blocking controls when block list entries are enforced.
+// Entries not selected by any rule are always enforced.
+type Blocking struct {
+	TimeZone string      `yaml:"timeZone"` // IANA time zone used to evaluate schedules, defaults to UTC.
+	Rules    []BlockRule `yaml:"rules"`
+}
+
+// BlockRule restricts the block list entries it selects to the given
+// client groups and schedules. Empty selectors match everything.
+type BlockRule struct {
+	Name       string     `yaml:"name"`
+	Groups     []string   `yaml:"groups"`     // Client groups the rule applies to.
+	Categories []string   `yaml:"categories"` // Block categories selected by the rule.
+	Sources    []string   `yaml:"sources"`    // Block list URLs selected by the rule.
+	Schedules  []Schedule `yaml:"schedules"`  // Windows during which the rule is active.
+}
+
+// Schedule is a daily time window, e.g. 21:00-07:00. A window whose end
+// is before its start spans midnight and belongs to the day it starts on.
+type Schedule struct {
+	Days  []string `yaml:"days"`  // mon, tue, ... or weekdays/weekends. Empty means every day.
+	Start string   `yaml:"start"` // HH:MM
+	End   string   `yaml:"end"`   // HH:MM
+}
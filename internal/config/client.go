@@ -0,0 +1,8 @@
+package config
+
+// ClientGroup names a set of clients identified by their source address.
+type ClientGroup struct {
+	Name       string   `yaml:"name"`
+	CIDRs      []string `yaml:"cidrs"`
+	SafeSearch bool     `yaml:"safeSearch"` // Rewrite search engines to their enforced safe endpoints.
+}
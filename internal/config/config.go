@@ -1,6 +1,7 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/rs/zerolog/log"
@@ -8,11 +9,22 @@ import (
 )
 
 type Config struct {
-	BlockLists []string  `yaml:"blockLists"`
-	Local      Local     `yaml:"local"`
-	Metrics    Metrics   `yaml:"metrics"`
-	Transport  Transport `yaml:"transport"`
-	Upstream   Upstream  `yaml:"upstream"`
+	API          API           `yaml:"api"`
+	BlockLists   []string      `yaml:"blockLists"`
+	Blocking     Blocking      `yaml:"blocking"`
+	ClientGroups []ClientGroup `yaml:"clientGroups"`
+	DNSSEC       DNSSEC        `yaml:"dnssec"`
+	ECS          ECS           `yaml:"ecs"`
+	Forwarding   Forwarding    `yaml:"forwarding"`
+	Local        Local         `yaml:"local"`
+	Metrics      Metrics       `yaml:"metrics"`
+	Resolver     Resolver      `yaml:"resolver"`
+	Secondaries  []Secondary   `yaml:"secondaries"`
+	Transfer     Transfer      `yaml:"transfer"`
+	Transport    Transport     `yaml:"transport"`
+	TSIGKeys     []TSIGKey     `yaml:"tsigKeys"`
+	Update       Update        `yaml:"update"`
+	Upstream     Upstream      `yaml:"upstream"`
 }
 
 // Load reads the configuration file and unmarshals it into the Config struct.
@@ -44,5 +56,17 @@ func Load() (*Config, error) {
 
 	log.Debug().Str("config", fmt.Sprintf("%+v", cfg)).Msg("loaded configuration")
 
+	// Reverse zones routed to a forwarder must not be answered as private zones.
+	cfg.Local.Reverse.Forwarded = cfg.Forwarding.Zones()
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
 	return &cfg, nil
 }
+
+// Validate checks the configuration for entries that cannot be used.
+func (c *Config) Validate() error {
+	return errors.Join(c.Upstream.validate("upstream"), c.Local.validate(), c.Local.validateViews(), c.Forwarding.validate())
+}
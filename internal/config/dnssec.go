@@ -0,0 +1,14 @@
+package config
+
+// DNSSEC controls validation of forwarded and recursive answers.
+type DNSSEC struct {
+	Validate        bool     `yaml:"validate"`
+	TrustAnchors    []string `yaml:"trustAnchors"`    // DS or DNSKEY records, the IANA root anchors if unset.
+	TrustAnchorFile string   `yaml:"trustAnchorFile"` // File keeping RFC 5011 trust anchor state across restarts, replacing TrustAnchors once written.
+
+	// Domains treated as insecure with their subdomains (negative trust
+	// anchors, RFC 7646). The zones of forwarding routes are added unless
+	// ValidateForwarded is set, as private zones are usually unsigned.
+	InsecureDomains   []string `yaml:"insecureDomains"`
+	ValidateForwarded bool     `yaml:"validateForwarded"`
+}
@@ -0,0 +1,17 @@
+package config
+
+// ECS modes.
+const (
+	ECSStrip       = "strip"       // Never send client subnets upstream.
+	ECSPassthrough = "passthrough" // Forward subnets supplied by clients.
+	ECSSynthesize  = "synthesize"  // Forward supplied subnets, or send the client's own.
+)
+
+// ECS controls the EDNS Client Subnet (RFC 7871) option of upstream queries.
+// Subnets are always truncated to the configured prefix lengths.
+type ECS struct {
+	Mode       string `yaml:"mode"`       // strip, passthrough or synthesize; strip if unset.
+	IPv4Prefix int    `yaml:"ipv4Prefix"` // 24 if unset.
+	IPv6Prefix int    `yaml:"ipv6Prefix"` // 56 if unset.
+	Privacy    bool   `yaml:"privacy"`    // Ignore subnets supplied by clients; synthesize only from their address.
+}
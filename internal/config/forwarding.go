@@ -0,0 +1,126 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Forwarding routes queries for selected domains to named upstream groups
+// instead of the default upstream. The route with the longest matching
+// domain wins.
+type Forwarding struct {
+	Groups []UpstreamGroup `yaml:"groups"`
+	Routes []Route         `yaml:"routes"`
+}
+
+// UpstreamGroup is a named set of upstream servers with its own strategy.
+type UpstreamGroup struct {
+	Name     string   `yaml:"name"`
+	Upstream Upstream `yaml:"upstream"`
+}
+
+// Route forwards domains, with their subdomains, and reverse lookups of networks to a group.
+type Route struct {
+	Domains []string `yaml:"domains"`
+	Reverse []string `yaml:"reverse"` // CIDRs whose in-addr.arpa or ip6.arpa names are forwarded.
+	Group   string   `yaml:"group"`
+}
+
+// Zones returns the domains of the route and the reverse zones of its networks.
+func (r Route) Zones() ([]string, error) {
+	var zones []string
+	for _, domain := range r.Domains {
+		zones = append(zones, dns.CanonicalName(domain))
+	}
+	for _, cidr := range r.Reverse {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		zones = append(zones, ReverseZones(network)...)
+	}
+	return zones, nil
+}
+
+// Zones returns the zones of every route.
+func (f *Forwarding) Zones() []string {
+	var zones []string
+	for _, route := range f.Routes {
+		routeZones, _ := route.Zones() // Invalid routes are reported by validate.
+		zones = append(zones, routeZones...)
+	}
+	return zones
+}
+
+// validate checks the servers of every group and that every route names a
+// known group and valid networks.
+func (f *Forwarding) validate() error {
+	var errs []error
+	groups := make(map[string]bool)
+	for i, g := range f.Groups {
+		groups[g.Name] = true
+		if len(g.Upstream.Servers) == 0 {
+			errs = append(errs, fmt.Errorf("forwarding.groups[%d] (%s): no servers", i, g.Name))
+		}
+		if err := g.Upstream.validate(fmt.Sprintf("forwarding.groups[%d].upstream", i)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for i, route := range f.Routes {
+		if !groups[route.Group] {
+			errs = append(errs, fmt.Errorf("forwarding.routes[%d] (%s): unknown group", i, route.Group))
+		}
+		if _, err := route.Zones(); err != nil {
+			errs = append(errs, fmt.Errorf("forwarding.routes[%d] (%s): %w", i, route.Group, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ReverseZones returns the reverse zones covering a network. Prefixes that
+// do not fall on a label boundary (8 bits for IPv4, 4 for IPv6) are covered
+// by every zone at the next boundary, e.g. 172.16.0.0/12 by 16.172.in-addr.arpa.
+// through 31.172.in-addr.arpa.
+func ReverseZones(network *net.IPNet) []string {
+	ones, _ := network.Mask.Size()
+
+	var digits []int
+	var unit int
+	var suffix, format string
+	if ip := network.IP.To4(); ip != nil {
+		for _, b := range ip {
+			digits = append(digits, int(b))
+		}
+		unit, suffix, format = 8, "in-addr.arpa.", "%d"
+	} else {
+		for _, b := range network.IP.To16() {
+			digits = append(digits, int(b>>4), int(b&0xf))
+		}
+		unit, suffix, format = 4, "ip6.arpa.", "%x"
+	}
+
+	full, rem := ones/unit, ones%unit
+	zone := func(labels []int) string {
+		var b strings.Builder
+		for i := len(labels) - 1; i >= 0; i-- {
+			fmt.Fprintf(&b, format+".", labels[i])
+		}
+		return b.String() + suffix
+	}
+
+	if rem == 0 {
+		return []string{zone(digits[:full])}
+	}
+	count := 1 << (unit - rem)
+	start := digits[full] &^ (count - 1)
+	zones := make([]string, 0, count)
+	for v := start; v < start+count; v++ {
+		zones = append(zones, zone(append(append([]int(nil), digits[:full]...), v)))
+	}
+	return zones
+}
@@ -0,0 +1,40 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+// HostsFile is an /etc/hosts style file of addresses and host names.
+type HostsFile struct {
+	Path   string `yaml:"path"`
+	Domain string `yaml:"domain"` // Appended to names without a dot, e.g. lan.
+	TTL    int    `yaml:"ttl"`    // Defaults to 60.
+}
+
+// LeaseFile is a DHCP server lease database.
+type LeaseFile struct {
+	Path   string `yaml:"path"`
+	Format string `yaml:"format"` // dnsmasq or dhcpd.
+	Domain string `yaml:"domain"` // Appended to client host names, e.g. lan.
+	TTL    int    `yaml:"ttl"`    // Defaults to 60.
+}
+
+// validateFiles checks the hosts and lease file entries.
+func (l *Local) validateFiles() error {
+	var errs []error
+	for i, hf := range l.HostsFiles {
+		if hf.Path == "" {
+			errs = append(errs, fmt.Errorf("local.hostsFiles[%d]: missing path", i))
+		}
+	}
+	for i, lf := range l.LeaseFiles {
+		if lf.Path == "" {
+			errs = append(errs, fmt.Errorf("local.leaseFiles[%d]: missing path", i))
+		}
+		if lf.Format != "dnsmasq" && lf.Format != "dhcpd" {
+			errs = append(errs, fmt.Errorf("local.leaseFiles[%d] (%s): invalid format %q, expected dnsmasq or dhcpd", i, lf.Path, lf.Format))
+		}
+	}
+	return errors.Join(errs...)
+}
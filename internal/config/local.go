@@ -3,16 +3,35 @@ package config
 import (
 	"errors"
 	"fmt"
+	"net"
+	"strings"
 
 	"github.com/miekg/dns"
 )
 
 // Local groups DNS records by their type for easy management and parsing.
 type Local struct {
-	Standard []StandardRecord `yaml:"standard"`
+	Standard   []StandardRecord `yaml:"standard"`
+	A          []AddressRecord  `yaml:"a"`
+	AAAA       []AddressRecord  `yaml:"aaaa"`
+	CNAME      []TargetRecord   `yaml:"cname"`
+	PTR        []TargetRecord   `yaml:"ptr"`
+	NS         []TargetRecord   `yaml:"ns"`
+	MX         []MXRecord       `yaml:"mx"`
+	SRV        []SRVRecord      `yaml:"srv"`
+	CAA        []CAARecord      `yaml:"caa"`
+	SOA        []SOARecord      `yaml:"soa"`
+	TXT        []TXTRecord      `yaml:"txt"`
+	Zones      []Zone           `yaml:"zones"`
+	ZoneFiles  []ZoneFile       `yaml:"zoneFiles"`
+	HostsFiles []HostsFile      `yaml:"hostsFiles"`
+	LeaseFiles []LeaseFile      `yaml:"leaseFiles"`
+	Reverse    Reverse          `yaml:"reverse"`
+	Views      []View           `yaml:"views"`
 }
 
-// DNSRecord represents a DNS record with common fields.
+// StandardRecord is a record given in presentation format, e.g. type "A" and value "10.0.0.1".
+// It suits single-field types; the typed records below should be preferred for the rest.
 type StandardRecord struct {
 	Domain string `yaml:"domain"`
 	Type   string `yaml:"type"`
@@ -20,22 +39,355 @@ type StandardRecord struct {
 	TTL    int    `yaml:"ttl"`
 }
 
-func (sr StandardRecord) ToMsg() (*dns.Msg, error) {
-	msg := new(dns.Msg)
+// AddressRecord is an A or AAAA record.
+type AddressRecord struct {
+	Domain string `yaml:"domain"`
+	IP     string `yaml:"ip"`
+	TTL    int    `yaml:"ttl"`
+	PTR    bool   `yaml:"ptr"` // Also answer reverse lookups of IP with Domain.
+}
+
+// TargetRecord is a record pointing at another name: CNAME, PTR or NS.
+type TargetRecord struct {
+	Domain string `yaml:"domain"`
+	Target string `yaml:"target"`
+	TTL    int    `yaml:"ttl"`
+}
+
+type MXRecord struct {
+	Domain     string `yaml:"domain"`
+	Preference int    `yaml:"preference"`
+	Exchange   string `yaml:"exchange"`
+	TTL        int    `yaml:"ttl"`
+}
+
+type SRVRecord struct {
+	Domain   string `yaml:"domain"` // e.g. _ldap._tcp.corp.internal
+	Priority int    `yaml:"priority"`
+	Weight   int    `yaml:"weight"`
+	Port     int    `yaml:"port"`
+	Target   string `yaml:"target"`
+	TTL      int    `yaml:"ttl"`
+}
+
+type CAARecord struct {
+	Domain string `yaml:"domain"`
+	Flag   int    `yaml:"flag"`
+	Tag    string `yaml:"tag"` // issue, issuewild or iodef
+	Value  string `yaml:"value"`
+	TTL    int    `yaml:"ttl"`
+}
+
+type SOARecord struct {
+	Domain  string `yaml:"domain"`
+	NS      string `yaml:"ns"`
+	Mbox    string `yaml:"mbox"`
+	Serial  uint32 `yaml:"serial"`
+	Refresh uint32 `yaml:"refresh"`
+	Retry   uint32 `yaml:"retry"`
+	Expire  uint32 `yaml:"expire"`
+	MinTTL  uint32 `yaml:"minTTL"`
+	TTL     int    `yaml:"ttl"`
+}
+
+// TXTRecord holds one or more character strings, each sent as-is without quoting.
+type TXTRecord struct {
+	Domain string   `yaml:"domain"`
+	Values []string `yaml:"values"`
+	TTL    int      `yaml:"ttl"`
+}
+
+// validate checks the records, zones, zone files, hosts and lease files.
+func (l *Local) validate() error {
+	_, recordsErr := l.Records()
+	_, zonesErr := l.ZoneRecords()
+	_, zoneFilesErr := l.ZoneFileRecords()
+	return errors.Join(recordsErr, zonesErr, zoneFilesErr, l.validateFiles())
+}
+
+// Records converts every configured local record into a dns.RR.
+// All invalid entries are reported, each identified by its section and index.
+func (l *Local) Records() ([]dns.RR, error) {
+	var rrs []dns.RR
+	var errs []error
+
+	collect("standard", l.Standard, StandardRecord.RR, &rrs, &errs)
+	collect("a", l.A, withType(AddressRecord.RR, dns.TypeA), &rrs, &errs)
+	collect("aaaa", l.AAAA, withType(AddressRecord.RR, dns.TypeAAAA), &rrs, &errs)
+	collect("cname", l.CNAME, withType(TargetRecord.RR, dns.TypeCNAME), &rrs, &errs)
+	collect("ptr", l.PTR, withType(TargetRecord.RR, dns.TypePTR), &rrs, &errs)
+	collect("ns", l.NS, withType(TargetRecord.RR, dns.TypeNS), &rrs, &errs)
+	collect("mx", l.MX, MXRecord.RR, &rrs, &errs)
+	collect("srv", l.SRV, SRVRecord.RR, &rrs, &errs)
+	collect("caa", l.CAA, CAARecord.RR, &rrs, &errs)
+	collect("soa", l.SOA, SOARecord.RR, &rrs, &errs)
+	collect("txt", l.TXT, TXTRecord.RR, &rrs, &errs)
+	collect("a", l.A, withType(AddressRecord.PTRRecord, dns.TypeA), &rrs, &errs)
+	collect("aaaa", l.AAAA, withType(AddressRecord.PTRRecord, dns.TypeAAAA), &rrs, &errs)
+
+	return rrs, errors.Join(errs...)
+}
+
+// record is implemented by every local record type.
+type record interface {
+	name() string
+}
+
+func collect[T record](section string, entries []T, convert func(T) (dns.RR, error), rrs *[]dns.RR, errs *[]error) {
+	for i, entry := range entries {
+		rr, err := convert(entry)
+		if err != nil {
+			*errs = append(*errs, fmt.Errorf("local.%s[%d] (%s): %w", section, i, entry.name(), err))
+			continue
+		}
+		if rr != nil {
+			*rrs = append(*rrs, rr)
+		}
+	}
+}
+
+// withType binds the record type of records shared between several types.
+func withType[T record](convert func(T, uint16) (dns.RR, error), rrtype uint16) func(T) (dns.RR, error) {
+	return func(entry T) (dns.RR, error) {
+		return convert(entry, rrtype)
+	}
+}
 
-	// Set the question section of the message.
-	if rType, err := dns.StringToType[sr.Type]; err != true {
+func (sr StandardRecord) name() string { return sr.Domain }
+func (ar AddressRecord) name() string  { return ar.Domain }
+func (tr TargetRecord) name() string   { return tr.Domain }
+func (mr MXRecord) name() string       { return mr.Domain }
+func (sr SRVRecord) name() string      { return sr.Domain }
+func (cr CAARecord) name() string      { return cr.Domain }
+func (sr SOARecord) name() string      { return sr.Domain }
+func (tr TXTRecord) name() string      { return tr.Domain }
+
+func (sr StandardRecord) RR() (dns.RR, error) {
+	rrtype, ok := dns.StringToType[strings.ToUpper(sr.Type)]
+	if !ok {
 		return nil, errors.New("invalid record type: " + sr.Type)
-	} else {
-		msg.SetQuestion(sr.Domain+".", rType)
 	}
+	hdr, err := header(sr.Domain, rrtype, sr.TTL)
+	if err != nil {
+		return nil, err
+	}
+
+	rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", hdr.Name, hdr.Ttl, dns.TypeToString[rrtype], sr.Value))
+	if err != nil {
+		return nil, err
+	}
+	if rr == nil {
+		return nil, errors.New("missing value")
+	}
+	return rr, nil
+}
+
+func (ar AddressRecord) RR(rrtype uint16) (dns.RR, error) {
+	hdr, err := header(ar.Domain, rrtype, ar.TTL)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(ar.IP)
+	switch {
+	case ip == nil:
+		return nil, fmt.Errorf("invalid ip %q", ar.IP)
+	case hdr.Rrtype == dns.TypeA && ip.To4() == nil:
+		return nil, fmt.Errorf("ip %q is not an IPv4 address", ar.IP)
+	case hdr.Rrtype == dns.TypeAAAA && ip.To4() != nil:
+		return nil, fmt.Errorf("ip %q is not an IPv6 address", ar.IP)
+	case hdr.Rrtype == dns.TypeA:
+		return &dns.A{Hdr: hdr, A: ip.To4()}, nil
+	default:
+		return &dns.AAAA{Hdr: hdr, AAAA: ip}, nil
+	}
+}
+
+// PTRRecord returns the reverse record of an address record with PTR set, or nil.
+func (ar AddressRecord) PTRRecord(rrtype uint16) (dns.RR, error) {
+	if !ar.PTR {
+		return nil, nil
+	}
+	rr, err := ar.RR(rrtype)
+	if err != nil {
+		return nil, nil // Already reported for the address record itself.
+	}
+	return PTRFor(rr), nil
+}
+
+// PTRFor returns the PTR record pointing back at an A or AAAA record's owner,
+// or nil for other records and wildcard owners.
+func PTRFor(rr dns.RR) dns.RR {
+	var ip net.IP
+	switch r := rr.(type) {
+	case *dns.A:
+		ip = r.A
+	case *dns.AAAA:
+		ip = r.AAAA
+	default:
+		return nil
+	}
+	if strings.HasPrefix(rr.Header().Name, "*.") {
+		return nil
+	}
+
+	reverse, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		return nil
+	}
+	return &dns.PTR{
+		Hdr: dns.RR_Header{Name: reverse, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: rr.Header().Ttl},
+		Ptr: rr.Header().Name,
+	}
+}
+
+func (tr TargetRecord) RR(rrtype uint16) (dns.RR, error) {
+	hdr, err := header(tr.Domain, rrtype, tr.TTL)
+	if err != nil {
+		return nil, err
+	}
+	target, err := domainName("target", tr.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	switch hdr.Rrtype {
+	case dns.TypeCNAME:
+		return &dns.CNAME{Hdr: hdr, Target: target}, nil
+	case dns.TypePTR:
+		return &dns.PTR{Hdr: hdr, Ptr: target}, nil
+	default:
+		return &dns.NS{Hdr: hdr, Ns: target}, nil
+	}
+}
+
+func (mr MXRecord) RR() (dns.RR, error) {
+	hdr, err := header(mr.Domain, dns.TypeMX, mr.TTL)
+	if err != nil {
+		return nil, err
+	}
+	exchange, err := domainName("exchange", mr.Exchange)
+	if err != nil {
+		return nil, err
+	}
+	preference, err := uint16Field("preference", mr.Preference)
+	if err != nil {
+		return nil, err
+	}
+	return &dns.MX{Hdr: hdr, Preference: preference, Mx: exchange}, nil
+}
 
-	// Add the answer section of the message.
-	rr, err := dns.NewRR(sr.Domain + "." + " " + fmt.Sprint(sr.TTL) + " IN " + sr.Type + " " + sr.Value)
+func (sr SRVRecord) RR() (dns.RR, error) {
+	hdr, err := header(sr.Domain, dns.TypeSRV, sr.TTL)
 	if err != nil {
 		return nil, err
 	}
-	msg.Answer = append(msg.Answer, rr)
+	target, err := domainName("target", sr.Target)
+	if err != nil {
+		return nil, err
+	}
+	priority, err := uint16Field("priority", sr.Priority)
+	if err != nil {
+		return nil, err
+	}
+	weight, err := uint16Field("weight", sr.Weight)
+	if err != nil {
+		return nil, err
+	}
+	port, err := uint16Field("port", sr.Port)
+	if err != nil {
+		return nil, err
+	}
+	return &dns.SRV{Hdr: hdr, Priority: priority, Weight: weight, Port: port, Target: target}, nil
+}
 
-	return msg, nil
+func (cr CAARecord) RR() (dns.RR, error) {
+	hdr, err := header(cr.Domain, dns.TypeCAA, cr.TTL)
+	if err != nil {
+		return nil, err
+	}
+	if cr.Flag < 0 || cr.Flag > 255 {
+		return nil, fmt.Errorf("flag %d out of range 0-255", cr.Flag)
+	}
+	switch cr.Tag {
+	case "issue", "issuewild", "iodef":
+	default:
+		return nil, fmt.Errorf("invalid tag %q, expected issue, issuewild or iodef", cr.Tag)
+	}
+	return &dns.CAA{Hdr: hdr, Flag: uint8(cr.Flag), Tag: cr.Tag, Value: cr.Value}, nil
+}
+
+func (sr SOARecord) RR() (dns.RR, error) {
+	hdr, err := header(sr.Domain, dns.TypeSOA, sr.TTL)
+	if err != nil {
+		return nil, err
+	}
+	ns, err := domainName("ns", sr.NS)
+	if err != nil {
+		return nil, err
+	}
+	mbox, err := domainName("mbox", sr.Mbox)
+	if err != nil {
+		return nil, err
+	}
+	return &dns.SOA{
+		Hdr:     hdr,
+		Ns:      ns,
+		Mbox:    mbox,
+		Serial:  sr.Serial,
+		Refresh: sr.Refresh,
+		Retry:   sr.Retry,
+		Expire:  sr.Expire,
+		Minttl:  sr.MinTTL,
+	}, nil
+}
+
+func (tr TXTRecord) RR() (dns.RR, error) {
+	hdr, err := header(tr.Domain, dns.TypeTXT, tr.TTL)
+	if err != nil {
+		return nil, err
+	}
+	if len(tr.Values) == 0 {
+		return nil, errors.New("missing values")
+	}
+
+	values := make([]string, len(tr.Values))
+	for i, v := range tr.Values {
+		if len(v) > 255 {
+			return nil, fmt.Errorf("values[%d] is longer than 255 bytes", i)
+		}
+		// Values are sent verbatim, so escape what the presentation format would interpret.
+		values[i] = strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v)
+	}
+	return &dns.TXT{Hdr: hdr, Txt: values}, nil
+}
+
+// header validates the fields shared by every record.
+func header(domain string, rrtype uint16, ttl int) (dns.RR_Header, error) {
+	name, err := domainName("domain", domain)
+	if err != nil {
+		return dns.RR_Header{}, err
+	}
+	if ttl < 0 {
+		return dns.RR_Header{}, fmt.Errorf("negative ttl %d", ttl)
+	}
+	return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: uint32(ttl)}, nil
+}
+
+// domainName validates a name and returns it in lower-case, fully qualified form.
+func domainName(field, value string) (string, error) {
+	if value == "" {
+		return "", fmt.Errorf("missing %s", field)
+	}
+	if _, ok := dns.IsDomainName(value); !ok {
+		return "", fmt.Errorf("invalid %s %q", field, value)
+	}
+	return strings.ToLower(dns.Fqdn(value)), nil
+}
+
+func uint16Field(field string, value int) (uint16, error) {
+	if value < 0 || value > 65535 {
+		return 0, fmt.Errorf("%s %d out of range 0-65535", field, value)
+	}
+	return uint16(value), nil
 }
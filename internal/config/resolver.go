@@ -0,0 +1,13 @@
+package config
+
+// DefaultMaxCNAMEDepth is the number of CNAME hops followed when MaxCNAMEDepth is not set.
+const DefaultMaxCNAMEDepth = 8
+
+// DefaultWorkers is the number of queries answered concurrently when Workers is not set.
+const DefaultWorkers = 128
+
+// Resolver controls how the resolver assembles answers.
+type Resolver struct {
+	MaxCNAMEDepth int `yaml:"maxCNAMEDepth"` // CNAME hops followed per query across local records, cache and upstream.
+	Workers       int `yaml:"workers"`       // Queries answered concurrently; only read at startup.
+}
@@ -0,0 +1,56 @@
+package config
+
+import "github.com/miekg/dns"
+
+// Reverse controls reverse (PTR) lookups of local addresses.
+type Reverse struct {
+	SynthesizePTR bool `yaml:"synthesizePTR"` // PTR records for every local A and AAAA record.
+	PrivateZones  bool `yaml:"privateZones"`  // Answer RFC 1918 and ULA reverse zones authoritatively.
+
+	Forwarded []string `mapstructure:"-"` // Zones routed to a forwarder, set from the forwarding routes.
+}
+
+// PrivateReverseZones are the reverse zones of RFC 1918 and RFC 4193 (ULA)
+// address space, which must never be forwarded to public resolvers.
+var PrivateReverseZones = []string{
+	"10.in-addr.arpa.",
+	"16.172.in-addr.arpa.", "17.172.in-addr.arpa.", "18.172.in-addr.arpa.", "19.172.in-addr.arpa.",
+	"20.172.in-addr.arpa.", "21.172.in-addr.arpa.", "22.172.in-addr.arpa.", "23.172.in-addr.arpa.",
+	"24.172.in-addr.arpa.", "25.172.in-addr.arpa.", "26.172.in-addr.arpa.", "27.172.in-addr.arpa.",
+	"28.172.in-addr.arpa.", "29.172.in-addr.arpa.", "30.172.in-addr.arpa.", "31.172.in-addr.arpa.",
+	"168.192.in-addr.arpa.",
+	"c.f.ip6.arpa.", "d.f.ip6.arpa.",
+}
+
+// PrivateZoneRecords returns the SOA records of the private reverse zones,
+// using the RFC 6303 placeholder name server and mailbox. Private zones
+// within a forwarded zone are left to the forwarder; those containing one
+// are kept, and the forwarded names within them skipped when answering.
+func (l *Local) PrivateZoneRecords() ([]dns.RR, error) {
+	if !l.Reverse.PrivateZones {
+		return nil, nil
+	}
+
+	var rrs []dns.RR
+	for _, name := range PrivateReverseZones {
+		if l.Reverse.forwarded(name) {
+			continue
+		}
+		rr, err := Zone{Name: name, NS: "localhost.", Mbox: "nobody.invalid."}.RR()
+		if err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+// forwarded reports whether zone is within a forwarded zone.
+func (r *Reverse) forwarded(zone string) bool {
+	for _, f := range r.Forwarded {
+		if dns.IsSubDomain(f, zone) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,17 @@
+package config
+
+// Transfer controls outbound zone transfers (AXFR/IXFR) of authoritative
+// local zones. A transfer is allowed when the client matches Allow, if set,
+// and is signed with one of Keys, if set. With neither set, transfers are refused.
+type Transfer struct {
+	Allow  []string `yaml:"allow"`  // Client CIDRs allowed to transfer.
+	Keys   []string `yaml:"keys"`   // TSIG keys allowed to transfer.
+	Notify []string `yaml:"notify"` // Secondaries (host:port) sent a NOTIFY when a zone changes.
+}
+
+// Secondary is a zone pulled from a primary server and served as local records.
+type Secondary struct {
+	Zone    string `yaml:"zone"`
+	Primary string `yaml:"primary"` // host:port of the primary server.
+	Key     string `yaml:"key"`     // Optional TSIG key used to sign transfer requests.
+}
@@ -0,0 +1,8 @@
+package config
+
+// TSIGKey is a shared secret used to authenticate messages as per RFC 8945.
+type TSIGKey struct {
+	Name      string `yaml:"name"`      // Key name, e.g. dhcp-updater.
+	Algorithm string `yaml:"algorithm"` // hmac-sha256 (default), hmac-sha512, hmac-sha1 or hmac-sha224.
+	Secret    string `yaml:"secret"`    // Base64 encoded secret.
+}
@@ -0,0 +1,13 @@
+package config
+
+// Update controls RFC 2136 dynamic updates of authoritative local zones.
+type Update struct {
+	Enabled bool         `yaml:"enabled"`
+	Rules   []UpdateRule `yaml:"rules"`
+}
+
+// UpdateRule allows messages signed with Key to update the given zones.
+type UpdateRule struct {
+	Key   string   `yaml:"key"`
+	Zones []string `yaml:"zones"` // Empty means every authoritative zone.
+}
@@ -1,5 +1,14 @@
 package config
 
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
 type Strategy string
 
 const (
@@ -7,16 +16,139 @@ const (
 	StrategyRoundRobin Strategy = "round_robin"
 	StrategyLatency    Strategy = "latency"
 	StrategySequential Strategy = "sequential"
+	StrategyParallel   Strategy = "parallel"
+	StrategyWeighted   Strategy = "weighted"
 )
 
 type Upstream struct {
-	Strategy Strategy         `yaml:"strategy"`
-	Servers  []UpstreamServer `yaml:"servers"`
+	Strategy    Strategy         `yaml:"strategy"`
+	Servers     []UpstreamServer `yaml:"servers"`
+	HealthCheck HealthCheck      `yaml:"healthCheck"`
+	Retry       Retry            `yaml:"retry"`
+	Pool        Pool             `yaml:"pool"`
+	FanOut      int              `yaml:"fanOut"`      // Servers queried at once by the parallel strategy, 2 if unset.
+	Bootstrap   []string         `yaml:"bootstrap"`   // Servers (IP or IP:port) resolving upstream hostnames, the system resolver if unset.
+	Exploration float64          `yaml:"exploration"` // Share of latency strategy queries sent to another server, 0.05 if unset, negative to disable.
+	Recursion   Recursion        `yaml:"recursion"`
 }
 
 type UpstreamServer struct {
 	Name    string `yaml:"name"`
 	IP      string `yaml:"ip"`
-	Port    int    `yaml:"port"`
+	Host    string `yaml:"host"` // Hostname resolved through the bootstrap servers, used when IP is unset.
+	Port    int    `yaml:"port"` // 53 if unset.
 	Timeout int    `yaml:"timeout"`
+	Weight  int    `yaml:"weight"` // Relative share of queries under the weighted strategy, 1 if unset.
+
+	Protocol      string `yaml:"protocol"`      // udp, tcp, tls (DNS over TLS) or recursive, udp if unset.
+	TLSServerName string `yaml:"tlsServerName"` // Name verified in the server's certificate, the host or IP if unset.
+}
+
+// validate checks that every server has a known protocol and an address, and
+// that bootstrap servers, which resolve server hostnames, are IP addresses.
+// section names the upstream in errors.
+func (u *Upstream) validate(section string) error {
+	var errs []error
+	for i, b := range u.Bootstrap {
+		host, _, err := net.SplitHostPort(b)
+		if err != nil {
+			host = b
+		}
+		if net.ParseIP(host) == nil {
+			errs = append(errs, fmt.Errorf("%s.bootstrap[%d] (%s): not an IP address", section, i, b))
+		}
+	}
+	for i, s := range u.Servers {
+		if err := s.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("%s.servers[%d] (%s): %w", section, i, s.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *UpstreamServer) validate() error {
+	switch strings.ToLower(s.Protocol) {
+	case "", "udp", "tcp", "tls":
+	case "recursive":
+		return nil // Resolves from the root servers, without an address.
+	default:
+		return fmt.Errorf("unknown protocol %q", s.Protocol)
+	}
+
+	host := s.Host
+	switch {
+	case s.IP != "" && net.ParseIP(s.IP) != nil:
+		return nil
+	case s.IP != "" && host == "":
+		host = s.IP // Hostnames given as ip are resolved like host.
+	case host == "":
+		return errors.New("no ip or host")
+	}
+	if !resolvable(host) {
+		return fmt.Errorf("host %q cannot be resolved", host)
+	}
+	return nil
+}
+
+// resolvable reports whether host is a name that bootstrap servers or the
+// system resolver can look up: a domain name of letters, digits, hyphens
+// and underscores whose last label is not numeric, as in a mistyped IP.
+func resolvable(host string) bool {
+	if _, ok := dns.IsDomainName(host); !ok {
+		return false
+	}
+	labels := dns.SplitDomainName(host)
+	if len(labels) == 0 {
+		return false
+	}
+	for _, label := range labels {
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return strings.Trim(labels[len(labels)-1], "0123456789") != ""
+}
+
+// QNAME minimisation modes.
+const (
+	MinimisationOff     = "off"
+	MinimisationRelaxed = "relaxed" // Fall back to the full name when a server fails a minimised query.
+	MinimisationStrict  = "strict"  // Trust NXDOMAIN for ancestors of the name, as per RFC 8020.
+)
+
+// Recursion controls servers with the recursive protocol, which resolve
+// queries iteratively from the root servers instead of forwarding them.
+type Recursion struct {
+	Roots             []string `yaml:"roots"`             // Root servers (IP or IP:port), the built-in root hints if unset.
+	MaxDepth          int      `yaml:"maxDepth"`          // Referrals, CNAMEs and name server lookups followed per query, 16 if unset.
+	QNAMEMinimisation string   `yaml:"qnameMinimisation"` // off, relaxed or strict (RFC 9156), relaxed if unset.
+	Timeout           int      `yaml:"timeout"`           // Seconds allowed to resolve one query, 10 if unset.
+	Port              int      `yaml:"port"`              // Port of authoritative name servers, 53 if unset.
+}
+
+// Pool controls the sockets and connections kept open to each upstream server.
+type Pool struct {
+	UDPSockets  int `yaml:"udpSockets"`  // Pre-bound UDP sockets kept per server, 8 if unset.
+	Connections int `yaml:"connections"` // TCP or TLS connections per server, each pipelining many queries, 2 if unset.
+	IdleTimeout int `yaml:"idleTimeout"` // Seconds before an unused connection is closed, 30 if unset.
+}
+
+// HealthCheck controls how unhealthy upstream servers are detected. Failures
+// of client queries are always tracked; Enabled adds active probes.
+type HealthCheck struct {
+	Enabled    bool   `yaml:"enabled"`
+	Name       string `yaml:"name"`       // Name probed with an NS query, "." if unset.
+	Interval   int    `yaml:"interval"`   // Seconds between probes, 10 if unset.
+	Failures   int    `yaml:"failures"`   // Consecutive failures marking a server down, 3 if unset.
+	Backoff    int    `yaml:"backoff"`    // Seconds before a down server is retried, 5 if unset. Doubles on each failed retry.
+	MaxBackoff int    `yaml:"maxBackoff"` // Upper bound of the retry backoff in seconds, 300 if unset.
+}
+
+// Retry controls failover to other servers when a query times out or is
+// answered with SERVFAIL or REFUSED.
+type Retry struct {
+	Attempts int `yaml:"attempts"` // Servers tried per query, every server if unset.
+	Deadline int `yaml:"deadline"` // Seconds allowed for every attempt of a query, 5 if unset or the timeout of recursive servers if longer.
 }
@@ -0,0 +1,53 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/bwoff11/go-resolve/internal/common"
+)
+
+// View is a split-horizon set of local records served to matching clients.
+// Names a view defines are answered from it; every other name falls back to
+// the default local records. A view's own views are ignored.
+type View struct {
+	Name       string   `yaml:"name"`
+	CIDRs      []string `yaml:"cidrs"`      // Client networks the view applies to.
+	Transports []string `yaml:"transports"` // Optional: listening transports (udp, tcp) the view applies to.
+	Interfaces []string `yaml:"interfaces"` // Optional: network interfaces, such as wg0, whose addresses queries must be sent to.
+	Records    Local    `yaml:"records"`
+}
+
+// validateViews checks each view's networks, transports, interfaces and records.
+func (l *Local) validateViews() error {
+	var errs []error
+	for i, v := range l.Views {
+		wrap := func(err error) error {
+			return fmt.Errorf("local.views[%d] (%s): %w", i, v.Name, err)
+		}
+		for _, cidr := range v.CIDRs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				errs = append(errs, wrap(err))
+			}
+		}
+		for _, t := range v.Transports {
+			switch common.Protocol(t) {
+			case common.ProtocolUDP, common.ProtocolTCP:
+			case common.ProtocolDOT, common.ProtocolDOH:
+				errs = append(errs, wrap(fmt.Errorf("transport %q has no listener", t)))
+			default:
+				errs = append(errs, wrap(fmt.Errorf("unknown transport %q", t)))
+			}
+		}
+		for _, name := range v.Interfaces {
+			if name == "" {
+				errs = append(errs, wrap(errors.New("empty interface name")))
+			}
+		}
+		if err := v.Records.validate(); err != nil {
+			errs = append(errs, wrap(err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"errors"
+
+	"github.com/miekg/dns"
+)
+
+// Zone declares a local zone go-resolve is authoritative for. Names in the
+// zone without local records are answered with NXDOMAIN or NODATA instead
+// of being forwarded upstream. Unset SOA fields use the defaults below,
+// and a SOA record configured at the zone apex takes precedence.
+type Zone struct {
+	Name    string `yaml:"name"`
+	NS      string `yaml:"ns"`      // Defaults to ns.<name>.
+	Mbox    string `yaml:"mbox"`    // Defaults to hostmaster.<name>.
+	Serial  uint32 `yaml:"serial"`  // Defaults to 1.
+	Refresh uint32 `yaml:"refresh"` // Defaults to 3600.
+	Retry   uint32 `yaml:"retry"`   // Defaults to 600.
+	Expire  uint32 `yaml:"expire"`  // Defaults to 86400.
+	MinTTL  uint32 `yaml:"minTTL"`  // Negative caching TTL, defaults to 300.
+	TTL     int    `yaml:"ttl"`     // Defaults to 3600.
+}
+
+// ZoneRecords returns the SOA record of every configured zone.
+func (l *Local) ZoneRecords() ([]dns.RR, error) {
+	var rrs []dns.RR
+	var errs []error
+	collect("zones", l.Zones, Zone.RR, &rrs, &errs)
+	return rrs, errors.Join(errs...)
+}
+
+func (z Zone) name() string { return z.Name }
+
+// RR returns the zone's SOA record.
+func (z Zone) RR() (dns.RR, error) {
+	ttl := z.TTL
+	if ttl == 0 {
+		ttl = 3600
+	}
+	hdr, err := header(z.Name, dns.TypeSOA, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	soa := &dns.SOA{
+		Hdr:     hdr,
+		Ns:      "ns." + hdr.Name,
+		Mbox:    "hostmaster." + hdr.Name,
+		Serial:  orDefault(z.Serial, 1),
+		Refresh: orDefault(z.Refresh, 3600),
+		Retry:   orDefault(z.Retry, 600),
+		Expire:  orDefault(z.Expire, 86400),
+		Minttl:  orDefault(z.MinTTL, 300),
+	}
+	if z.NS != "" {
+		if soa.Ns, err = domainName("ns", z.NS); err != nil {
+			return nil, err
+		}
+	}
+	if z.Mbox != "" {
+		if soa.Mbox, err = domainName("mbox", z.Mbox); err != nil {
+			return nil, err
+		}
+	}
+	return soa, nil
+}
+
+func orDefault(value, fallback uint32) uint32 {
+	if value == 0 {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/miekg/dns"
+)
+
+// ZoneFile is a master file in RFC 1035 format. $ORIGIN, $TTL, $INCLUDE and
+// relative names are supported. A SOA record in the file makes its owner an
+// authoritative local zone.
+type ZoneFile struct {
+	Path   string `yaml:"path"`
+	Origin string `yaml:"origin"` // Initial origin for relative names, e.g. lab.corp.
+}
+
+// ZoneFileRecords parses every configured zone file.
+func (l *Local) ZoneFileRecords() ([]dns.RR, error) {
+	var rrs []dns.RR
+	var errs []error
+	for i, zf := range l.ZoneFiles {
+		records, err := zf.Records()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("local.zoneFiles[%d] (%s): %w", i, zf.Path, err))
+			continue
+		}
+		rrs = append(rrs, records...)
+	}
+	return rrs, errors.Join(errs...)
+}
+
+// Records parses the zone file. Parse errors include the file and line.
+func (zf ZoneFile) Records() ([]dns.RR, error) {
+	f, err := os.Open(zf.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	origin := ""
+	if zf.Origin != "" {
+		origin = dns.Fqdn(zf.Origin)
+	}
+
+	zp := dns.NewZoneParser(f, origin, zf.Path)
+	zp.SetIncludeAllowed(true)
+
+	var rrs []dns.RR
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	return rrs, nil
+}
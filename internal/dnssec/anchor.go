@@ -0,0 +1,266 @@
+package dnssec
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// holdDown is how long a new key must be seen in a zone's validated DNSKEY
+// set before it is trusted, the add hold-down time of RFC 5011.
+const holdDown = 30 * 24 * time.Hour
+
+// rootAnchors are the DS records of the root zone KSKs published by IANA.
+var rootAnchors = []string{
+	". 86400 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". 86400 IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// Trust anchor states.
+const (
+	stateValid   = "valid"
+	statePending = "pending" // Seen, but still within the hold-down time.
+	stateRevoked = "revoked" // Revoked by its own key, never trusted again.
+)
+
+type anchor struct {
+	rr        dns.RR // DS or DNSKEY.
+	state     string
+	firstSeen time.Time
+}
+
+// anchors holds the trust anchors of each zone. Anchors learned or revoked
+// through RFC 5011 rollovers are written to file, if set, which then
+// replaces the configured anchors on the next start.
+type anchors struct {
+	mutex sync.Mutex
+	file  string
+	zones map[string][]*anchor
+}
+
+func newAnchors(records []string, file string) *anchors {
+	a := &anchors{file: file, zones: make(map[string][]*anchor)}
+	if file != "" {
+		if err := a.load(); err == nil {
+			return a
+		} else if !os.IsNotExist(err) {
+			log.Error().Err(err).Str("file", file).Msg("failed to load trust anchor state")
+		}
+	}
+
+	if len(records) == 0 {
+		records = rootAnchors
+	}
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil || (rr.Header().Rrtype != dns.TypeDS && rr.Header().Rrtype != dns.TypeDNSKEY) {
+			log.Error().Err(err).Str("record", record).Msg("invalid trust anchor, expected a DS or DNSKEY record")
+			continue
+		}
+		a.add(&anchor{rr: rr, state: stateValid})
+	}
+	return a
+}
+
+func (a *anchors) add(an *anchor) {
+	zone := dns.CanonicalName(an.rr.Header().Name)
+	a.zones[zone] = append(a.zones[zone], an)
+}
+
+// closest returns the closest zone enclosing name with a valid anchor, or "".
+func (a *anchors) closest(name string) string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	name = dns.CanonicalName(name)
+	for _, i := range append(dns.Split(name), len(name)-1) {
+		for _, an := range a.zones[name[i:]] {
+			if an.state == stateValid {
+				return name[i:]
+			}
+		}
+	}
+	return ""
+}
+
+// trusts reports whether key matches a valid anchor of its zone.
+func (a *anchors) trusts(key *dns.DNSKEY) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for _, an := range a.zones[dns.CanonicalName(key.Hdr.Name)] {
+		if an.state == stateValid && matches(an.rr, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// update applies the RFC 5011 rules to the validated DNSKEY set of an anchor
+// zone: new key signing keys become pending and are trusted once they have
+// been seen for the hold-down time, pending keys that disappear are
+// forgotten, and keys revoked with a signature of their own are distrusted.
+func (a *anchors) update(zone string, keys []*dns.DNSKEY, sigs []*dns.RRSIG, set []dns.RR, now time.Time) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	zone = dns.CanonicalName(zone)
+	changed := false
+	for _, key := range keys {
+		if key.Flags&dns.SEP == 0 {
+			continue
+		}
+		existing := a.find(zone, key)
+
+		if key.Flags&dns.REVOKE != 0 {
+			if existing != nil && existing.state != stateRevoked && selfSigned(key, sigs, set, now) {
+				log.Warn().Str("zone", zone).Uint16("keytag", existing.keyTag()).Msg("trust anchor revoked")
+				existing.rr, existing.state = key, stateRevoked
+				changed = true
+			}
+			continue
+		}
+
+		switch {
+		case existing == nil:
+			log.Info().Str("zone", zone).Uint16("keytag", key.KeyTag()).Msg("new trust anchor key seen, waiting for hold-down")
+			a.zones[zone] = append(a.zones[zone], &anchor{rr: key, state: statePending, firstSeen: now})
+			changed = true
+		case existing.state == statePending && now.Sub(existing.firstSeen) >= holdDown:
+			log.Info().Str("zone", zone).Uint16("keytag", key.KeyTag()).Msg("trust anchor added")
+			existing.state = stateValid
+			changed = true
+		}
+	}
+
+	kept := a.zones[zone][:0]
+	for _, an := range a.zones[zone] {
+		if an.state == statePending && !present(an, keys) {
+			log.Info().Str("zone", zone).Uint16("keytag", an.keyTag()).Msg("pending trust anchor key removed before hold-down")
+			changed = true
+			continue
+		}
+		kept = append(kept, an)
+	}
+	a.zones[zone] = kept
+
+	if changed {
+		if err := a.save(); err != nil {
+			log.Error().Err(err).Str("file", a.file).Msg("failed to save trust anchor state")
+		}
+	}
+}
+
+// find returns the anchor of zone matching key, ignoring its revoke flag.
+func (a *anchors) find(zone string, key *dns.DNSKEY) *anchor {
+	for _, an := range a.zones[zone] {
+		if matches(an.rr, key) {
+			return an
+		}
+	}
+	return nil
+}
+
+// load reads the anchors from file, one "state first-seen record" per line.
+func (a *anchors) load() error {
+	f, err := os.Open(a.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, ";") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 {
+			return fmt.Errorf("invalid trust anchor line %q", line)
+		}
+		seen, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		rr, err := dns.NewRR(fields[2])
+		if err != nil {
+			return err
+		}
+		a.add(&anchor{rr: rr, state: fields[0], firstSeen: time.Unix(seen, 0)})
+	}
+	return scanner.Err()
+}
+
+// save writes the anchors to file, replacing it atomically.
+func (a *anchors) save() error {
+	if a.file == "" {
+		return nil
+	}
+
+	var b strings.Builder
+	b.WriteString("; Trust anchors managed as per RFC 5011: state, first seen (unix time), record.\n")
+	for _, zone := range a.zones {
+		for _, an := range zone {
+			fmt.Fprintf(&b, "%s %d %s\n", an.state, an.firstSeen.Unix(), an.rr.String())
+		}
+	}
+
+	tmp := a.file + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.file)
+}
+
+func (an *anchor) keyTag() uint16 {
+	switch rr := an.rr.(type) {
+	case *dns.DS:
+		return rr.KeyTag
+	case *dns.DNSKEY:
+		return rr.KeyTag()
+	}
+	return 0
+}
+
+// matches reports whether anchor, a DS or DNSKEY record, designates key.
+// The revoke flag of key is ignored.
+func matches(anchor dns.RR, key *dns.DNSKEY) bool {
+	switch a := anchor.(type) {
+	case *dns.DS:
+		k := *key
+		k.Flags &^= dns.REVOKE
+		ds := k.ToDS(a.DigestType)
+		return ds != nil && a.KeyTag == ds.KeyTag && a.Algorithm == k.Algorithm && strings.EqualFold(a.Digest, ds.Digest)
+	case *dns.DNSKEY:
+		return a.Algorithm == key.Algorithm && a.PublicKey == key.PublicKey
+	}
+	return false
+}
+
+// present reports whether a key of keys matches the anchor.
+func present(an *anchor, keys []*dns.DNSKEY) bool {
+	for _, key := range keys {
+		if matches(an.rr, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// selfSigned reports whether key has signed set itself.
+func selfSigned(key *dns.DNSKEY, sigs []*dns.RRSIG, set []dns.RR, now time.Time) bool {
+	for _, sig := range sigs {
+		if sig.KeyTag == key.KeyTag() && sig.ValidityPeriod(now) && sig.Verify(key, set) == nil {
+			return true
+		}
+	}
+	return false
+}
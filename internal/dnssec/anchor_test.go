@@ -0,0 +1,182 @@
+package dnssec
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// keySet returns the DNSKEY RRset of the root holding keys, signed by signers.
+func keySet(t *testing.T, keys []*dns.DNSKEY, signers ...*signer) ([]dns.RR, []*dns.RRSIG) {
+	t.Helper()
+	var set []dns.RR
+	for _, key := range keys {
+		set = append(set, key)
+	}
+	var sigs []*dns.RRSIG
+	for _, s := range signers {
+		signed := s.sign(t, set...)
+		sigs = append(sigs, signed[len(signed)-1].(*dns.RRSIG))
+	}
+	return set, sigs
+}
+
+// revoked returns a copy of the key of s with the revoke flag set, and
+// changes s to sign with it.
+func revoked(s *signer) *dns.DNSKEY {
+	key := *s.key
+	key.Flags |= dns.REVOKE
+	s.key = &key
+	return &key
+}
+
+func state(a *anchors, key *dns.DNSKEY) string {
+	if an := a.find(".", key); an != nil {
+		return an.state
+	}
+	return ""
+}
+
+func TestAnchorsUpdate(t *testing.T) {
+	t0 := time.Now()
+
+	t.Run("hold-down", func(t *testing.T) {
+		current, next := newSigner(t, "."), newSigner(t, ".")
+		a := newAnchors([]string{current.ds().String()}, "")
+		keys := []*dns.DNSKEY{current.key, next.key}
+		set, sigs := keySet(t, keys, current)
+
+		a.update(".", keys, sigs, set, t0)
+		if got := state(a, next.key); got != statePending {
+			t.Fatalf("new key state = %q, want %q", got, statePending)
+		}
+		if a.trusts(next.key) {
+			t.Error("pending key trusted")
+		}
+
+		a.update(".", keys, sigs, set, t0.Add(holdDown-time.Second))
+		if got := state(a, next.key); got != statePending {
+			t.Fatalf("key state before hold-down = %q, want %q", got, statePending)
+		}
+
+		a.update(".", keys, sigs, set, t0.Add(holdDown))
+		if got := state(a, next.key); got != stateValid {
+			t.Fatalf("key state after hold-down = %q, want %q", got, stateValid)
+		}
+		if !a.trusts(next.key) {
+			t.Error("key not trusted after hold-down")
+		}
+	})
+
+	t.Run("pending removal", func(t *testing.T) {
+		current, next := newSigner(t, "."), newSigner(t, ".")
+		a := newAnchors([]string{current.ds().String()}, "")
+		set, sigs := keySet(t, []*dns.DNSKEY{current.key, next.key}, current)
+		a.update(".", []*dns.DNSKEY{current.key, next.key}, sigs, set, t0)
+
+		set, sigs = keySet(t, []*dns.DNSKEY{current.key}, current)
+		a.update(".", []*dns.DNSKEY{current.key}, sigs, set, t0.Add(24*time.Hour))
+		if got := state(a, next.key); got != "" {
+			t.Fatalf("removed pending key state = %q, want it forgotten", got)
+		}
+
+		// Seen again, it starts a new hold-down.
+		set, sigs = keySet(t, []*dns.DNSKEY{current.key, next.key}, current)
+		a.update(".", []*dns.DNSKEY{current.key, next.key}, sigs, set, t0.Add(holdDown))
+		if got := state(a, next.key); got != statePending {
+			t.Errorf("key state = %q, want %q", got, statePending)
+		}
+	})
+
+	t.Run("revoke", func(t *testing.T) {
+		old, next := newSigner(t, "."), newSigner(t, ".")
+		a := newAnchors([]string{old.ds().String(), next.ds().String()}, "")
+		original := old.key
+		key := revoked(old)
+		keys := []*dns.DNSKEY{key, next.key}
+		set, sigs := keySet(t, keys, old, next)
+
+		a.update(".", keys, sigs, set, t0)
+		if got := state(a, key); got != stateRevoked {
+			t.Fatalf("revoked key state = %q, want %q", got, stateRevoked)
+		}
+		if a.trusts(original) || a.trusts(key) {
+			t.Error("revoked key trusted")
+		}
+		if !a.trusts(next.key) {
+			t.Error("remaining key not trusted")
+		}
+	})
+
+	t.Run("revoke without self-signature", func(t *testing.T) {
+		old, next := newSigner(t, "."), newSigner(t, ".")
+		a := newAnchors([]string{old.ds().String(), next.ds().String()}, "")
+		original := old.key
+		keys := []*dns.DNSKEY{revoked(old), next.key}
+		set, sigs := keySet(t, keys, next)
+
+		a.update(".", keys, sigs, set, t0)
+		if !a.trusts(original) {
+			t.Error("key distrusted without a signature of its revoked self")
+		}
+	})
+
+	t.Run("zone signing keys ignored", func(t *testing.T) {
+		current, zsk := newSigner(t, "."), newSigner(t, ".")
+		zsk.key.Flags = dns.ZONE
+		a := newAnchors([]string{current.ds().String()}, "")
+		keys := []*dns.DNSKEY{current.key, zsk.key}
+		set, sigs := keySet(t, keys, current)
+
+		a.update(".", keys, sigs, set, t0)
+		if got := state(a, zsk.key); got != "" {
+			t.Errorf("zone signing key state = %q, want none", got)
+		}
+	})
+
+	t.Run("state file", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "anchors")
+		current, next := newSigner(t, "."), newSigner(t, ".")
+		a := newAnchors([]string{current.ds().String()}, file)
+		keys := []*dns.DNSKEY{current.key, next.key}
+		set, sigs := keySet(t, keys, current)
+		a.update(".", keys, sigs, set, t0)
+
+		loaded := newAnchors(nil, file)
+		if !loaded.trusts(current.key) {
+			t.Error("configured anchor lost on reload")
+		}
+		an := loaded.find(".", next.key)
+		if an == nil || an.state != statePending || an.firstSeen.Unix() != t0.Unix() {
+			t.Fatalf("reloaded pending anchor = %+v, want pending since %v", an, t0)
+		}
+
+		loaded.update(".", keys, sigs, set, t0.Add(holdDown))
+		if !loaded.trusts(next.key) {
+			t.Error("reloaded pending key not trusted after hold-down")
+		}
+	})
+}
+
+func TestAnchorsClosest(t *testing.T) {
+	root, example := newSigner(t, "."), newSigner(t, "example.")
+	a := newAnchors([]string{root.ds().String(), example.key.String()}, "")
+
+	tests := map[string]string{
+		".":            ".",
+		"org.":         ".",
+		"example.":     "example.",
+		"www.EXAMPLE.": "example.",
+	}
+	for name, want := range tests {
+		if got := a.closest(name); got != want {
+			t.Errorf("closest(%s) = %q, want %q", name, got, want)
+		}
+	}
+
+	if got := newAnchors([]string{example.key.String()}, "").closest("org."); got != "" {
+		t.Errorf("closest(org.) without a root anchor = %q, want none", got)
+	}
+}
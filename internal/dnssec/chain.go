@@ -0,0 +1,260 @@
+package dnssec
+
+import (
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	maxCutTTL = time.Hour        // Upper bound on how long the state of a name is kept.
+	bogusTTL  = 30 * time.Second // How long a broken chain of trust is kept before it is fetched again.
+	maxCuts   = 10000            // Names kept before expired entries are purged.
+)
+
+// cut is the validated state of a name: the closest enclosing zone with its
+// validated keys if it is secure.
+type cut struct {
+	Result
+	zone    string
+	keys    []*dns.DNSKEY
+	expires time.Time
+}
+
+// building is the state of a name being built by one query, which others
+// needing it wait for instead of fetching the same records again.
+type building struct {
+	done chan struct{}
+	cut  cut // Set before done is closed.
+}
+
+// chain returns the state of name, built top-down from the closest trust
+// anchor. Each name below the anchor is checked for a DS RRset signed by the
+// zone above it; a signed proof that a delegation has no DS makes everything
+// below it insecure. Names without an anchor above them are insecure.
+func (v *Validator) chain(name string) cut {
+	name = dns.CanonicalName(name)
+	now := time.Now()
+
+	v.mutex.Lock()
+	if c, ok := v.cuts[name]; ok && now.Before(c.expires) {
+		v.mutex.Unlock()
+		return c
+	}
+	if b, ok := v.building[name]; ok {
+		v.mutex.Unlock()
+		<-b.done
+		return b.cut
+	}
+	b := &building{done: make(chan struct{})}
+	v.building[name] = b
+	v.mutex.Unlock()
+
+	c := v.build(name, now)
+
+	v.mutex.Lock()
+	if len(v.cuts) >= maxCuts {
+		for n, entry := range v.cuts {
+			if !now.Before(entry.expires) {
+				delete(v.cuts, n)
+			}
+		}
+	}
+	v.cuts[name] = c
+	delete(v.building, name)
+	v.mutex.Unlock()
+
+	b.cut = c
+	close(b.done)
+	return c
+}
+
+// build works out the state of name from the state of its parent, which
+// chain builds first if needed. Names at or below a negative trust anchor
+// are insecure.
+func (v *Validator) build(name string, now time.Time) cut {
+	if v.insecure[name] {
+		log.Debug().Str("zone", name).Msg("negative trust anchor")
+		return cut{Result: Result{Security: Insecure}, expires: now.Add(maxCutTTL)}
+	}
+	switch anchor := v.anchors.closest(name); anchor {
+	case "":
+		return cut{Result: Result{Security: Insecure}, expires: now.Add(maxCutTTL)}
+	case name:
+		return v.anchorKeys(name, now)
+	}
+	c := v.chain(parent(name))
+	if c.Security != Secure {
+		return c
+	}
+	return v.step(c, name, now)
+}
+
+// anchorKeys fetches the DNSKEY RRset of an anchored zone and validates it
+// with a key matching a trust anchor, then updates the anchors from it.
+func (v *Validator) anchorKeys(zone string, now time.Time) cut {
+	resp := v.query(zone, dns.TypeDNSKEY)
+	if resp == nil {
+		return cut{Result: bogus(dns.ExtendedErrorCodeNoReachableAuthority, "no DNSKEY response for "+zone), expires: now.Add(bogusTTL)}
+	}
+	set, keys, sigs := dnskeys(resp, zone)
+	c := verifyKeys(zone, set, keys, sigs, v.anchors.trusts, now)
+	if c.Security == Secure {
+		v.anchors.update(zone, keys, sigs, set, now)
+	}
+	return c
+}
+
+// step extends the secure state of the parent of name to name. A signed DS
+// RRset makes name a secure zone; a signed proof of a delegation without DS
+// makes it insecure; anything else leaves it within the parent's zone.
+func (v *Validator) step(above cut, name string, now time.Time) cut {
+	resp := v.query(name, dns.TypeDS)
+	if resp == nil {
+		return cut{Result: bogus(dns.ExtendedErrorCodeNoReachableAuthority, "no DS response for "+name), expires: now.Add(bogusTTL)}
+	}
+
+	var ds []dns.RR
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype == dns.TypeDS && strings.EqualFold(rr.Header().Name, name) {
+			ds = append(ds, rr)
+		}
+	}
+
+	if len(ds) == 0 {
+		if has(resp.Answer, name, dns.TypeCNAME) {
+			return above // An alias is never a zone cut.
+		}
+		if r := verifyAuthority(resp.Ns, above.zone, above.keys, now); r.Security != Secure {
+			return cut{Result: r, expires: now.Add(bogusTTL)}
+		}
+		if insecureDelegation(resp.Ns, name) || nsec3IterationsTooHigh(resp.Ns) {
+			log.Debug().Str("zone", name).Msg("insecure delegation")
+			return cut{Result: Result{Security: Insecure}, expires: now.Add(ttl(resp.Ns))}
+		}
+		if resp.Rcode == dns.RcodeSuccess && len(resp.Ns) == 0 {
+			return cut{Result: bogus(dns.ExtendedErrorCodeNSECMissing, "no proof of missing DS for "+name), expires: now.Add(bogusTTL)}
+		}
+		return above // No zone cut at name.
+	}
+
+	if r := verify(ds, signatures(resp.Answer, ds), above.zone, above.keys, now); r.Security != Secure {
+		return cut{Result: r, expires: now.Add(bogusTTL)}
+	}
+	if !anySupported(ds) {
+		log.Debug().Str("zone", name).Msg("no supported DS algorithm, treating zone as insecure")
+		return cut{Result: Result{Security: Insecure}, expires: now.Add(ttl(ds))}
+	}
+
+	keyResp := v.query(name, dns.TypeDNSKEY)
+	if keyResp == nil {
+		return cut{Result: bogus(dns.ExtendedErrorCodeNoReachableAuthority, "no DNSKEY response for "+name), expires: now.Add(bogusTTL)}
+	}
+	set, keys, sigs := dnskeys(keyResp, name)
+	trusted := func(key *dns.DNSKEY) bool {
+		for _, rr := range ds {
+			if matches(rr, key) {
+				return true
+			}
+		}
+		return false
+	}
+	c := verifyKeys(name, set, keys, sigs, trusted, now)
+	if c.Security == Secure {
+		c.expires = now.Add(min(ttl(ds), ttl(set), maxCutTTL))
+	}
+	return c
+}
+
+// verifyKeys validates the DNSKEY RRset of zone with one of its trusted keys.
+func verifyKeys(zone string, set []dns.RR, keys []*dns.DNSKEY, sigs []*dns.RRSIG, trusted func(*dns.DNSKEY) bool, now time.Time) cut {
+	failed := cut{Result: bogus(dns.ExtendedErrorCodeDNSKEYMissing, "no trusted DNSKEY for "+zone), expires: now.Add(bogusTTL)}
+	if len(set) == 0 {
+		return failed
+	}
+
+	var zoneKeys, trustedKeys []*dns.DNSKEY
+	for _, key := range keys {
+		if key.Flags&dns.ZONE == 0 || key.Flags&dns.REVOKE != 0 {
+			continue
+		}
+		zoneKeys = append(zoneKeys, key)
+		if trusted(key) {
+			trustedKeys = append(trustedKeys, key)
+		}
+	}
+	if len(trustedKeys) == 0 {
+		return failed
+	}
+
+	if r := verify(set, sigs, zone, trustedKeys, now); r.Security != Secure {
+		return cut{Result: r, expires: now.Add(bogusTTL)}
+	}
+	return cut{
+		Result:  Result{Security: Secure},
+		zone:    zone,
+		keys:    zoneKeys,
+		expires: now.Add(min(ttl(set), maxCutTTL)),
+	}
+}
+
+// query fetches records of name for validation, with DO and CD set so that
+// signatures are returned even by validating upstreams.
+func (v *Validator) query(name string, qtype uint16) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	msg.CheckingDisabled = true
+	SetDO(msg)
+
+	resp := v.exchange(msg)
+	if resp == nil || (resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError) {
+		return nil
+	}
+	return resp
+}
+
+// dnskeys returns the DNSKEY RRset of zone in resp, its keys and signatures.
+func dnskeys(resp *dns.Msg, zone string) ([]dns.RR, []*dns.DNSKEY, []*dns.RRSIG) {
+	var set []dns.RR
+	var keys []*dns.DNSKEY
+	for _, rr := range resp.Answer {
+		if key, ok := rr.(*dns.DNSKEY); ok && strings.EqualFold(key.Hdr.Name, zone) {
+			set = append(set, key)
+			keys = append(keys, key)
+		}
+	}
+	if len(set) == 0 {
+		return nil, nil, nil
+	}
+	return set, keys, signatures(resp.Answer, set)
+}
+
+// anySupported reports whether a DS record uses a digest and algorithm
+// that can be validated. Zones with none are treated as insecure, as per
+// RFC 4035 section 5.2.
+func anySupported(ds []dns.RR) bool {
+	for _, rr := range ds {
+		d := rr.(*dns.DS)
+		switch d.DigestType {
+		case dns.SHA1, dns.SHA256, dns.SHA384:
+		default:
+			continue
+		}
+		switch d.Algorithm {
+		case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512, dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+			return true
+		}
+	}
+	return false
+}
+
+// ttl returns the lowest TTL of records, or maxCutTTL if there are none.
+func ttl(records []dns.RR) time.Duration {
+	lowest := maxCutTTL
+	for _, rr := range records {
+		lowest = min(lowest, time.Duration(rr.Header().Ttl)*time.Second)
+	}
+	return lowest
+}
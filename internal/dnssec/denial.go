@@ -0,0 +1,221 @@
+package dnssec
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// maxNSEC3Iterations is the highest NSEC3 iteration count validated; zones
+// using more are treated as insecure, as per RFC 9276 section 3.2.
+const maxNSEC3Iterations = 100
+
+// provesNXDOMAIN reports whether the NSEC or NSEC3 records of authority prove
+// that name does not exist and that no wildcard could have matched it.
+func provesNXDOMAIN(authority []dns.RR, name string) bool {
+	nsecs, nsec3s := denials(authority)
+	if len(nsecs) > 0 {
+		var closest string
+		for _, nsec := range nsecs {
+			if covers(nsec, name) {
+				closest = longest(closestEncloser(name, nsec.Hdr.Name), closestEncloser(name, nsec.NextDomain))
+			}
+		}
+		if closest == "" {
+			return false
+		}
+		wildcard := wildcardOf(closest)
+		return slices.ContainsFunc(nsecs, func(nsec *dns.NSEC) bool { return covers(nsec, wildcard) })
+	}
+
+	closest, nextCloser := closestEncloserProof(nsec3s, name)
+	if closest == "" || nextCloser == "" {
+		return false
+	}
+	return coveredByNSEC3(nsec3s, wildcardOf(closest))
+}
+
+// provesNODATA reports whether the NSEC or NSEC3 records of authority prove
+// that name has no records of type qtype.
+func provesNODATA(authority []dns.RR, name string, qtype uint16) bool {
+	nsecs, nsec3s := denials(authority)
+	for _, nsec := range nsecs {
+		if strings.EqualFold(nsec.Hdr.Name, name) {
+			return !slices.Contains(nsec.TypeBitMap, qtype) && !slices.Contains(nsec.TypeBitMap, dns.TypeCNAME)
+		}
+		// An empty non-terminal lies between an NSEC and its next name below it.
+		if covers(nsec, name) && dns.IsSubDomain(name, nsec.NextDomain) {
+			return true
+		}
+	}
+
+	for _, nsec3 := range nsec3s {
+		if nsec3.Match(name) {
+			return !slices.Contains(nsec3.TypeBitMap, qtype) && !slices.Contains(nsec3.TypeBitMap, dns.TypeCNAME)
+		}
+	}
+	// A DS query for an unsigned delegation may be covered by an opt-out span.
+	if qtype == dns.TypeDS {
+		return optOut(nsec3s, name)
+	}
+	return false
+}
+
+// insecureDelegation reports whether authority proves that name is a
+// delegation without DS records.
+func insecureDelegation(authority []dns.RR, name string) bool {
+	nsecs, nsec3s := denials(authority)
+	for _, nsec := range nsecs {
+		if strings.EqualFold(nsec.Hdr.Name, name) {
+			return delegationWithoutDS(nsec.TypeBitMap)
+		}
+	}
+	for _, nsec3 := range nsec3s {
+		if nsec3.Match(name) {
+			return delegationWithoutDS(nsec3.TypeBitMap)
+		}
+	}
+	return optOut(nsec3s, name)
+}
+
+func delegationWithoutDS(types []uint16) bool {
+	return slices.Contains(types, dns.TypeNS) && !slices.Contains(types, dns.TypeDS) && !slices.Contains(types, dns.TypeSOA)
+}
+
+// optOut reports whether the next closer name of name is covered by an NSEC3
+// record with the opt-out flag, RFC 5155 section 6.
+func optOut(nsec3s []*dns.NSEC3, name string) bool {
+	_, nextCloser := closestEncloserProof(nsec3s, name)
+	if nextCloser == "" {
+		return false
+	}
+	for _, nsec3 := range nsec3s {
+		if nsec3.Flags&1 == 1 && coveredBy(nsec3, nextCloser) {
+			return true
+		}
+	}
+	return false
+}
+
+// coversWildcardSource reports whether authority proves that owner, answered
+// by expanding the wildcard below closest, does not exist itself.
+func coversWildcardSource(authority []dns.RR, owner, closest string) bool {
+	nsecs, nsec3s := denials(authority)
+	for _, nsec := range nsecs {
+		if covers(nsec, owner) {
+			return true
+		}
+	}
+	return coveredByNSEC3(nsec3s, nextCloserName(closest, owner))
+}
+
+// closestEncloserProof finds the closest existing ancestor of name matched
+// by an NSEC3 record, and the next closer name below it if that is covered,
+// as per RFC 5155 section 8.3.
+func closestEncloserProof(nsec3s []*dns.NSEC3, name string) (string, string) {
+	name = dns.CanonicalName(name)
+	labels := dns.Split(name)
+	for i := 1; i <= len(labels); i++ {
+		ancestor := "."
+		if i < len(labels) {
+			ancestor = name[labels[i]:]
+		}
+		if !slices.ContainsFunc(nsec3s, func(n *dns.NSEC3) bool { return n.Match(ancestor) }) {
+			continue
+		}
+		nextCloser := name[labels[i-1]:]
+		if coveredByNSEC3(nsec3s, nextCloser) {
+			return ancestor, nextCloser
+		}
+		return ancestor, ""
+	}
+	return "", ""
+}
+
+func coveredByNSEC3(nsec3s []*dns.NSEC3, name string) bool {
+	return slices.ContainsFunc(nsec3s, func(n *dns.NSEC3) bool { return coveredBy(n, name) })
+}
+
+// coveredBy reports whether the hash of name falls strictly between the owner
+// and next hashes of nsec3. NSEC3.Cover also accepts the owner hash itself,
+// which proves the name exists.
+func coveredBy(nsec3 *dns.NSEC3, name string) bool {
+	return nsec3.Cover(name) && !nsec3.Match(name)
+}
+
+func nsec3IterationsTooHigh(authority []dns.RR) bool {
+	_, nsec3s := denials(authority)
+	return slices.ContainsFunc(nsec3s, func(n *dns.NSEC3) bool { return n.Iterations > maxNSEC3Iterations })
+}
+
+func denials(authority []dns.RR) ([]*dns.NSEC, []*dns.NSEC3) {
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, rr := range authority {
+		switch d := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, d)
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, d)
+		}
+	}
+	return nsecs, nsec3s
+}
+
+// covers reports whether name falls strictly between the owner and next
+// name of nsec in canonical order, wrapping around at the end of the zone.
+func covers(nsec *dns.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if canonicalLess(owner, next) {
+		return canonicalLess(owner, name) && canonicalLess(name, next)
+	}
+	return canonicalLess(owner, name) || canonicalLess(name, next)
+}
+
+// canonicalLess orders names as per RFC 4034 section 6.1.
+func canonicalLess(a, b string) bool {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if la[i] != lb[j] {
+			return la[i] < lb[j]
+		}
+	}
+	return len(la) < len(lb)
+}
+
+// closestEncloser returns the deepest common ancestor of name and other.
+func closestEncloser(name, other string) string {
+	n := dns.CompareDomainName(name, other)
+	labels := dns.SplitDomainName(dns.CanonicalName(name))
+	if n == 0 {
+		return "."
+	}
+	return strings.Join(labels[len(labels)-n:], ".") + "."
+}
+
+// nextCloserName returns the ancestor of name one label below closest.
+func nextCloserName(closest, name string) string {
+	name = dns.CanonicalName(name)
+	labels := dns.Split(name)
+	below := len(labels) - dns.CountLabel(closest) - 1
+	if below < 0 {
+		return name
+	}
+	return name[labels[below]:]
+}
+
+func wildcardOf(closest string) string {
+	if closest == "." {
+		return "*."
+	}
+	return "*." + closest
+}
+
+func longest(a, b string) string {
+	if dns.CountLabel(b) > dns.CountLabel(a) {
+		return b
+	}
+	return a
+}
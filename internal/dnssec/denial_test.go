@@ -0,0 +1,381 @@
+package dnssec
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// nsecs parses NSEC records.
+func nsecs(t *testing.T, records ...string) []dns.RR {
+	t.Helper()
+	var rrs []dns.RR
+	for _, s := range records {
+		rrs = append(rrs, mustRR(t, s))
+	}
+	return rrs
+}
+
+// nsec3s returns the NSEC3 chain of example. for names, as authority records.
+func nsec3s(names map[string][]uint16, flags uint8) []dns.RR {
+	var rrs []dns.RR
+	for _, nsec3 := range nsec3Chain("example.", names, flags) {
+		rrs = append(rrs, nsec3)
+	}
+	return rrs
+}
+
+var (
+	apexTypes = []uint16{dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeDNSKEY, dns.TypeNSEC3PARAM}
+	hostTypes = []uint16{dns.TypeA, dns.TypeRRSIG}
+)
+
+func TestProvesNXDOMAIN(t *testing.T) {
+	tests := []struct {
+		name      string
+		authority []dns.RR
+		qname     string
+		want      bool
+	}{
+		{
+			name:      "nsec covering name and wildcard",
+			authority: nsecs(t, "example. 300 IN NSEC www.example. NS SOA RRSIG NSEC DNSKEY"),
+			qname:     "nope.example.",
+			want:      true,
+		},
+		{
+			name: "separate nsec for wildcard",
+			authority: nsecs(t,
+				"mail.example. 300 IN NSEC www.example. A RRSIG NSEC",
+				"example. 300 IN NSEC mail.example. NS SOA RRSIG NSEC DNSKEY",
+			),
+			qname: "nope.example.",
+			want:  true,
+		},
+		{
+			name:      "wildcard not covered",
+			authority: nsecs(t, "mail.example. 300 IN NSEC www.example. A RRSIG NSEC"),
+			qname:     "nope.example.",
+			want:      false,
+		},
+		{
+			name:      "name not covered",
+			authority: nsecs(t, "example. 300 IN NSEC mail.example. NS SOA RRSIG NSEC DNSKEY"),
+			qname:     "nope.example.",
+			want:      false,
+		},
+		{
+			name:      "nsec matching name",
+			authority: nsecs(t, "nope.example. 300 IN NSEC www.example. A RRSIG NSEC"),
+			qname:     "nope.example.",
+			want:      false,
+		},
+		{
+			name:      "nsec wrapping at end of zone",
+			authority: nsecs(t, "www.example. 300 IN NSEC example. A RRSIG NSEC", "example. 300 IN NSEC www.example. NS SOA RRSIG NSEC DNSKEY"),
+			qname:     "zzz.example.",
+			want:      true,
+		},
+		{
+			name:      "nsec3",
+			authority: nsec3s(map[string][]uint16{"example.": apexTypes, "www.example.": hostTypes}, 0),
+			qname:     "nope.example.",
+			want:      true,
+		},
+		{
+			name:      "nsec3 below an empty non-terminal",
+			authority: nsec3s(map[string][]uint16{"example.": apexTypes, "a.b.example.": hostTypes, "b.example.": nil}, 0),
+			qname:     "nope.b.example.",
+			want:      true,
+		},
+		{
+			name:      "nsec3 for an existing name",
+			authority: nsec3s(map[string][]uint16{"example.": apexTypes, "www.example.": hostTypes}, 0),
+			qname:     "www.example.",
+			want:      false,
+		},
+		{
+			name:      "nsec3 with existing wildcard",
+			authority: nsec3s(map[string][]uint16{"example.": apexTypes, "*.example.": hostTypes}, 0),
+			qname:     "nope.example.",
+			want:      false,
+		},
+		{
+			name:      "nsec3 without closest encloser",
+			authority: nsec3s(map[string][]uint16{"www.example.": hostTypes}, 0),
+			qname:     "nope.example.",
+			want:      false,
+		},
+		{
+			name:  "no denial",
+			qname: "nope.example.",
+			want:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := provesNXDOMAIN(tt.authority, tt.qname); got != tt.want {
+				t.Errorf("provesNXDOMAIN(%s) = %v, want %v", tt.qname, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProvesNODATA(t *testing.T) {
+	tests := []struct {
+		name      string
+		authority []dns.RR
+		qname     string
+		qtype     uint16
+		want      bool
+	}{
+		{
+			name:      "nsec without type",
+			authority: nsecs(t, "www.example. 300 IN NSEC zz.example. A RRSIG NSEC"),
+			qname:     "www.example.",
+			qtype:     dns.TypeTXT,
+			want:      true,
+		},
+		{
+			name:      "nsec with type",
+			authority: nsecs(t, "www.example. 300 IN NSEC zz.example. A RRSIG NSEC"),
+			qname:     "www.example.",
+			qtype:     dns.TypeA,
+			want:      false,
+		},
+		{
+			name:      "nsec with cname",
+			authority: nsecs(t, "www.example. 300 IN NSEC zz.example. CNAME RRSIG NSEC"),
+			qname:     "www.example.",
+			qtype:     dns.TypeA,
+			want:      false,
+		},
+		{
+			name:      "empty non-terminal",
+			authority: nsecs(t, "example. 300 IN NSEC a.b.example. NS SOA RRSIG NSEC DNSKEY"),
+			qname:     "b.example.",
+			qtype:     dns.TypeA,
+			want:      true,
+		},
+		{
+			name:      "covered name is not an empty non-terminal",
+			authority: nsecs(t, "example. 300 IN NSEC www.example. NS SOA RRSIG NSEC DNSKEY"),
+			qname:     "b.example.",
+			qtype:     dns.TypeA,
+			want:      false,
+		},
+		{
+			name:      "nsec3 without type",
+			authority: nsec3s(map[string][]uint16{"example.": apexTypes, "www.example.": hostTypes}, 0),
+			qname:     "www.example.",
+			qtype:     dns.TypeTXT,
+			want:      true,
+		},
+		{
+			name:      "nsec3 with type",
+			authority: nsec3s(map[string][]uint16{"example.": apexTypes, "www.example.": hostTypes}, 0),
+			qname:     "www.example.",
+			qtype:     dns.TypeA,
+			want:      false,
+		},
+		{
+			name:      "nsec3 opt-out for ds",
+			authority: nsec3s(map[string][]uint16{"example.": apexTypes, "www.example.": hostTypes}, 1),
+			qname:     "unsigned.example.",
+			qtype:     dns.TypeDS,
+			want:      true,
+		},
+		{
+			name:      "nsec3 opt-out for other types",
+			authority: nsec3s(map[string][]uint16{"example.": apexTypes, "www.example.": hostTypes}, 1),
+			qname:     "unsigned.example.",
+			qtype:     dns.TypeA,
+			want:      false,
+		},
+		{
+			name:      "nsec3 covering ds without opt-out",
+			authority: nsec3s(map[string][]uint16{"example.": apexTypes, "www.example.": hostTypes}, 0),
+			qname:     "unsigned.example.",
+			qtype:     dns.TypeDS,
+			want:      false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := provesNODATA(tt.authority, tt.qname, tt.qtype); got != tt.want {
+				t.Errorf("provesNODATA(%s, %s) = %v, want %v", tt.qname, dns.TypeToString[tt.qtype], got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInsecureDelegation(t *testing.T) {
+	tests := []struct {
+		name      string
+		authority []dns.RR
+		want      bool
+	}{
+		{
+			name:      "nsec without ds",
+			authority: nsecs(t, "sub.example. 300 IN NSEC www.example. NS RRSIG NSEC"),
+			want:      true,
+		},
+		{
+			name:      "nsec with ds",
+			authority: nsecs(t, "sub.example. 300 IN NSEC www.example. NS DS RRSIG NSEC"),
+			want:      false,
+		},
+		{
+			name:      "nsec of a zone apex",
+			authority: nsecs(t, "sub.example. 300 IN NSEC www.example. NS SOA RRSIG NSEC DNSKEY"),
+			want:      false,
+		},
+		{
+			name:      "nsec without delegation",
+			authority: nsecs(t, "sub.example. 300 IN NSEC www.example. A RRSIG NSEC"),
+			want:      false,
+		},
+		{
+			name:      "nsec covering name",
+			authority: nsecs(t, "example. 300 IN NSEC www.example. NS SOA RRSIG NSEC DNSKEY"),
+			want:      false,
+		},
+		{
+			name:      "nsec3 without ds",
+			authority: nsec3s(map[string][]uint16{"example.": apexTypes, "sub.example.": {dns.TypeNS}}, 0),
+			want:      true,
+		},
+		{
+			name:      "nsec3 with ds",
+			authority: nsec3s(map[string][]uint16{"example.": apexTypes, "sub.example.": {dns.TypeNS, dns.TypeDS, dns.TypeRRSIG}}, 0),
+			want:      false,
+		},
+		{
+			name:      "nsec3 opt-out",
+			authority: nsec3s(map[string][]uint16{"example.": apexTypes, "www.example.": hostTypes}, 1),
+			want:      true,
+		},
+		{
+			name: "no denial",
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := insecureDelegation(tt.authority, "sub.example."); got != tt.want {
+				t.Errorf("insecureDelegation = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOptOut(t *testing.T) {
+	tests := []struct {
+		name  string
+		names map[string][]uint16
+		flags uint8
+		qname string
+		want  bool
+	}{
+		{"opt-out span", map[string][]uint16{"example.": apexTypes, "www.example.": hostTypes}, 1, "sub.example.", true},
+		{"below opt-out span", map[string][]uint16{"example.": apexTypes, "www.example.": hostTypes}, 1, "a.sub.example.", true},
+		{"without opt-out flag", map[string][]uint16{"example.": apexTypes, "www.example.": hostTypes}, 0, "sub.example.", false},
+		{"existing name", map[string][]uint16{"example.": apexTypes, "sub.example.": {dns.TypeNS}}, 1, "sub.example.", false},
+		{"no closest encloser", map[string][]uint16{"www.example.": hostTypes}, 1, "sub.example.", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := optOut(nsec3Chain("example.", tt.names, tt.flags), tt.qname); got != tt.want {
+				t.Errorf("optOut(%s) = %v, want %v", tt.qname, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCoversWildcardSource(t *testing.T) {
+	tests := []struct {
+		name      string
+		authority []dns.RR
+		owner     string
+		closest   string
+		want      bool
+	}{
+		{
+			name:      "nsec covering owner",
+			authority: nsecs(t, "*.example. 300 IN NSEC www.example. A RRSIG NSEC"),
+			owner:     "host.example.",
+			closest:   "example.",
+			want:      true,
+		},
+		{
+			name:      "nsec not covering owner",
+			authority: nsecs(t, "*.example. 300 IN NSEC host.example. A RRSIG NSEC"),
+			owner:     "www.example.",
+			closest:   "example.",
+			want:      false,
+		},
+		{
+			name:      "nsec3 covering owner",
+			authority: nsec3s(map[string][]uint16{"example.": apexTypes, "*.example.": hostTypes}, 0),
+			owner:     "host.example.",
+			closest:   "example.",
+			want:      true,
+		},
+		{
+			name:      "nsec3 covering next closer name",
+			authority: nsec3s(map[string][]uint16{"example.": apexTypes, "*.example.": hostTypes}, 0),
+			owner:     "a.b.example.",
+			closest:   "example.",
+			want:      true,
+		},
+		{
+			name:      "nsec3 for an existing owner",
+			authority: nsec3s(map[string][]uint16{"example.": apexTypes, "*.example.": hostTypes, "host.example.": hostTypes}, 0),
+			owner:     "host.example.",
+			closest:   "example.",
+			want:      false,
+		},
+		{
+			name:    "no denial",
+			owner:   "host.example.",
+			closest: "example.",
+			want:    false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := coversWildcardSource(tt.authority, tt.owner, tt.closest); got != tt.want {
+				t.Errorf("coversWildcardSource(%s, %s) = %v, want %v", tt.owner, tt.closest, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanonicalLess(t *testing.T) {
+	// Canonically ordered, from RFC 4034 section 6.1 without escaped labels.
+	ordered := []string{
+		"example.",
+		"a.example.",
+		"yljkjljk.a.example.",
+		"Z.a.example.",
+		"zABC.a.EXAMPLE.",
+		"z.example.",
+		"*.z.example.",
+		"b.z.example.",
+		"org.",
+	}
+	for i := range ordered {
+		for j := range ordered {
+			if got, want := canonicalLess(ordered[i], ordered[j]), i < j; got != want {
+				t.Errorf("canonicalLess(%s, %s) = %v, want %v", ordered[i], ordered[j], got, want)
+			}
+		}
+	}
+
+	if canonicalLess("WWW.example.", "www.EXAMPLE.") || canonicalLess("www.EXAMPLE.", "WWW.example.") {
+		t.Error("names differing in case are ordered")
+	}
+	if !canonicalLess(".", "example.") || canonicalLess("example.", ".") {
+		t.Error("the root does not come first")
+	}
+}
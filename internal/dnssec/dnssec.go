@@ -0,0 +1,368 @@
+package dnssec
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwoff11/go-resolve/internal/config"
+	"github.com/bwoff11/go-resolve/internal/metrics"
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// Security is the outcome of validating a response, as per RFC 4033 section 5.
+type Security int
+
+const (
+	Indeterminate Security = iota // Not validated.
+	Insecure                      // Provably unsigned.
+	Secure                        // Signed by a chain of trust from an anchor.
+	Bogus                         // Signed, but the chain of trust or a signature is broken.
+)
+
+var securityNames = map[Security]string{
+	Indeterminate: "indeterminate",
+	Insecure:      "insecure",
+	Secure:        "secure",
+	Bogus:         "bogus",
+}
+
+func (s Security) String() string { return securityNames[s] }
+
+// Result is the security of a response and, for bogus responses, the
+// extended DNS error (RFC 8914) explaining why.
+type Result struct {
+	Security Security
+	EDE      uint16
+	Reason   string
+}
+
+func bogus(ede uint16, reason string) Result {
+	return Result{Security: Bogus, EDE: ede, Reason: reason}
+}
+
+// Validator validates upstream responses against a chain of trust from the
+// configured trust anchors. DS and DNSKEY records are fetched through
+// exchange, which must return nil if no valid response was received.
+type Validator struct {
+	enabled  bool
+	anchors  *anchors
+	insecure map[string]bool // Negative trust anchors.
+	exchange func(*dns.Msg) *dns.Msg
+	mutex    sync.Mutex
+	cuts     map[string]cut       // Validated state of names on the way to a zone, by name.
+	building map[string]*building // States being built, by name.
+}
+
+// New creates a Validator from its configuration.
+func New(cfg *config.DNSSEC, exchange func(*dns.Msg) *dns.Msg) *Validator {
+	v := &Validator{
+		enabled:  cfg.Validate,
+		insecure: make(map[string]bool),
+		exchange: exchange,
+		cuts:     make(map[string]cut),
+		building: make(map[string]*building),
+	}
+	if v.enabled {
+		v.anchors = newAnchors(cfg.TrustAnchors, cfg.TrustAnchorFile)
+	}
+	for _, domain := range cfg.InsecureDomains {
+		v.insecure[dns.CanonicalName(domain)] = true
+	}
+	return v
+}
+
+// Enabled reports whether responses are validated.
+func (v *Validator) Enabled() bool {
+	return v.enabled
+}
+
+// Validate checks the answer and, for negative responses, the denial of
+// existence in the authority section of resp. Every RRset must be secure for
+// the response to be secure; a single insecure RRset makes it insecure.
+func (v *Validator) Validate(resp *dns.Msg) Result {
+	result := v.validate(resp)
+	metrics.DNSSECValidations.WithLabelValues(result.Security.String()).Inc()
+	if result.Security == Bogus {
+		log.Warn().Str("domain", resp.Question[0].Name).Str("reason", result.Reason).Msg("dnssec validation failed")
+	}
+	return result
+}
+
+func (v *Validator) validate(resp *dns.Msg) Result {
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return Result{}
+	}
+	q := resp.Question[0]
+	now := time.Now()
+
+	result := Result{Security: Secure}
+	for _, set := range rrsets(resp.Answer) {
+		sigs := signatures(resp.Answer, set)
+		if len(sigs) == 0 && synthesized(resp.Answer, set) {
+			continue // As secure as its DNAME, RFC 6672 section 5.3.1.
+		}
+		r := v.validateRRset(set, sigs, resp.Ns, now)
+		if r.Security == Bogus {
+			return r
+		}
+		if r.Security == Insecure {
+			result = r
+		}
+	}
+
+	final := chainEnd(resp.Answer, q.Name)
+	if resp.Rcode == dns.RcodeNameError || (q.Qtype != dns.TypeCNAME && !has(resp.Answer, final, q.Qtype)) {
+		r := v.validateDenial(resp, final, q.Qtype, now)
+		if r.Security == Bogus {
+			return r
+		}
+		if r.Security == Insecure {
+			result = r
+		}
+	}
+	return result
+}
+
+// validateRRset verifies an RRset of the answer with the keys of the zone
+// that signed it. An RRset expanded from a wildcard must come with proof
+// that its name does not exist.
+func (v *Validator) validateRRset(set []dns.RR, sigs []*dns.RRSIG, authority []dns.RR, now time.Time) Result {
+	owner, rtype := set[0].Header().Name, set[0].Header().Rrtype
+	if len(sigs) == 0 {
+		// Unsigned data is only acceptable below an insecure delegation.
+		if c := v.chain(zoneOf(owner, rtype)); c.Security != Secure {
+			return c.Result
+		}
+		return bogus(dns.ExtendedErrorCodeRRSIGsMissing, "no signature for "+owner+" "+dns.TypeToString[rtype])
+	}
+
+	signer := dns.CanonicalName(sigs[0].SignerName)
+	if !dns.IsSubDomain(signer, owner) {
+		return bogus(dns.ExtendedErrorCodeDNSBogus, "signer "+signer+" is not an ancestor of "+owner)
+	}
+	c := v.chain(signer)
+	if c.Security != Secure {
+		return c.Result
+	}
+	if r := verify(set, sigs, c.zone, c.keys, now); r.Security != Secure {
+		return r
+	}
+
+	if labels := int(sigs[0].Labels); labels < dns.CountLabel(owner) {
+		closest := strings.Join(dns.SplitDomainName(owner)[dns.CountLabel(owner)-labels:], ".") + "."
+		if r := verifyAuthority(authority, c.zone, c.keys, now); r.Security != Secure {
+			return r
+		}
+		if !coversWildcardSource(authority, owner, closest) {
+			return bogus(dns.ExtendedErrorCodeNSECMissing, "no proof that "+owner+" does not exist for its wildcard answer")
+		}
+	}
+	return c.Result
+}
+
+// validateDenial checks that the authority section of a negative response
+// proves the name or type does not exist.
+func (v *Validator) validateDenial(resp *dns.Msg, name string, qtype uint16, now time.Time) Result {
+	zone := zoneOf(name, qtype)
+	for _, rr := range resp.Ns {
+		if sig, ok := rr.(*dns.RRSIG); ok && dns.IsSubDomain(sig.SignerName, name) {
+			zone = dns.CanonicalName(sig.SignerName)
+			break
+		}
+	}
+
+	c := v.chain(zone)
+	if c.Security != Secure {
+		return c.Result
+	}
+	if r := verifyAuthority(resp.Ns, c.zone, c.keys, now); r.Security != Secure {
+		return r
+	}
+	if nsec3IterationsTooHigh(resp.Ns) {
+		return Result{Security: Insecure} // RFC 9276 section 3.2.
+	}
+
+	var proven bool
+	if resp.Rcode == dns.RcodeNameError {
+		proven = provesNXDOMAIN(resp.Ns, name)
+	} else {
+		proven = provesNODATA(resp.Ns, name, qtype)
+	}
+	if !proven {
+		return bogus(dns.ExtendedErrorCodeNSECMissing, "no proof of nonexistence for "+name+" "+dns.TypeToString[qtype])
+	}
+	return c.Result
+}
+
+// verify checks that one of sigs by zone is valid for set under keys.
+func verify(set []dns.RR, sigs []*dns.RRSIG, zone string, keys []*dns.DNSKEY, now time.Time) Result {
+	result := bogus(dns.ExtendedErrorCodeRRSIGsMissing, "no signature by "+zone+" for "+set[0].Header().Name)
+	for _, sig := range sigs {
+		if dns.CanonicalName(sig.SignerName) != zone {
+			continue
+		}
+		result = bogus(dns.ExtendedErrorCodeDNSKEYMissing, "no key of "+zone+" matches the signature")
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+			if !sig.ValidityPeriod(now) {
+				result = validityError(sig, now)
+				continue
+			}
+			if err := sig.Verify(key, set); err != nil {
+				result = bogus(dns.ExtendedErrorCodeDNSBogus, "invalid signature for "+set[0].Header().Name+": "+err.Error())
+				continue
+			}
+			return Result{Security: Secure}
+		}
+	}
+	return result
+}
+
+// verifyAuthority verifies every NSEC, NSEC3 and SOA RRset of an authority
+// section with the keys of zone.
+func verifyAuthority(authority []dns.RR, zone string, keys []*dns.DNSKEY, now time.Time) Result {
+	for _, set := range rrsets(authority) {
+		switch set[0].Header().Rrtype {
+		case dns.TypeNSEC, dns.TypeNSEC3, dns.TypeSOA:
+			if r := verify(set, signatures(authority, set), zone, keys, now); r.Security != Secure {
+				return r
+			}
+		}
+	}
+	return Result{Security: Secure}
+}
+
+func validityError(sig *dns.RRSIG, now time.Time) Result {
+	if uint32(now.Unix())-sig.Inception > 1<<31 {
+		return bogus(dns.ExtendedErrorCodeSignatureNotYetValid, "signature not yet valid")
+	}
+	return bogus(dns.ExtendedErrorCodeSignatureExpired, "signature expired")
+}
+
+// SetDO requests DNSSEC records for msg by setting its DO bit.
+func SetDO(msg *dns.Msg) {
+	if opt := msg.IsEdns0(); opt != nil {
+		opt.SetDo()
+		return
+	}
+	msg.SetEdns0(dns.DefaultMsgSize, true)
+}
+
+// Strip removes DNSSEC records from records, except those of type qtype.
+func Strip(records []dns.RR, qtype uint16) []dns.RR {
+	var kept []dns.RR
+	for _, rr := range records {
+		switch rtype := rr.Header().Rrtype; rtype {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			if rtype != qtype {
+				continue
+			}
+		}
+		kept = append(kept, rr)
+	}
+	return kept
+}
+
+// zoneOf returns the name whose zone holds the rtype records of name. DS
+// records belong to the parent zone.
+func zoneOf(name string, rtype uint16) string {
+	name = dns.CanonicalName(name)
+	if rtype == dns.TypeDS && name != "." {
+		return parent(name)
+	}
+	return name
+}
+
+func parent(name string) string {
+	if i, end := dns.NextLabel(name, 0); !end {
+		return name[i:]
+	}
+	return "."
+}
+
+// rrsets groups records by owner and type, leaving out signatures.
+func rrsets(records []dns.RR) [][]dns.RR {
+	var sets [][]dns.RR
+	index := make(map[string]int)
+	for _, rr := range records {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeRRSIG || h.Rrtype == dns.TypeOPT {
+			continue
+		}
+		key := dns.CanonicalName(h.Name) + "/" + dns.TypeToString[h.Rrtype]
+		if i, ok := index[key]; ok {
+			sets[i] = append(sets[i], rr)
+			continue
+		}
+		index[key] = len(sets)
+		sets = append(sets, []dns.RR{rr})
+	}
+	return sets
+}
+
+// signatures returns the signatures in records covering set.
+func signatures(records []dns.RR, set []dns.RR) []*dns.RRSIG {
+	owner, rtype := set[0].Header().Name, set[0].Header().Rrtype
+	var sigs []*dns.RRSIG
+	for _, rr := range records {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == rtype && strings.EqualFold(sig.Hdr.Name, owner) {
+			sigs = append(sigs, sig)
+		}
+	}
+	return sigs
+}
+
+// chainEnd returns the last name of the CNAME chain starting at name.
+func chainEnd(records []dns.RR, name string) string {
+	for hops := 0; hops <= len(records); hops++ {
+		next := ""
+		for _, rr := range records {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				next = cname.Target
+			}
+		}
+		if next == "" {
+			break
+		}
+		name = next
+	}
+	return name
+}
+
+// synthesized reports whether set is a single CNAME that a DNAME in records
+// produces, which servers send unsigned.
+func synthesized(records []dns.RR, set []dns.RR) bool {
+	cname, ok := set[0].(*dns.CNAME)
+	if !ok || len(set) != 1 {
+		return false
+	}
+	owner := dns.CanonicalName(cname.Hdr.Name)
+	for _, rr := range records {
+		dname, ok := rr.(*dns.DNAME)
+		if !ok {
+			continue
+		}
+		apex := dns.CanonicalName(dname.Hdr.Name)
+		if owner == apex || !dns.IsSubDomain(apex, owner) {
+			continue
+		}
+		if strings.TrimSuffix(owner, apex)+dns.CanonicalName(dname.Target) == dns.CanonicalName(cname.Target) {
+			return true
+		}
+	}
+	return false
+}
+
+// has reports whether records hold a record of type rtype owned by name.
+func has(records []dns.RR, name string, rtype uint16) bool {
+	for _, rr := range records {
+		if rr.Header().Rrtype == rtype && strings.EqualFold(rr.Header().Name, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,421 @@
+package dnssec
+
+import (
+	"crypto"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bwoff11/go-resolve/internal/config"
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog"
+)
+
+func TestMain(m *testing.M) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	os.Exit(m.Run())
+}
+
+// signer is a zone signed with a single key.
+type signer struct {
+	zone string
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newSigner(t *testing.T, zone string) *signer {
+	t.Helper()
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &signer{zone: zone, key: key, priv: priv.(crypto.Signer)}
+}
+
+// sign returns set followed by its signature, valid for an hour either side of now.
+func (s *signer) sign(t *testing.T, set ...dns.RR) []dns.RR {
+	t.Helper()
+	now := time.Now()
+	return s.signAt(t, set, now.Add(-time.Hour), now.Add(time.Hour))
+}
+
+// signAt returns set followed by its signature, valid from inception to expiration.
+func (s *signer) signAt(t *testing.T, set []dns.RR, inception, expiration time.Time) []dns.RR {
+	t.Helper()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: set[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: set[0].Header().Ttl},
+		Algorithm:  s.key.Algorithm,
+		KeyTag:     s.key.KeyTag(),
+		SignerName: s.zone,
+		Inception:  uint32(inception.Unix()),
+		Expiration: uint32(expiration.Unix()),
+	}
+	if err := sig.Sign(s.priv, set); err != nil {
+		t.Fatal(err)
+	}
+	return append(set, sig)
+}
+
+func (s *signer) ds() *dns.DS {
+	return s.key.ToDS(dns.SHA256)
+}
+
+// world is a signed root zone delegating to the signed example. zone, which
+// has a DNAME at alias.example., and, without DS records, to insecure.,
+// served to a Validator through exchange.
+type world struct {
+	root, example *signer
+	responses     map[string]*dns.Msg // By name and type.
+	delay         time.Duration       // Time taken to answer each query.
+	queries       atomic.Int32
+}
+
+func newWorld(t *testing.T) *world {
+	t.Helper()
+	w := &world{
+		root:      newSigner(t, "."),
+		example:   newSigner(t, "example."),
+		responses: make(map[string]*dns.Msg),
+	}
+	w.respond(msg(".", dns.TypeDNSKEY, dns.RcodeSuccess, w.root.sign(t, w.root.key), nil))
+	w.respond(msg("example.", dns.TypeDS, dns.RcodeSuccess, w.root.sign(t, w.example.ds()), nil))
+	w.respond(msg("example.", dns.TypeDNSKEY, dns.RcodeSuccess, w.example.sign(t, w.example.key), nil))
+	w.respond(msg("www.example.", dns.TypeDS, dns.RcodeSuccess, nil,
+		w.example.sign(t, mustRR(t, "www.example. 300 IN NSEC zz.example. A RRSIG NSEC"))))
+	w.respond(msg("alias.example.", dns.TypeDS, dns.RcodeSuccess, nil,
+		w.example.sign(t, mustRR(t, "alias.example. 300 IN NSEC www.example. DNAME RRSIG NSEC"))))
+	w.respond(msg("www.alias.example.", dns.TypeDS, dns.RcodeSuccess,
+		append(w.example.sign(t, mustRR(t, "alias.example. 300 IN DNAME example.")), mustRR(t, "www.alias.example. 300 IN CNAME www.example.")), nil))
+	w.respond(msg("insecure.", dns.TypeDS, dns.RcodeSuccess, nil,
+		w.root.sign(t, mustRR(t, "insecure. 3600 IN NSEC zz. NS RRSIG NSEC"))))
+	return w
+}
+
+func (w *world) respond(resp *dns.Msg) {
+	q := resp.Question[0]
+	w.responses[q.Name+"/"+dns.TypeToString[q.Qtype]] = resp
+}
+
+func (w *world) exchange(req *dns.Msg) *dns.Msg {
+	w.queries.Add(1)
+	time.Sleep(w.delay)
+	q := req.Question[0]
+	if resp, ok := w.responses[q.Name+"/"+dns.TypeToString[q.Qtype]]; ok {
+		return resp.Copy()
+	}
+	return nil
+}
+
+func (w *world) validator() *Validator {
+	cfg := &config.DNSSEC{Validate: true, TrustAnchors: []string{w.root.ds().String()}}
+	return New(cfg, w.exchange)
+}
+
+func msg(name string, qtype uint16, rcode int, answer, ns []dns.RR) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.Response = true
+	m.Rcode = rcode
+	m.Answer = answer
+	m.Ns = ns
+	return m
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatalf("invalid record %q: %v", s, err)
+	}
+	return rr
+}
+
+// nsec3Chain returns the NSEC3 records of zone for the names and types in
+// names, hashed without salt or extra iterations.
+func nsec3Chain(zone string, names map[string][]uint16, flags uint8) []*dns.NSEC3 {
+	type entry struct {
+		hash  string
+		types []uint16
+	}
+	var entries []entry
+	for name, types := range names {
+		entries = append(entries, entry{dns.HashName(name, dns.SHA1, 0, ""), types})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].hash < entries[j].hash })
+
+	var nsec3s []*dns.NSEC3
+	for i, e := range entries {
+		nsec3s = append(nsec3s, &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: strings.ToLower(e.hash) + "." + zone, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+			Hash:       dns.SHA1,
+			Flags:      flags,
+			HashLength: 20,
+			NextDomain: entries[(i+1)%len(entries)].hash,
+			TypeBitMap: e.types,
+		})
+	}
+	return nsec3s
+}
+
+// signNSEC3 returns each record of nsec3s followed by its signature.
+func (s *signer) signNSEC3(t *testing.T, nsec3s []*dns.NSEC3) []dns.RR {
+	t.Helper()
+	var records []dns.RR
+	for _, nsec3 := range nsec3s {
+		records = append(records, s.sign(t, nsec3)...)
+	}
+	return records
+}
+
+func TestValidate(t *testing.T) {
+	w := newWorld(t)
+	now := time.Now()
+	ex := w.example
+
+	soa := func(t *testing.T) []dns.RR {
+		return ex.sign(t, mustRR(t, "example. 300 IN SOA ns.example. admin.example. 1 3600 600 86400 300"))
+	}
+	chain := func(t *testing.T) []dns.RR {
+		return ex.signNSEC3(t, nsec3Chain("example.", map[string][]uint16{
+			"example.":     {dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeDNSKEY, dns.TypeNSEC3PARAM},
+			"www.example.": {dns.TypeA, dns.TypeRRSIG},
+		}, 0))
+	}
+
+	tests := []struct {
+		name string
+		resp func(t *testing.T) *dns.Msg
+		want Security
+		ede  uint16
+	}{
+		{
+			name: "secure answer",
+			resp: func(t *testing.T) *dns.Msg {
+				return msg("www.example.", dns.TypeA, dns.RcodeSuccess, ex.sign(t, mustRR(t, "www.example. 300 IN A 192.0.2.1")), nil)
+			},
+			want: Secure,
+		},
+		{
+			name: "bogus signature",
+			resp: func(t *testing.T) *dns.Msg {
+				answer := ex.sign(t, mustRR(t, "www.example. 300 IN A 192.0.2.1"))
+				answer[0].(*dns.A).A = net.ParseIP("198.51.100.66")
+				return msg("www.example.", dns.TypeA, dns.RcodeSuccess, answer, nil)
+			},
+			want: Bogus,
+			ede:  dns.ExtendedErrorCodeDNSBogus,
+		},
+		{
+			name: "expired signature",
+			resp: func(t *testing.T) *dns.Msg {
+				answer := ex.signAt(t, []dns.RR{mustRR(t, "www.example. 300 IN A 192.0.2.1")}, now.Add(-2*time.Hour), now.Add(-time.Hour))
+				return msg("www.example.", dns.TypeA, dns.RcodeSuccess, answer, nil)
+			},
+			want: Bogus,
+			ede:  dns.ExtendedErrorCodeSignatureExpired,
+		},
+		{
+			name: "signature not yet valid",
+			resp: func(t *testing.T) *dns.Msg {
+				answer := ex.signAt(t, []dns.RR{mustRR(t, "www.example. 300 IN A 192.0.2.1")}, now.Add(time.Hour), now.Add(2*time.Hour))
+				return msg("www.example.", dns.TypeA, dns.RcodeSuccess, answer, nil)
+			},
+			want: Bogus,
+			ede:  dns.ExtendedErrorCodeSignatureNotYetValid,
+		},
+		{
+			name: "missing signature",
+			resp: func(t *testing.T) *dns.Msg {
+				return msg("www.example.", dns.TypeA, dns.RcodeSuccess, []dns.RR{mustRR(t, "www.example. 300 IN A 192.0.2.1")}, nil)
+			},
+			want: Bogus,
+			ede:  dns.ExtendedErrorCodeRRSIGsMissing,
+		},
+		{
+			name: "dname with synthesized cname",
+			resp: func(t *testing.T) *dns.Msg {
+				answer := append(ex.sign(t, mustRR(t, "alias.example. 300 IN DNAME example.")),
+					mustRR(t, "www.alias.example. 300 IN CNAME www.example."))
+				answer = append(answer, ex.sign(t, mustRR(t, "www.example. 300 IN A 192.0.2.1"))...)
+				return msg("www.alias.example.", dns.TypeA, dns.RcodeSuccess, answer, nil)
+			},
+			want: Secure,
+		},
+		{
+			name: "unsigned cname not matching the dname",
+			resp: func(t *testing.T) *dns.Msg {
+				answer := append(ex.sign(t, mustRR(t, "alias.example. 300 IN DNAME example.")),
+					mustRR(t, "www.alias.example. 300 IN CNAME mail.example."))
+				answer = append(answer, ex.sign(t, mustRR(t, "mail.example. 300 IN A 192.0.2.1"))...)
+				return msg("www.alias.example.", dns.TypeA, dns.RcodeSuccess, answer, nil)
+			},
+			want: Bogus,
+			ede:  dns.ExtendedErrorCodeRRSIGsMissing,
+		},
+		{
+			name: "nxdomain nsec",
+			resp: func(t *testing.T) *dns.Msg {
+				ns := append(soa(t), ex.sign(t, mustRR(t, "example. 300 IN NSEC www.example. NS SOA RRSIG NSEC DNSKEY"))...)
+				return msg("nope.example.", dns.TypeA, dns.RcodeNameError, nil, ns)
+			},
+			want: Secure,
+		},
+		{
+			name: "nxdomain nsec without wildcard proof",
+			resp: func(t *testing.T) *dns.Msg {
+				ns := append(soa(t), ex.sign(t, mustRR(t, "mail.example. 300 IN NSEC www.example. A RRSIG NSEC"))...)
+				return msg("nope.example.", dns.TypeA, dns.RcodeNameError, nil, ns)
+			},
+			want: Bogus,
+			ede:  dns.ExtendedErrorCodeNSECMissing,
+		},
+		{
+			name: "nxdomain nsec3",
+			resp: func(t *testing.T) *dns.Msg {
+				return msg("nope.example.", dns.TypeA, dns.RcodeNameError, nil, append(soa(t), chain(t)...))
+			},
+			want: Secure,
+		},
+		{
+			name: "nxdomain without proof",
+			resp: func(t *testing.T) *dns.Msg {
+				return msg("nope.example.", dns.TypeA, dns.RcodeNameError, nil, soa(t))
+			},
+			want: Bogus,
+			ede:  dns.ExtendedErrorCodeNSECMissing,
+		},
+		{
+			name: "nodata nsec",
+			resp: func(t *testing.T) *dns.Msg {
+				ns := append(soa(t), ex.sign(t, mustRR(t, "www.example. 300 IN NSEC example. A RRSIG NSEC"))...)
+				return msg("www.example.", dns.TypeTXT, dns.RcodeSuccess, nil, ns)
+			},
+			want: Secure,
+		},
+		{
+			name: "nodata nsec3",
+			resp: func(t *testing.T) *dns.Msg {
+				return msg("www.example.", dns.TypeTXT, dns.RcodeSuccess, nil, append(soa(t), chain(t)...))
+			},
+			want: Secure,
+		},
+		{
+			name: "nodata denying an existing type",
+			resp: func(t *testing.T) *dns.Msg {
+				ns := append(soa(t), ex.sign(t, mustRR(t, "www.example. 300 IN NSEC example. A RRSIG NSEC"))...)
+				return msg("www.example.", dns.TypeA, dns.RcodeSuccess, nil, ns)
+			},
+			want: Bogus,
+			ede:  dns.ExtendedErrorCodeNSECMissing,
+		},
+		{
+			name: "unsigned denial",
+			resp: func(t *testing.T) *dns.Msg {
+				ns := append(soa(t), mustRR(t, "www.example. 300 IN NSEC example. A RRSIG NSEC"))
+				return msg("www.example.", dns.TypeTXT, dns.RcodeSuccess, nil, ns)
+			},
+			want: Bogus,
+			ede:  dns.ExtendedErrorCodeRRSIGsMissing,
+		},
+		{
+			name: "wildcard expansion",
+			resp: func(t *testing.T) *dns.Msg {
+				ns := ex.sign(t, mustRR(t, "*.example. 300 IN NSEC www.example. A RRSIG NSEC"))
+				return msg("host.example.", dns.TypeA, dns.RcodeSuccess, expand(t, ex, "host.example."), ns)
+			},
+			want: Secure,
+		},
+		{
+			name: "wildcard expansion without proof",
+			resp: func(t *testing.T) *dns.Msg {
+				return msg("host.example.", dns.TypeA, dns.RcodeSuccess, expand(t, ex, "host.example."), nil)
+			},
+			want: Bogus,
+			ede:  dns.ExtendedErrorCodeNSECMissing,
+		},
+		{
+			name: "insecure delegation",
+			resp: func(t *testing.T) *dns.Msg {
+				return msg("www.insecure.", dns.TypeA, dns.RcodeSuccess, []dns.RR{mustRR(t, "www.insecure. 300 IN A 192.0.2.2")}, nil)
+			},
+			want: Insecure,
+		},
+		{
+			name: "server failure",
+			resp: func(t *testing.T) *dns.Msg {
+				return msg("www.example.", dns.TypeA, dns.RcodeServerFailure, nil, nil)
+			},
+			want: Indeterminate,
+		},
+	}
+
+	v := w.validator()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := v.Validate(tt.resp(t))
+			if got.Security != tt.want {
+				t.Fatalf("security = %s (%s), want %s", got.Security, got.Reason, tt.want)
+			}
+			if got.EDE != tt.ede {
+				t.Errorf("extended error = %d (%s), want %d", got.EDE, got.Reason, tt.ede)
+			}
+		})
+	}
+}
+
+// expand returns an A record of name expanded from the wildcard of the zone
+// of s, with the wildcard's signature.
+func expand(t *testing.T, s *signer, name string) []dns.RR {
+	t.Helper()
+	signed := s.sign(t, mustRR(t, "*."+s.zone+" 300 IN A 192.0.2.9"))
+	for _, rr := range signed {
+		rr.Header().Name = name
+	}
+	return signed
+}
+
+func TestValidateUntrustedRoot(t *testing.T) {
+	w := newWorld(t)
+	other := newSigner(t, ".")
+	v := New(&config.DNSSEC{Validate: true, TrustAnchors: []string{other.ds().String()}}, w.exchange)
+
+	resp := msg("www.example.", dns.TypeA, dns.RcodeSuccess, w.example.sign(t, mustRR(t, "www.example. 300 IN A 192.0.2.1")), nil)
+	if got := v.Validate(resp); got.Security != Bogus || got.EDE != dns.ExtendedErrorCodeDNSKEYMissing {
+		t.Errorf("result = %s %d (%s), want bogus with missing DNSKEY", got.Security, got.EDE, got.Reason)
+	}
+}
+
+func TestChainBuiltOnce(t *testing.T) {
+	w := newWorld(t)
+	w.delay = 20 * time.Millisecond
+	v := w.validator()
+	resp := msg("www.example.", dns.TypeA, dns.RcodeSuccess, w.example.sign(t, mustRR(t, "www.example. 300 IN A 192.0.2.1")), nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got := v.Validate(resp.Copy()); got.Security != Secure {
+				t.Errorf("security = %s (%s), want secure", got.Security, got.Reason)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The root DNSKEY, example. DS and example. DNSKEY RRsets.
+	if got := w.queries.Load(); got != 3 {
+		t.Errorf("sent %d queries, want 3", got)
+	}
+}
@@ -0,0 +1,136 @@
+package ecs
+
+import (
+	"net"
+
+	"github.com/bwoff11/go-resolve/internal/config"
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// Policy decides the client subnet sent with each upstream query.
+type Policy struct {
+	mode       string
+	ipv4Prefix int
+	ipv6Prefix int
+	privacy    bool
+}
+
+// New creates a policy from its configuration. Unknown modes strip subnets.
+func New(cfg *config.ECS) *Policy {
+	p := &Policy{
+		mode:       cfg.Mode,
+		ipv4Prefix: cfg.IPv4Prefix,
+		ipv6Prefix: cfg.IPv6Prefix,
+		privacy:    cfg.Privacy,
+	}
+	switch p.mode {
+	case "", config.ECSStrip, config.ECSPassthrough, config.ECSSynthesize:
+	default:
+		log.Error().Str("mode", p.mode).Msg("unknown ecs mode, stripping client subnets")
+	}
+	if p.ipv4Prefix <= 0 || p.ipv4Prefix > 32 {
+		p.ipv4Prefix = 24
+	}
+	if p.ipv6Prefix <= 0 || p.ipv6Prefix > 128 {
+		p.ipv6Prefix = 56
+	}
+	return p
+}
+
+// Subnet returns the client subnet to send upstream for a query from
+// client, truncated to the configured prefix length, or nil if none is sent.
+func (p *Policy) Subnet(req *dns.Msg, client net.IP) *net.IPNet {
+	if p.mode != config.ECSPassthrough && p.mode != config.ECSSynthesize {
+		return nil
+	}
+
+	if supplied := option(req); supplied != nil && !p.privacy {
+		if supplied.SourceNetmask == 0 {
+			return nil // The client opted out as per RFC 7871 7.1.2.
+		}
+		return p.truncate(supplied.Address, int(supplied.SourceNetmask))
+	}
+	if p.mode == config.ECSSynthesize && client != nil {
+		return p.truncate(client, 128)
+	}
+	return nil
+}
+
+// truncate masks ip to prefix bits, at most the configured prefix length of its family.
+func (p *Policy) truncate(ip net.IP, prefix int) *net.IPNet {
+	if v4 := ip.To4(); v4 != nil {
+		bits := min(prefix, p.ipv4Prefix)
+		return &net.IPNet{IP: v4.Mask(net.CIDRMask(bits, 32)), Mask: net.CIDRMask(bits, 32)}
+	}
+	bits := min(prefix, p.ipv6Prefix)
+	return &net.IPNet{IP: ip.Mask(net.CIDRMask(bits, 128)), Mask: net.CIDRMask(bits, 128)}
+}
+
+// Set replaces any client subnet option of msg with subnet, or removes it if subnet is nil.
+func Set(msg *dns.Msg, subnet *net.IPNet) {
+	opt := msg.IsEdns0()
+	if opt != nil {
+		var kept []dns.EDNS0
+		for _, o := range opt.Option {
+			if _, ok := o.(*dns.EDNS0_SUBNET); !ok {
+				kept = append(kept, o)
+			}
+		}
+		opt.Option = kept
+	}
+	if subnet == nil {
+		return
+	}
+
+	if opt == nil {
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		opt = msg.IsEdns0()
+	}
+	bits, _ := subnet.Mask.Size()
+	family := uint16(1)
+	if subnet.IP.To4() == nil {
+		family = 2
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        family,
+		SourceNetmask: uint8(bits),
+		Address:       subnet.IP,
+	})
+}
+
+// Scope returns the subnet an upstream response applies to, from the scope
+// prefix length it returned for the subnet sent. It returns nil if the
+// response applies to every client.
+func Scope(resp *dns.Msg, sent *net.IPNet) *net.IPNet {
+	if sent == nil {
+		return nil
+	}
+	returned := option(resp)
+	if returned == nil || returned.SourceScope == 0 {
+		return nil
+	}
+
+	// A scope longer than the subnet sent applies to all of it, RFC 7871 7.3.1.
+	sentBits, size := sent.Mask.Size()
+	bits := min(int(returned.SourceScope), sentBits)
+	return &net.IPNet{IP: sent.IP.Mask(net.CIDRMask(bits, size)), Mask: net.CIDRMask(bits, size)}
+}
+
+// option returns the client subnet option of msg, or nil.
+func option(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	if msg == nil {
+		return nil
+	}
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+	return nil
+}
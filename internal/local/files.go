@@ -0,0 +1,262 @@
+package local
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwoff11/go-resolve/internal/config"
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// defaultFileTTL is the TTL of records from hosts and lease files without one configured.
+const defaultFileTTL = 60
+
+// fileSource is a hosts or lease file that is parsed into records.
+type fileSource struct {
+	path  string
+	parse func(r io.Reader) ([]dns.RR, error)
+}
+
+// host is an address and the names it is known by, the first being canonical.
+type host struct {
+	ip    net.IP
+	names []string
+}
+
+func fileSources(cfg *config.Local) []fileSource {
+	var files []fileSource
+	for _, hf := range cfg.HostsFiles {
+		hf := hf
+		files = append(files, fileSource{
+			path: hf.Path,
+			parse: func(r io.Reader) ([]dns.RR, error) {
+				hosts, err := parseHosts(r)
+				return hostRecords(hosts, hf.Domain, hf.TTL), err
+			},
+		})
+	}
+	for _, lf := range cfg.LeaseFiles {
+		lf := lf
+		parse := parseDnsmasqLeases
+		if lf.Format == "dhcpd" {
+			parse = parseDhcpdLeases
+		}
+		files = append(files, fileSource{
+			path: lf.Path,
+			parse: func(r io.Reader) ([]dns.RR, error) {
+				hosts, err := parse(r, time.Now())
+				return hostRecords(hosts, lf.Domain, lf.TTL), err
+			},
+		})
+	}
+	return files
+}
+
+// loadFile replaces the records of a file source with the file's current contents.
+// If the file cannot be read, its previous records are kept.
+func (l *LocalRecords) loadFile(f fileSource) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		log.Error().Err(err).Str("path", f.path).Msg("failed to open local records file")
+		return
+	}
+	defer file.Close()
+
+	rrs, err := f.parse(file)
+	if err != nil {
+		log.Error().Err(err).Str("path", f.path).Msg("failed to parse local records file")
+		return
+	}
+
+	l.setFileSource(f.path, rrs)
+	log.Info().Str("path", f.path).Int("count", len(rrs)).Msg("loaded local records file")
+}
+
+// setFileSource replaces the records of a file, leaving out those removed by
+// dynamic updates so that reloading the file does not bring them back.
+// Deletions of records no longer in the file are forgotten.
+func (l *LocalRecords) setFileSource(path string, rrs []dns.RR) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var kept, deleted []dns.RR
+	for _, rr := range rrs {
+		if containsRR(l.deleted[path], rr) {
+			deleted = append(deleted, rr)
+		} else {
+			kept = append(kept, rr)
+		}
+	}
+	if len(deleted) > 0 {
+		log.Info().Str("path", path).Int("count", len(deleted)).Msg("keeping records removed by dynamic updates out of reloaded file")
+	}
+
+	l.deleted[path] = deleted
+	l.sources[path] = kept
+	l.reindex()
+}
+
+// hostRecords converts hosts into A or AAAA records for every name and a PTR
+// record for the canonical name. Names without a dot are qualified with domain.
+func hostRecords(hosts []host, domain string, ttl int) []dns.RR {
+	if ttl <= 0 {
+		ttl = defaultFileTTL
+	}
+
+	var rrs []dns.RR
+	for _, h := range hosts {
+		var fqdns []string
+		seen := make(map[string]bool)
+		for _, name := range h.names {
+			if !strings.Contains(name, ".") && domain != "" {
+				name += "." + domain
+			}
+			if _, ok := dns.IsDomainName(name); !ok {
+				continue
+			}
+			name = dns.CanonicalName(name)
+			if !seen[name] {
+				seen[name] = true
+				fqdns = append(fqdns, name)
+			}
+		}
+		if len(fqdns) == 0 {
+			continue
+		}
+
+		canonical := len(rrs)
+		for _, name := range fqdns {
+			hdr := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: uint32(ttl)}
+			if ip4 := h.ip.To4(); ip4 != nil {
+				hdr.Rrtype = dns.TypeA
+				rrs = append(rrs, &dns.A{Hdr: hdr, A: ip4})
+			} else {
+				hdr.Rrtype = dns.TypeAAAA
+				rrs = append(rrs, &dns.AAAA{Hdr: hdr, AAAA: h.ip})
+			}
+		}
+
+		if ptr := config.PTRFor(rrs[canonical]); ptr != nil {
+			rrs = append(rrs, ptr)
+		}
+	}
+	return rrs
+}
+
+// parseHosts reads lines of "address name [alias...]", ignoring comments.
+func parseHosts(r io.Reader) ([]host, error) {
+	var hosts []host
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		hosts = append(hosts, host{ip: ip, names: fields[1:]})
+	}
+	return hosts, scanner.Err()
+}
+
+// parseDnsmasqLeases reads dnsmasq lease lines of "expiry mac|iaid address hostname client-id".
+// Leases without a host name or that expired before now are skipped.
+func parseDnsmasqLeases(r io.Reader, now time.Time) ([]host, error) {
+	var hosts []host
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// The "duid" line of DHCPv6 leases has three fields and is skipped.
+		if len(fields) < 4 || fields[3] == "*" {
+			continue
+		}
+
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil || (expiry != 0 && time.Unix(expiry, 0).Before(now)) {
+			continue
+		}
+
+		ip := net.ParseIP(fields[2])
+		if ip == nil {
+			continue
+		}
+		hosts = append(hosts, host{ip: ip, names: []string{fields[3]}})
+	}
+	return hosts, scanner.Err()
+}
+
+// parseDhcpdLeases reads ISC dhcpd lease declarations. Later declarations for
+// an address replace earlier ones, as dhcpd appends to the file.
+func parseDhcpdLeases(r io.Reader, now time.Time) ([]host, error) {
+	type lease struct {
+		hostname string
+		active   bool
+		ends     time.Time
+	}
+
+	leases := make(map[string]*lease)
+	var order []string
+	var current *lease
+	var currentIP string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(strings.TrimSuffix(strings.TrimSpace(scanner.Text()), ";"))
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch {
+		case fields[0] == "lease" && len(fields) >= 3 && fields[2] == "{":
+			currentIP = fields[1]
+			current = &lease{}
+		case current == nil:
+			continue
+		case fields[0] == "}":
+			if _, seen := leases[currentIP]; !seen {
+				order = append(order, currentIP)
+			}
+			leases[currentIP] = current
+			current = nil
+		case fields[0] == "binding" && len(fields) == 3 && fields[1] == "state":
+			current.active = fields[2] == "active"
+		case fields[0] == "client-hostname" && len(fields) == 2:
+			current.hostname = strings.Trim(fields[1], `"`)
+		case fields[0] == "ends" && len(fields) == 4:
+			// ends <weekday> <yyyy/mm/dd> <hh:mm:ss> in UTC.
+			ends, err := time.Parse("2006/01/02 15:04:05", fields[2]+" "+fields[3])
+			if err != nil {
+				return nil, fmt.Errorf("invalid lease end for %s: %w", currentIP, err)
+			}
+			current.ends = ends
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var hosts []host
+	for _, address := range order {
+		l := leases[address]
+		ip := net.ParseIP(address)
+		if ip == nil || !l.active || l.hostname == "" || (!l.ends.IsZero() && l.ends.Before(now)) {
+			continue
+		}
+		hosts = append(hosts, host{ip: ip, names: []string{l.hostname}})
+	}
+	return hosts, nil
+}
@@ -2,7 +2,6 @@ package local
 
 import (
 	"sync"
-	"time"
 
 	"github.com/bwoff11/go-resolve/internal/config"
 	"github.com/miekg/dns"
@@ -11,69 +10,197 @@ import (
 
 type LocalRecords struct {
 	mutex   sync.RWMutex
-	Records []Record
+	sources map[string][]dns.RR // Records by the config section or file they were loaded from.
+	names   map[string][]dns.RR // Owner name to every record at that name.
+	nodes   map[string]bool     // Owner names and their ancestors, including empty non-terminals.
+	zones   map[string]*dns.SOA // Apex of each authoritative zone to its SOA record.
+	journal []Change            // Dynamic updates, oldest first.
+	deleted map[string][]dns.RR // File records removed by dynamic updates, by file.
+	watcher *watcher
+
+	forwarded []string // Zones routed to a forwarder.
 }
 
-type Record struct {
-	Question *dns.Question
-	Answer   []dns.RR
-	Expiry   time.Time
+// Response is the local answer to a question.
+type Response struct {
+	Answer        []dns.RR
+	Ns            []dns.RR
+	Rcode         int
+	Authoritative bool // The question is within an authoritative zone.
 }
 
+// Record sources that are not files.
+const (
+	sourceConfig = "config"
+	sourceZones  = "zones"
+)
+
 // New creates a new LocalRecords instance.
 // It converts the configuration records to
-// DNS messages and adds them to the local
-// records cache.
+// DNS records and indexes them by owner name.
+// Hosts and lease files are watched and
+// reloaded when they change.
 func New(cfg *config.Local) *LocalRecords {
-	l := &LocalRecords{}
-	l.addRecords(cfg.Standard)
+	l := &LocalRecords{
+		sources: make(map[string][]dns.RR),
+		names:   make(map[string][]dns.RR),
+		nodes:   make(map[string]bool),
+		zones:   make(map[string]*dns.SOA),
+		deleted: make(map[string][]dns.RR),
+
+		forwarded: cfg.Reverse.Forwarded,
+	}
+
+	rrs, err := cfg.Records()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to convert local records")
+	}
+
+	soas, err := cfg.ZoneRecords()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to convert local zones")
+	}
+
+	zoneFileRecords, err := cfg.ZoneFileRecords()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to parse local zone files")
+	}
+	for _, rr := range zoneFileRecords {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			soas = append(soas, rr)
+		}
+	}
+
+	rrs = append(rrs, zoneFileRecords...)
+	if cfg.Reverse.SynthesizePTR {
+		rrs = append(rrs, synthesizePTR(rrs)...)
+	}
+
+	privateZones, err := cfg.PrivateZoneRecords()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to create private reverse zones")
+	}
+	soas = append(soas, privateZones...)
+
+	l.setSource(sourceConfig, rrs)
+	l.addZones(soas)
+
+	files := fileSources(cfg)
+	for _, f := range files {
+		l.loadFile(f)
+	}
+	if len(files) > 0 {
+		l.watcher = l.watch(files)
+	}
+
 	return l
 }
 
-func (l *LocalRecords) addRecords(records []config.StandardRecord) {
+// Close stops watching hosts and lease files.
+func (l *LocalRecords) Close() {
+	if l.watcher != nil {
+		l.watcher.close()
+	}
+}
+
+// addZones marks each SOA's owner as an authoritative zone. A SOA record
+// already configured at the apex is used in place of the synthesized one.
+func (l *LocalRecords) addZones(soas []dns.RR) {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 
-	for _, r := range records {
-		msg, err := r.ToMsg()
-		if err != nil {
-			log.Error().Err(err).Msg("failed to convert record to message")
-			continue
+	var synthesized []dns.RR
+	for _, rr := range soas {
+		apex := dns.CanonicalName(rr.Header().Name)
+		soa, configured := rr.(*dns.SOA), false
+		for _, existing := range l.names[apex] {
+			if existingSOA, ok := existing.(*dns.SOA); ok {
+				soa, configured = existingSOA, true
+			}
+		}
+		if !configured {
+			synthesized = append(synthesized, rr)
 		}
+		l.zones[apex] = soa
 
-		l.Records = append(l.Records, Record{
-			Question: &msg.Question[0],
-			Answer:   msg.Answer,
-			Expiry:   time.Now().Add(time.Duration(r.TTL) * time.Second),
-		})
+		log.Info().Str("zone", apex).Msg("serving authoritative local zone")
+	}
 
-		log.Debug().Str("domain", r.Domain).Str("type", r.Type).Str("value", r.Value).Int("ttl", r.TTL).Msg("added local record")
+	l.sources[sourceZones] = synthesized
+	l.reindex()
+}
+
+// setSource replaces every record loaded from a source.
+func (l *LocalRecords) setSource(source string, rrs []dns.RR) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.sources[source] = rrs
+	l.reindex()
+	log.Debug().Str("source", source).Int("count", len(rrs)).Msg("loaded local records")
+}
+
+// reindex rebuilds the name index from every source. The caller must hold the write lock.
+func (l *LocalRecords) reindex() {
+	l.names = make(map[string][]dns.RR)
+	l.nodes = make(map[string]bool)
+
+	for _, rrs := range l.sources {
+		for _, rr := range rrs {
+			name := dns.CanonicalName(rr.Header().Name)
+			l.names[name] = append(l.names[name], rr)
+			for _, ancestor := range ancestors(name) {
+				l.nodes[ancestor] = true
+			}
+		}
 	}
 }
 
-// Query returns the DNS message for the given question.
+// Query returns the local records answering the given question.
 func (l *LocalRecords) Query(q *dns.Question) []dns.RR {
+	if resp := l.Lookup(q); resp != nil {
+		return resp.Answer
+	}
+	return nil
+}
+
+// Lookup answers a question from local data. Within an authoritative zone,
+// names without matching records are answered with NXDOMAIN or NODATA and
+// the zone's SOA in the authority section. Lookup returns nil when the
+// question is outside every zone and no local record answers it.
+func (l *LocalRecords) Lookup(q *dns.Question) *Response {
 	l.mutex.RLock()
 	defer l.mutex.RUnlock()
 
-	var finalAnswers []dns.RR
-
-	for _, r := range l.Records {
-		if r.Question.Name == q.Name && r.Question.Qtype == q.Qtype {
-			log.Debug().Str("domain", q.Name).Str("type", dns.TypeToString[q.Qtype]).Msg("local record found")
-			finalAnswers = append(finalAnswers, r.Answer...)
-		} else if r.Question.Name == q.Name && r.Question.Qtype == dns.TypeCNAME {
-			// Found a CNAME for the queried name. Need to do a recursive lookup for the CNAME target.
-			log.Debug().Str("domain", q.Name).Str("type", dns.TypeToString[q.Qtype]).Msg("CNAME record found, performing recursive lookup")
-			finalAnswers = append(finalAnswers, r.Answer...)
-			cnameRecord := r.Answer[0].(*dns.CNAME)
-			cnameQuestion := &dns.Question{Name: cnameRecord.Target, Qtype: q.Qtype, Qclass: q.Qclass}
-			additionalAnswers := l.recursiveLookup(cnameQuestion)
-			finalAnswers = append(finalAnswers, additionalAnswers...)
-		}
+	name := dns.CanonicalName(q.Name)
+	soa := l.zone(name)
+
+	if answer := l.answer(q); len(answer) > 0 {
+		return &Response{Answer: answer, Rcode: dns.RcodeSuccess, Authoritative: soa != nil}
 	}
+	if soa == nil {
+		return nil
+	}
+
+	resp := &Response{Ns: []dns.RR{negativeSOA(soa)}, Rcode: dns.RcodeSuccess, Authoritative: true}
+	if !l.exists(name) {
+		resp.Rcode = dns.RcodeNameError
+	}
+	log.Debug().Str("domain", q.Name).Str("type", dns.TypeToString[q.Qtype]).Str("rcode", dns.RcodeToString[resp.Rcode]).Msg("negative answer from local zone")
+	return resp
+}
+
+// answer returns the records answering q. A CNAME is returned without
+// following it; the resolver chases CNAME chains across every source.
+// Wildcard owners such as *.dev.corp. follow RFC 4592: they only answer
+// names that do not exist locally, including empty non-terminals, and the
+// synthesized records carry the queried name.
+func (l *LocalRecords) answer(q *dns.Question) []dns.RR {
+	name := dns.CanonicalName(q.Name)
 
+	finalAnswers := l.match(name, q.Qtype)
 	if len(finalAnswers) > 0 {
+		log.Debug().Str("domain", q.Name).Str("type", dns.TypeToString[q.Qtype]).Msg("local record found")
 		return finalAnswers
 	}
 
@@ -81,11 +208,96 @@ func (l *LocalRecords) Query(q *dns.Question) []dns.RR {
 	return nil
 }
 
-func (l *LocalRecords) recursiveLookup(q *dns.Question) []dns.RR {
-	for _, r := range l.Records {
-		if r.Question.Name == q.Name && (r.Question.Qtype == q.Qtype || r.Question.Qtype == dns.TypeCNAME) {
-			return r.Answer
+// zone returns the SOA of the closest authoritative zone containing name.
+func (l *LocalRecords) zone(name string) *dns.SOA {
+	for _, ancestor := range ancestors(name) {
+		if soa, ok := l.zones[ancestor]; ok {
+			return soa
 		}
 	}
 	return nil
 }
+
+// exists reports whether name exists locally, directly, as an empty
+// non-terminal or through a wildcard.
+func (l *LocalRecords) exists(name string) bool {
+	if l.nodes[name] {
+		return true
+	}
+	_, ok := l.wildcard(name)
+	return ok
+}
+
+// negativeSOA returns the SOA for the authority section of a negative
+// answer, with its TTL capped at the SOA minimum as per RFC 2308.
+func negativeSOA(soa *dns.SOA) dns.RR {
+	rr := dns.Copy(soa)
+	if soa.Minttl < rr.Header().Ttl {
+		rr.Header().Ttl = soa.Minttl
+	}
+	return rr
+}
+
+// match returns the records of type qtype owned by name, or its CNAME if it has
+// no records of that type. Names that do not exist are answered from the
+// wildcard at their closest encloser, if there is one.
+func (l *LocalRecords) match(name string, qtype uint16) []dns.RR {
+	if l.nodes[name] {
+		return selectType(l.names[name], qtype)
+	}
+
+	wildcard, ok := l.wildcard(name)
+	if !ok {
+		return nil
+	}
+
+	var synthesized []dns.RR
+	for _, rr := range selectType(l.names[wildcard], qtype) {
+		rr = dns.Copy(rr)
+		rr.Header().Name = name
+		synthesized = append(synthesized, rr)
+	}
+	return synthesized
+}
+
+// wildcard returns the wildcard owner at the closest encloser of a name that does not exist.
+func (l *LocalRecords) wildcard(name string) (string, bool) {
+	for _, ancestor := range ancestors(name)[1:] {
+		if !l.nodes[ancestor] {
+			continue
+		}
+		wildcard := "*." + ancestor
+		if ancestor == "." {
+			wildcard = "*."
+		}
+		_, ok := l.names[wildcard]
+		return wildcard, ok
+	}
+	return "", false
+}
+
+// selectType returns the records of type qtype, falling back to a CNAME.
+func selectType(rrs []dns.RR, qtype uint16) []dns.RR {
+	var selected, cnames []dns.RR
+	for _, rr := range rrs {
+		switch rr.Header().Rrtype {
+		case qtype:
+			selected = append(selected, rr)
+		case dns.TypeCNAME:
+			cnames = append(cnames, rr)
+		}
+	}
+	if len(selected) > 0 {
+		return selected
+	}
+	return cnames
+}
+
+// ancestors returns name followed by each of its parents, ending with the root.
+func ancestors(name string) []string {
+	var names []string
+	for _, i := range dns.Split(name) {
+		names = append(names, name[i:])
+	}
+	return append(names, ".")
+}
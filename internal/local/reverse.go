@@ -0,0 +1,28 @@
+package local
+
+import (
+	"github.com/bwoff11/go-resolve/internal/config"
+	"github.com/miekg/dns"
+)
+
+// synthesizePTR returns a PTR record for every A and AAAA record whose address
+// has no PTR record yet. The first name seen for an address wins.
+func synthesizePTR(rrs []dns.RR) []dns.RR {
+	exists := make(map[string]bool)
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypePTR {
+			exists[dns.CanonicalName(rr.Header().Name)] = true
+		}
+	}
+
+	var ptrs []dns.RR
+	for _, rr := range rrs {
+		ptr := config.PTRFor(rr)
+		if ptr == nil || exists[ptr.Header().Name] {
+			continue
+		}
+		exists[ptr.Header().Name] = true
+		ptrs = append(ptrs, ptr)
+	}
+	return ptrs
+}
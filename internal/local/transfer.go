@@ -0,0 +1,133 @@
+package local
+
+import (
+	"sort"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// SOA returns the SOA record of an authoritative zone.
+func (l *LocalRecords) SOA(apex string) (*dns.SOA, bool) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	soa, ok := l.zones[dns.CanonicalName(apex)]
+	return soa, ok
+}
+
+// AXFR returns the records of a full zone transfer as per RFC 5936: the SOA,
+// every other record of the zone, and the SOA again.
+func (l *LocalRecords) AXFR(apex string) ([]dns.RR, bool) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	apex = dns.CanonicalName(apex)
+	soa, ok := l.zones[apex]
+	if !ok {
+		return nil, false
+	}
+	return l.axfr(apex, soa), true
+}
+
+func (l *LocalRecords) axfr(apex string, soa *dns.SOA) []dns.RR {
+	rrs := []dns.RR{soa}
+	for _, rr := range l.zoneRecords(apex) {
+		if rr.Header().Rrtype != dns.TypeSOA {
+			rrs = append(rrs, rr)
+		}
+	}
+	sort.SliceStable(rrs[1:], func(i, j int) bool {
+		return rrs[1+i].Header().Name < rrs[1+j].Header().Name
+	})
+	return append(rrs, soa)
+}
+
+// IXFR returns the records of an incremental zone transfer from serial as per
+// RFC 1995. A client that is up to date gets only the current SOA. When the
+// journal does not reach back to serial, a full transfer is returned instead.
+func (l *LocalRecords) IXFR(apex string, serial uint32) ([]dns.RR, bool) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	apex = dns.CanonicalName(apex)
+	soa, ok := l.zones[apex]
+	if !ok {
+		return nil, false
+	}
+	if !serialGreater(soa.Serial, serial) {
+		return []dns.RR{soa}, true
+	}
+
+	var chain []Change
+	current := serial
+	for _, change := range l.journal {
+		if change.Zone != apex {
+			continue
+		}
+		if old := changeSOA(change.Deleted); old != nil && old.Serial == current {
+			chain = append(chain, change)
+			current = change.Serial
+		}
+	}
+	if len(chain) == 0 || current != soa.Serial {
+		log.Debug().Str("zone", apex).Uint32("serial", serial).Msg("journal incomplete, sending full transfer")
+		return l.axfr(apex, soa), true
+	}
+
+	rrs := []dns.RR{soa}
+	for _, change := range chain {
+		rrs = append(rrs, changeSOA(change.Deleted))
+		rrs = append(rrs, withoutSOA(change.Deleted)...)
+		rrs = append(rrs, changeSOA(change.Added))
+		rrs = append(rrs, withoutSOA(change.Added)...)
+	}
+	return append(rrs, soa), true
+}
+
+// SetZone replaces the records of a zone transferred from a primary server
+// and serves it authoritatively.
+func (l *LocalRecords) SetZone(apex string, rrs []dns.RR) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	apex = dns.CanonicalName(apex)
+	soa := changeSOA(rrs)
+	if soa == nil {
+		return
+	}
+
+	l.sources[zoneSource(apex)] = withoutSOA(rrs)
+	l.sources[zoneSource(apex)] = append(l.sources[zoneSource(apex)], soa)
+	l.zones[apex] = soa
+	l.reindex()
+}
+
+// RemoveZone stops serving a zone set with SetZone.
+func (l *LocalRecords) RemoveZone(apex string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	apex = dns.CanonicalName(apex)
+	delete(l.sources, zoneSource(apex))
+	delete(l.zones, apex)
+	l.reindex()
+}
+
+func zoneSource(apex string) string {
+	return "zone:" + apex
+}
+
+// changeSOA returns the first SOA record in rrs, or nil.
+func changeSOA(rrs []dns.RR) *dns.SOA {
+	for _, rr := range rrs {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa
+		}
+	}
+	return nil
+}
+
+func withoutSOA(rrs []dns.RR) []dns.RR {
+	return remove(rrs, func(rr dns.RR) bool { return rr.Header().Rrtype == dns.TypeSOA })
+}
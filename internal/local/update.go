@@ -0,0 +1,364 @@
+package local
+
+import (
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// sourceDynamic holds records added by dynamic updates.
+const sourceDynamic = "dynamic"
+
+// journalSize is the number of changes kept for replay and incremental transfers.
+const journalSize = 1000
+
+// Change is the difference a dynamic update made to a zone, in the form used
+// by incremental zone transfers: the old SOA is deleted and the new one added.
+type Change struct {
+	Zone    string
+	Serial  uint32
+	Deleted []dns.RR
+	Added   []dns.RR
+}
+
+// Update applies an RFC 2136 update to the authoritative zone apex. The update
+// is applied atomically: if any prerequisite fails or any record is invalid,
+// nothing changes. The zone's SOA serial is incremented when records change.
+// Update returns the response code for the update.
+func (l *LocalRecords) Update(apex string, prereqs, updates []dns.RR) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	apex = dns.CanonicalName(apex)
+	soa, ok := l.zones[apex]
+	if !ok {
+		return dns.RcodeNotAuth
+	}
+
+	if rcode := l.checkPrerequisites(apex, prereqs); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+	for _, rr := range updates {
+		if rcode := l.checkUpdate(apex, rr); rcode != dns.RcodeSuccess {
+			return rcode
+		}
+	}
+
+	original := l.zoneRecords(apex)
+	working := append([]dns.RR(nil), original...)
+	for _, rr := range updates {
+		working = applyUpdate(apex, working, rr)
+	}
+
+	deleted, added := difference(original, working), difference(working, original)
+	if len(deleted) == 0 && len(added) == 0 {
+		return dns.RcodeSuccess
+	}
+
+	// Bump the serial unless the update itself raised it.
+	next := soa
+	for _, rr := range added {
+		if s, ok := rr.(*dns.SOA); ok {
+			next = s
+		}
+	}
+	if next == soa {
+		next = dns.Copy(soa).(*dns.SOA)
+		next.Serial++
+		deleted = append(deleted, soa)
+		added = append(added, next)
+	}
+
+	change := Change{Zone: apex, Serial: next.Serial, Deleted: deleted, Added: added}
+	l.apply(change)
+	log.Info().Str("zone", apex).Uint32("serial", next.Serial).Int("deleted", len(deleted)).Int("added", len(added)).Msg("dynamic update applied")
+	return dns.RcodeSuccess
+}
+
+// Journal returns the changes made by dynamic updates, oldest first.
+func (l *LocalRecords) Journal() []Change {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return append([]Change(nil), l.journal...)
+}
+
+// Replay reapplies changes, such as the journal of the LocalRecords this one
+// replaces after a configuration reload. Changes to zones that no longer
+// exist are dropped.
+func (l *LocalRecords) Replay(changes []Change) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, change := range changes {
+		if _, ok := l.zones[change.Zone]; ok {
+			l.apply(change)
+		}
+	}
+}
+
+// apply removes and adds a change's records and records it in the journal.
+// The caller must hold the write lock.
+func (l *LocalRecords) apply(change Change) {
+	removed := change.Deleted
+	for _, rr := range change.Added {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			// A replayed change may follow a SOA that differs from the one it deleted.
+			removed = append(removed, selectExact(l.names[change.Zone], dns.TypeSOA)...)
+		}
+	}
+
+	for source, rrs := range l.sources {
+		var kept []dns.RR
+		for _, rr := range rrs {
+			if !containsRR(removed, rr) {
+				kept = append(kept, rr)
+			} else if isFileSource(source) {
+				l.deleted[source] = append(l.deleted[source], rr)
+			}
+		}
+		l.sources[source] = kept
+	}
+	l.sources[sourceDynamic] = append(l.sources[sourceDynamic], change.Added...)
+
+	for _, rr := range change.Added {
+		if soa, ok := rr.(*dns.SOA); ok {
+			l.zones[change.Zone] = soa
+		}
+	}
+	l.reindex()
+
+	l.journal = append(l.journal, change)
+	if len(l.journal) > journalSize {
+		l.journal = l.journal[len(l.journal)-journalSize:]
+	}
+}
+
+// isFileSource reports whether records of source are loaded from a hosts or
+// lease file, which is reloaded whenever it changes.
+func isFileSource(source string) bool {
+	return source != sourceConfig && source != sourceZones && source != sourceDynamic
+}
+
+// checkPrerequisites evaluates the prerequisite section as per RFC 2136 3.2.
+// The caller must hold the lock.
+func (l *LocalRecords) checkPrerequisites(apex string, prereqs []dns.RR) int {
+	var required []dns.RR
+	for _, rr := range prereqs {
+		hdr := rr.Header()
+		name := dns.CanonicalName(hdr.Name)
+		if l.zoneApex(name) != apex {
+			return dns.RcodeNotZone
+		}
+		if hdr.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+
+		switch hdr.Class {
+		case dns.ClassANY:
+			if hdr.Rrtype == dns.TypeANY && len(l.names[name]) == 0 {
+				return dns.RcodeNameError
+			}
+			if hdr.Rrtype != dns.TypeANY && len(selectExact(l.names[name], hdr.Rrtype)) == 0 {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if hdr.Rrtype == dns.TypeANY && len(l.names[name]) > 0 {
+				return dns.RcodeYXDomain
+			}
+			if hdr.Rrtype != dns.TypeANY && len(selectExact(l.names[name], hdr.Rrtype)) > 0 {
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			required = append(required, rr)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	// Value dependent prerequisites must match each RRset exactly.
+	for _, rr := range required {
+		hdr := rr.Header()
+		name := dns.CanonicalName(hdr.Name)
+		existing := selectExact(l.names[name], hdr.Rrtype)
+
+		var wanted []dns.RR
+		for _, r := range required {
+			if dns.CanonicalName(r.Header().Name) == name && r.Header().Rrtype == hdr.Rrtype {
+				wanted = append(wanted, r)
+			}
+		}
+		if len(difference(existing, wanted)) > 0 || len(difference(wanted, existing)) > 0 {
+			return dns.RcodeNXRrset
+		}
+	}
+
+	return dns.RcodeSuccess
+}
+
+// checkUpdate prescans an update record as per RFC 2136 3.4.1.
+func (l *LocalRecords) checkUpdate(apex string, rr dns.RR) int {
+	hdr := rr.Header()
+	if l.zoneApex(dns.CanonicalName(hdr.Name)) != apex {
+		return dns.RcodeNotZone
+	}
+
+	switch hdr.Class {
+	case dns.ClassINET:
+		switch hdr.Rrtype {
+		case dns.TypeANY, dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB:
+			return dns.RcodeFormatError
+		}
+	case dns.ClassANY:
+		if hdr.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+	case dns.ClassNONE:
+		if hdr.Ttl != 0 || hdr.Rrtype == dns.TypeANY {
+			return dns.RcodeFormatError
+		}
+	default:
+		return dns.RcodeFormatError
+	}
+	return dns.RcodeSuccess
+}
+
+// applyUpdate applies one update record to the zone's records as per RFC 2136 3.4.2.
+func applyUpdate(apex string, records []dns.RR, rr dns.RR) []dns.RR {
+	hdr := rr.Header()
+	name := dns.CanonicalName(hdr.Name)
+	atApex := name == apex
+
+	switch hdr.Class {
+	case dns.ClassINET:
+		rr = dns.Copy(rr)
+		rr.Header().Name = name
+		existing := filterName(records, name)
+
+		switch hdr.Rrtype {
+		case dns.TypeSOA:
+			soas := selectExact(existing, dns.TypeSOA)
+			if !atApex || len(soas) == 0 || !serialGreater(rr.(*dns.SOA).Serial, soas[0].(*dns.SOA).Serial) {
+				return records
+			}
+			return append(remove(records, func(r dns.RR) bool { return r == soas[0] }), rr)
+		case dns.TypeCNAME:
+			if len(existing) > len(selectExact(existing, dns.TypeCNAME)) {
+				return records // CNAMEs cannot coexist with other data.
+			}
+			records = remove(records, func(r dns.RR) bool {
+				return dns.CanonicalName(r.Header().Name) == name && r.Header().Rrtype == dns.TypeCNAME
+			})
+			return append(records, rr)
+		default:
+			if len(selectExact(existing, dns.TypeCNAME)) > 0 {
+				return records
+			}
+		}
+
+		for i, r := range records {
+			if dns.IsDuplicate(r, rr) {
+				records[i] = rr // Same data, take the new TTL.
+				return records
+			}
+		}
+		return append(records, rr)
+
+	case dns.ClassANY:
+		return remove(records, func(r dns.RR) bool {
+			if dns.CanonicalName(r.Header().Name) != name {
+				return false
+			}
+			t := r.Header().Rrtype
+			if atApex && (t == dns.TypeSOA || t == dns.TypeNS) {
+				return false
+			}
+			return hdr.Rrtype == dns.TypeANY || t == hdr.Rrtype
+		})
+
+	default: // dns.ClassNONE
+		target := dns.Copy(rr)
+		target.Header().Class = dns.ClassINET
+		if hdr.Rrtype == dns.TypeSOA {
+			return records
+		}
+		if atApex && hdr.Rrtype == dns.TypeNS && len(selectExact(filterName(records, name), dns.TypeNS)) <= 1 {
+			return records // The last apex NS record is never removed.
+		}
+		return remove(records, func(r dns.RR) bool { return dns.IsDuplicate(r, target) })
+	}
+}
+
+// zoneRecords returns every record belonging to a zone, excluding records of
+// zones delegated below it. The caller must hold the lock.
+func (l *LocalRecords) zoneRecords(apex string) []dns.RR {
+	var rrs []dns.RR
+	for name, records := range l.names {
+		if l.zoneApex(name) == apex {
+			rrs = append(rrs, records...)
+		}
+	}
+	return rrs
+}
+
+// zoneApex returns the apex of the closest authoritative zone containing name.
+func (l *LocalRecords) zoneApex(name string) string {
+	if soa := l.zone(name); soa != nil {
+		return dns.CanonicalName(soa.Hdr.Name)
+	}
+	return ""
+}
+
+// selectExact returns the records of type rrtype, without falling back to a CNAME.
+func selectExact(rrs []dns.RR, rrtype uint16) []dns.RR {
+	var selected []dns.RR
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == rrtype {
+			selected = append(selected, rr)
+		}
+	}
+	return selected
+}
+
+func filterName(rrs []dns.RR, name string) []dns.RR {
+	var filtered []dns.RR
+	for _, rr := range rrs {
+		if dns.CanonicalName(rr.Header().Name) == name {
+			filtered = append(filtered, rr)
+		}
+	}
+	return filtered
+}
+
+func remove(rrs []dns.RR, match func(dns.RR) bool) []dns.RR {
+	var kept []dns.RR
+	for _, rr := range rrs {
+		if !match(rr) {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
+
+// difference returns the records of a that are not in b.
+func difference(a, b []dns.RR) []dns.RR {
+	var diff []dns.RR
+	for _, rr := range a {
+		if !containsRR(b, rr) {
+			diff = append(diff, rr)
+		}
+	}
+	return diff
+}
+
+func containsRR(rrs []dns.RR, rr dns.RR) bool {
+	for _, r := range rrs {
+		if r == rr || (dns.IsDuplicate(r, rr) && r.Header().Ttl == rr.Header().Ttl) {
+			return true
+		}
+	}
+	return false
+}
+
+// serialGreater compares SOA serials using RFC 1982 serial number arithmetic.
+func serialGreater(a, b uint32) bool {
+	return a != b && (a-b) < 1<<31
+}
@@ -0,0 +1,151 @@
+package local
+
+import (
+	"net"
+
+	"github.com/bwoff11/go-resolve/internal/client"
+	"github.com/bwoff11/go-resolve/internal/config"
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// Views selects the local records answering a client. The first view matching
+// the client's address, transport and interface answers the names it defines;
+// every other question is answered by the default records.
+type Views struct {
+	Default *LocalRecords
+	views   []view
+}
+
+type view struct {
+	name       string
+	networks   []*net.IPNet
+	transports []string
+	interfaces []string
+	records    *LocalRecords
+}
+
+// NewViews loads the records of each configured view on top of def.
+// Invalid CIDRs are logged and skipped.
+func NewViews(cfg []config.View, def *LocalRecords) *Views {
+	v := &Views{Default: def}
+	for _, c := range cfg {
+		entry := view{name: c.Name, transports: c.Transports, interfaces: c.Interfaces}
+		for _, cidr := range c.CIDRs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				log.Error().Err(err).Str("view", c.Name).Str("cidr", cidr).Msg("invalid view cidr")
+				continue
+			}
+			entry.networks = append(entry.networks, network)
+		}
+		records := c.Records
+		records.Views = nil
+		entry.records = New(&records)
+		v.views = append(v.views, entry)
+		log.Info().Str("view", c.Name).Int("networks", len(entry.networks)).Msg("added local view")
+	}
+	return v
+}
+
+// Lookup answers a question for the client src from its view, falling back
+// to the default records. See LocalRecords.Lookup. Names routed to a
+// forwarder are only answered by local records, not denied by an enclosing
+// local zone such as a private reverse zone.
+func (v *Views) Lookup(q *dns.Question, src client.Source) *Response {
+	if entry := v.match(src); entry != nil {
+		if resp := entry.records.Lookup(q); resp != nil {
+			log.Debug().Str("domain", q.Name).Str("view", entry.name).Msg("answered from view")
+			return resp
+		}
+	}
+	resp := v.Default.Lookup(q)
+	if resp != nil && len(resp.Answer) == 0 && v.forwarded(q.Name) {
+		return nil
+	}
+	return resp
+}
+
+// forwarded reports whether name is within a zone routed to a forwarder.
+func (v *Views) forwarded(name string) bool {
+	for _, zone := range v.Default.forwarded {
+		if dns.IsSubDomain(zone, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Close stops watching the files of every view and of the default records.
+func (v *Views) Close() {
+	for _, entry := range v.views {
+		entry.records.Close()
+	}
+	v.Default.Close()
+}
+
+// match returns the first view containing the client src, or nil.
+func (v *Views) match(src client.Source) *view {
+	ip := client.IP(src.Addr)
+	if ip == nil {
+		return nil
+	}
+	for i := range v.views {
+		entry := &v.views[i]
+		if entry.contains(ip) && entry.accepts(string(src.Protocol)) && entry.on(client.IP(src.Local)) {
+			return entry
+		}
+	}
+	return nil
+}
+
+func (e *view) contains(ip net.IP) bool {
+	for _, network := range e.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// accepts reports whether the view applies to clients of the transport protocol.
+func (e *view) accepts(protocol string) bool {
+	if len(e.transports) == 0 {
+		return true
+	}
+	for _, t := range e.transports {
+		if t == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// on reports whether the view applies to queries sent to the local address
+// ip. Interface addresses are looked up for each query, as interfaces such
+// as VPN tunnels may come and go while running.
+func (e *view) on(ip net.IP) bool {
+	if len(e.interfaces) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, name := range e.interfaces {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			log.Debug().Err(err).Str("view", e.name).Str("interface", name).Msg("view interface not found")
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if network, ok := addr.(*net.IPNet); ok && network.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package local
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+)
+
+// reloadDelay debounces bursts of writes to a watched file.
+const reloadDelay = 500 * time.Millisecond
+
+type watcher struct {
+	fsw  *fsnotify.Watcher
+	done chan struct{}
+	once sync.Once
+}
+
+// watch reloads file sources whenever they change. Parent directories are
+// watched so files replaced by rename, as DHCP servers do, are picked up.
+func (l *LocalRecords) watch(files []fileSource) *watcher {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to watch local records files")
+		return nil
+	}
+
+	byPath := make(map[string]fileSource)
+	for _, f := range files {
+		path := filepath.Clean(f.path)
+		byPath[path] = f
+		if err := fsw.Add(filepath.Dir(path)); err != nil {
+			log.Error().Err(err).Str("path", f.path).Msg("failed to watch local records file")
+		}
+	}
+
+	w := &watcher{fsw: fsw, done: make(chan struct{})}
+	go func() {
+		timers := make(map[string]*time.Timer)
+		for {
+			select {
+			case event, ok := <-fsw.Events:
+				if !ok {
+					return
+				}
+				f, watched := byPath[filepath.Clean(event.Name)]
+				if !watched || event.Op == fsnotify.Chmod {
+					continue
+				}
+				if t, pending := timers[f.path]; pending {
+					t.Reset(reloadDelay)
+					continue
+				}
+				timers[f.path] = time.AfterFunc(reloadDelay, func() { l.loadFile(f) })
+			case err, ok := <-fsw.Errors:
+				if !ok {
+					return
+				}
+				log.Error().Err(err).Msg("error watching local records files")
+			case <-w.done:
+				for _, t := range timers {
+					t.Stop()
+				}
+				return
+			}
+		}
+	}()
+
+	return w
+}
+
+func (w *watcher) close() {
+	w.once.Do(func() {
+		close(w.done)
+		w.fsw.Close()
+	})
+}
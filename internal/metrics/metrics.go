@@ -58,6 +58,37 @@ var (
 		},
 	)
 
+	BlockingPaused = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "blocking_paused",
+			Help: "Seconds remaining until blocking resumes, by client group (\"all\" for global).",
+		},
+		[]string{"group"},
+	)
+
+	TemporaryAllows = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "temporary_allows",
+			Help: "Current number of domains temporarily exempt from blocking.",
+		},
+	)
+
+	BlockedBySource = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "blocked_by_source",
+			Help: "Total number of DNS queries blocked, by block list URL.",
+		},
+		[]string{"source"},
+	)
+
+	BlockedByCategory = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "blocked_by_category",
+			Help: "Total number of DNS queries blocked, by block category.",
+		},
+		[]string{"category"},
+	)
+
 	CacheDuration = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
 			Name:    "cache_duration",
@@ -99,20 +130,60 @@ var (
 		},
 		[]string{"server"},
 	)
+
+	UpstreamRetries = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "upstream_retries",
+			Help: "Total number of queries retried on another upstream DNS server.",
+		},
+	)
+
+	UpstreamWins = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "upstream_wins",
+			Help: "Total number of parallel queries answered first by an upstream DNS server.",
+		},
+		[]string{"server"},
+	)
+
+	UpstreamUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "upstream_up",
+			Help: "Whether an upstream DNS server is considered healthy (1) or down (0).",
+		},
+		[]string{"server"},
+	)
+
+	DNSSECValidations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dnssec_validations",
+			Help: "Total number of upstream responses validated with DNSSEC, by result.",
+		},
+		[]string{"result"},
+	)
 )
 
 func init() {
 	// Register custom metrics with Prometheus
 	prometheus.MustRegister(
+		BlockedByCategory,
+		BlockedBySource,
+		BlockedCount,
 		BlocklistDuration,
+		BlockingPaused,
 		CacheDuration,
 		CacheHits,
 		CacheMisses,
 		CacheSize,
+		DNSSECValidations,
 		RequestDuration,
 		ResolutionDuration,
+		TemporaryAllows,
 		TotalQueries,
 		UpstreamDuration,
+		UpstreamRetries,
 		UpstreamRTT,
+		UpstreamUp,
+		UpstreamWins,
 	)
 }
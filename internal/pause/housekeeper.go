@@ -0,0 +1,41 @@
+package pause
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+func (s *State) startHousekeeper(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		for {
+			select {
+			case <-ticker.C:
+				s.RemoveExpired()
+			}
+		}
+	}()
+}
+
+// RemoveExpired drops pauses and allows whose time has passed.
+func (s *State) RemoveExpired() {
+	now := time.Now()
+
+	s.mutex.Lock()
+	for g, until := range s.pauses {
+		if !now.Before(until) {
+			delete(s.pauses, g)
+			log.Info().Str("group", g).Msg("blocking pause expired, blocking resumed")
+		}
+	}
+	for d, until := range s.allows {
+		if !now.Before(until) {
+			delete(s.allows, d)
+			log.Info().Str("domain", d).Msg("temporary allow expired")
+		}
+	}
+	s.mutex.Unlock()
+
+	s.updateMetrics()
+}
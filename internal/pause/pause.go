@@ -0,0 +1,149 @@
+package pause
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bwoff11/go-resolve/internal/blocklist"
+	"github.com/bwoff11/go-resolve/internal/metrics"
+	"github.com/rs/zerolog/log"
+)
+
+// Global is the group name used for pauses that apply to every client.
+const Global = "all"
+
+// State tracks temporary blocking pauses and per-domain allows.
+// Entries expire on their own, so blocking resumes automatically.
+// State is independent of the configuration and survives reloads.
+type State struct {
+	mutex  sync.RWMutex
+	pauses map[string]time.Time // Group name to resume time.
+	allows map[string]time.Time // Domain to expiry time.
+}
+
+// Status is a snapshot of the active pauses and allows.
+type Status struct {
+	Pauses map[string]time.Time `json:"pauses"`
+	Allows map[string]time.Time `json:"allows"`
+}
+
+func New() *State {
+	s := &State{
+		pauses: make(map[string]time.Time),
+		allows: make(map[string]time.Time),
+	}
+
+	expiryInterval := 1 * time.Second
+	s.startHousekeeper(expiryInterval)
+	return s
+}
+
+// Pause disables blocking for a client group, or every client if group is
+// Global or empty, until d has elapsed.
+func (s *State) Pause(group string, d time.Duration) time.Time {
+	if group == "" {
+		group = Global
+	}
+	until := time.Now().Add(d)
+
+	s.mutex.Lock()
+	s.pauses[group] = until
+	s.mutex.Unlock()
+
+	log.Info().Str("group", group).Time("until", until).Msg("blocking paused")
+	s.updateMetrics()
+	return until
+}
+
+// Resume re-enables blocking for a client group before its pause expires.
+func (s *State) Resume(group string) {
+	if group == "" {
+		group = Global
+	}
+
+	s.mutex.Lock()
+	delete(s.pauses, group)
+	s.mutex.Unlock()
+
+	log.Info().Str("group", group).Msg("blocking resumed")
+	s.updateMetrics()
+}
+
+// Allow exempts a domain from blocking until d has elapsed.
+func (s *State) Allow(domain string, d time.Duration) time.Time {
+	domain = blocklist.Normalize(domain)
+	until := time.Now().Add(d)
+
+	s.mutex.Lock()
+	s.allows[domain] = until
+	s.mutex.Unlock()
+
+	log.Info().Str("domain", domain).Time("until", until).Msg("domain temporarily allowed")
+	s.updateMetrics()
+	return until
+}
+
+// Revoke removes a temporary allow before it expires.
+func (s *State) Revoke(domain string) {
+	domain = blocklist.Normalize(domain)
+	s.mutex.Lock()
+	delete(s.allows, domain)
+	s.mutex.Unlock()
+
+	log.Info().Str("domain", domain).Msg("temporary allow revoked")
+	s.updateMetrics()
+}
+
+// Paused reports whether blocking is paused globally or for any of the groups at time t.
+func (s *State) Paused(groups []string, t time.Time) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if until, ok := s.pauses[Global]; ok && t.Before(until) {
+		return true
+	}
+	for _, g := range groups {
+		if until, ok := s.pauses[g]; ok && t.Before(until) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed reports whether a domain is temporarily exempt from blocking at time t.
+func (s *State) Allowed(domain string, t time.Time) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	until, ok := s.allows[blocklist.Normalize(domain)]
+	return ok && t.Before(until)
+}
+
+// Status returns a copy of the active pauses and allows.
+func (s *State) Status() Status {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	status := Status{
+		Pauses: make(map[string]time.Time, len(s.pauses)),
+		Allows: make(map[string]time.Time, len(s.allows)),
+	}
+	for g, until := range s.pauses {
+		status.Pauses[g] = until
+	}
+	for d, until := range s.allows {
+		status.Allows[d] = until
+	}
+	return status
+}
+
+func (s *State) updateMetrics() {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	metrics.BlockingPaused.Reset()
+	for g, until := range s.pauses {
+		metrics.BlockingPaused.WithLabelValues(g).Set(time.Until(until).Seconds())
+	}
+	metrics.TemporaryAllows.Set(float64(len(s.allows)))
+}
@@ -0,0 +1,510 @@
+package recursive
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwoff11/go-resolve/internal/cache"
+	"github.com/bwoff11/go-resolve/internal/config"
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultTimeout = 10 * time.Second        // Time allowed to resolve one query.
+	serverTimeout  = 1500 * time.Millisecond // Wait for one authoritative server before trying the next.
+	maxMinimised   = 10                      // Minimised queries per name before the full name is sent, MAX_MINIMISE_COUNT of RFC 9156.
+)
+
+var (
+	errDepth     = errors.New("recursion depth exceeded")
+	errLame      = errors.New("lame delegation")
+	errNoServers = errors.New("no reachable name server")
+)
+
+// Recursor resolves queries iteratively, starting from the root servers and
+// following referrals. Delegations and glue are kept in the shared cache, so
+// later queries start from the closest known zone.
+type Recursor struct {
+	cache        *cache.Cache
+	roots        []string // IP:port of the root servers.
+	port         string   // Port of other name servers.
+	maxDepth     int
+	minimisation string // QNAME minimisation mode.
+	timeout      time.Duration
+}
+
+// New creates a Recursor from its configuration. Root servers without a port
+// use the configured name server port.
+func New(cfg *config.Recursion, c *cache.Cache) *Recursor {
+	roots := cfg.Roots
+	if len(roots) == 0 {
+		roots = rootHints
+	}
+
+	r := &Recursor{
+		cache:        c,
+		port:         "53",
+		maxDepth:     cfg.MaxDepth,
+		minimisation: cfg.QNAMEMinimisation,
+		timeout:      time.Duration(cfg.Timeout) * time.Second,
+	}
+	if cfg.Port > 0 {
+		r.port = strconv.Itoa(cfg.Port)
+	}
+	if r.maxDepth <= 0 {
+		r.maxDepth = 16
+	}
+	if r.timeout <= 0 {
+		r.timeout = defaultTimeout
+	}
+	switch r.minimisation {
+	case config.MinimisationOff, config.MinimisationRelaxed, config.MinimisationStrict:
+	case "":
+		r.minimisation = config.MinimisationRelaxed
+	default:
+		log.Error().Str("mode", r.minimisation).Msg("unknown qname minimisation mode, using relaxed")
+		r.minimisation = config.MinimisationRelaxed
+	}
+	for _, root := range roots {
+		if _, _, err := net.SplitHostPort(root); err != nil {
+			root = net.JoinHostPort(root, r.port)
+		}
+		r.roots = append(r.roots, root)
+	}
+	return r
+}
+
+// Timeout returns the time allowed to resolve one query.
+func (r *Recursor) Timeout() time.Duration {
+	return r.timeout
+}
+
+// Exchange resolves the question of msg and returns the response to it. A name
+// that cannot be resolved is answered with SERVFAIL; only cancellation of ctx
+// is returned as an error.
+func (r *Recursor) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	q := msg.Question[0]
+	reply := new(dns.Msg)
+	reply.SetReply(msg)
+	reply.RecursionAvailable = true
+
+	resp, err := r.resolve(ctx, q.Name, q.Qtype, 0)
+	if errors.Is(err, context.Canceled) {
+		return nil, err
+	}
+	if err != nil {
+		log.Debug().Err(err).Str("domain", q.Name).Msg("recursive resolution failed")
+		reply.Rcode = dns.RcodeServerFailure
+		return reply, nil
+	}
+
+	reply.Rcode = resp.Rcode
+	reply.Answer = resp.Answer
+	reply.Ns = resp.Ns
+	return reply, nil
+}
+
+// resolve follows referrals from the closest cached delegation of name until
+// a server answers authoritatively, then completes any CNAME or DNAME chain
+// leaving the answering zone.
+//
+// With QNAME minimisation, each server is only asked for the A records of
+// the name one label below what is known to exist, until the zone cut
+// closest to name is found (RFC 9156). In relaxed mode, a server that fails
+// a minimised query or answers NXDOMAIN is asked for the full name instead.
+func (r *Recursor) resolve(ctx context.Context, name string, qtype uint16, depth int) (*dns.Msg, error) {
+	// DS records live on the parent side of a zone cut, so referrals are only
+	// followed down to the parent of name.
+	below := name
+	if qtype == dns.TypeDS {
+		below = parentName(name)
+	}
+
+	zone, servers := r.delegation(below)
+	known, minimised := zone, 0 // Deepest ancestor of name known to exist, and minimised queries sent.
+	if r.minimisation == config.MinimisationOff {
+		minimised = maxMinimised
+	}
+
+	for {
+		if depth > r.maxDepth {
+			return nil, errDepth
+		}
+
+		if child := childOf(known, name); minimised < maxMinimised && child != dns.CanonicalName(name) {
+			minimised++
+			resp, err := r.ask(ctx, zone, servers, child, dns.TypeA, depth)
+			strict := r.minimisation == config.MinimisationStrict
+			switch {
+			case strict && err != nil:
+				return nil, err
+			case strict && resp.Rcode == dns.RcodeNameError:
+				return resp, nil // Nothing exists below a nonexistent name, RFC 8020.
+			case err != nil || resp.Rcode == dns.RcodeNameError:
+				log.Debug().Str("domain", name).Str("zone", zone).Msg("minimised query failed, sending full name")
+				minimised = maxMinimised
+				continue
+			}
+			if cut, ns := referral(resp, zone, child); cut != "" {
+				log.Debug().Str("domain", name).Str("zone", cut).Msg("following referral")
+				r.cacheDelegation(zone, cut, ns, resp.Extra)
+				zone, servers, known = cut, nsNames(ns), cut
+				depth++
+				continue
+			}
+			known = child // No zone cut, the name exists within zone.
+			continue
+		}
+
+		resp, err := r.ask(ctx, zone, servers, name, qtype, depth)
+		if err != nil {
+			return nil, err
+		}
+
+		child, ns := referral(resp, zone, below)
+		if child == "" {
+			return r.follow(ctx, resp, name, qtype, depth)
+		}
+		log.Debug().Str("domain", name).Str("zone", child).Msg("following referral")
+		r.cacheDelegation(zone, child, ns, resp.Extra)
+		zone, servers, known = child, nsNames(ns), child
+		depth++
+	}
+}
+
+// parentName returns the name one label above name, or the root.
+func parentName(name string) string {
+	if i, end := dns.NextLabel(name, 0); !end {
+		return name[i:]
+	}
+	return "."
+}
+
+// childOf returns the ancestor of name one label below known, or name itself.
+func childOf(known, name string) string {
+	name = dns.CanonicalName(name)
+	labels := dns.Split(name)
+	below := len(labels) - dns.CountLabel(known) - 1
+	if below <= 0 {
+		return name
+	}
+	return name[labels[below]:]
+}
+
+// delegation returns the closest enclosing zone of name with cached name
+// servers. The root zone has no cached servers; its servers are the roots.
+func (r *Recursor) delegation(name string) (string, []string) {
+	name = dns.CanonicalName(name)
+	for _, i := range dns.Split(name) {
+		zone := name[i:]
+		if ns := r.cache.Query(&dns.Question{Name: zone, Qtype: dns.TypeNS, Qclass: dns.ClassINET}, nil); len(ns) > 0 {
+			return zone, nsNames(ns)
+		}
+	}
+	return ".", nil
+}
+
+// ask sends the query to the name servers of zone until one gives a usable
+// response. Servers with cached addresses are tried first; the addresses of
+// the others are resolved only if those fail.
+func (r *Recursor) ask(ctx context.Context, zone string, servers []string, name string, qtype uint16, depth int) (*dns.Msg, error) {
+	if zone == "." {
+		return r.askAddresses(ctx, zone, r.roots, name, qtype)
+	}
+
+	servers = append([]string(nil), servers...)
+	rand.Shuffle(len(servers), func(i, j int) { servers[i], servers[j] = servers[j], servers[i] })
+
+	var lastErr error = errNoServers
+	for _, glueless := range []bool{false, true} {
+		for _, server := range servers {
+			addrs := r.addresses(ctx, zone, server, depth, glueless)
+			if len(addrs) == 0 {
+				continue
+			}
+			resp, err := r.askAddresses(ctx, zone, addrs, name, qtype)
+			if err == nil {
+				return resp, nil
+			}
+			lastErr = err
+		}
+	}
+	return nil, lastErr
+}
+
+// askAddresses sends the query to each address in turn, skipping lame servers.
+// Answer and authority records outside zone are dropped: a server is only
+// trusted for its own zone, and following an alias out of it means asking the
+// target's servers.
+func (r *Recursor) askAddresses(ctx context.Context, zone string, addrs []string, name string, qtype uint16) (*dns.Msg, error) {
+	var lastErr error = errNoServers
+	for _, addr := range addrs {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		resp, err := exchange(ctx, addr, name, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resp.Answer = inBailiwick(resp.Answer, zone)
+		resp.Ns = inBailiwick(resp.Ns, zone)
+		if lame(resp, zone, name) {
+			log.Warn().Str("zone", zone).Str("server", addr).Int("rcode", resp.Rcode).Msg("lame delegation")
+			lastErr = errLame
+			continue
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+// addresses returns the IP:port addresses of a name server of zone from its
+// cached A and AAAA records. With glueless set, an uncached server outside
+// zone is resolved first; one inside zone cannot be, as that needs its
+// missing glue.
+func (r *Recursor) addresses(ctx context.Context, zone, server string, depth int, glueless bool) []string {
+	server = dns.CanonicalName(server)
+	records := r.cachedAddresses(server)
+	if len(records) == 0 && glueless && !dns.IsSubDomain(zone, server) {
+		log.Debug().Str("zone", zone).Str("server", server).Msg("resolving glueless name server")
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			resp, err := r.resolve(ctx, server, qtype, depth+1)
+			if err != nil {
+				continue
+			}
+			if found := addressRecords(resp.Answer, qtype); len(found) > 0 {
+				r.cache.Add(&dns.Question{Name: server, Qtype: qtype, Qclass: dns.ClassINET}, found, nil)
+				records = append(records, found...)
+			}
+		}
+	}
+
+	var addrs []string
+	for _, rr := range records {
+		switch a := rr.(type) {
+		case *dns.A:
+			addrs = append(addrs, net.JoinHostPort(a.A.String(), r.port))
+		case *dns.AAAA:
+			addrs = append(addrs, net.JoinHostPort(a.AAAA.String(), r.port))
+		}
+	}
+	return addrs
+}
+
+// cachedAddresses returns the cached A records of server followed by its AAAA records.
+func (r *Recursor) cachedAddresses(server string) []dns.RR {
+	var records []dns.RR
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		q := &dns.Question{Name: server, Qtype: qtype, Qclass: dns.ClassINET}
+		records = append(records, addressRecords(r.cache.Query(q, nil), qtype)...)
+	}
+	return records
+}
+
+// cacheDelegation caches the name servers of child, delegated from zone, and
+// the glue addresses of those within zone. Other glue is out of bailiwick and
+// could poison the cache.
+func (r *Recursor) cacheDelegation(zone, child string, ns []dns.RR, extra []dns.RR) {
+	r.cache.Add(&dns.Question{Name: child, Qtype: dns.TypeNS, Qclass: dns.ClassINET}, ns, nil)
+
+	for _, server := range nsNames(ns) {
+		if !dns.IsSubDomain(zone, server) {
+			continue
+		}
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			var glue []dns.RR
+			for _, rr := range addressRecords(extra, qtype) {
+				if strings.EqualFold(rr.Header().Name, server) {
+					glue = append(glue, rr)
+				}
+			}
+			if len(glue) > 0 {
+				r.cache.Add(&dns.Question{Name: server, Qtype: qtype, Qclass: dns.ClassINET}, glue, nil)
+			}
+		}
+	}
+}
+
+// follow completes the chain of CNAME and DNAME records in an answer. Links
+// the answering server had no data for, including every name outside its
+// zone, are resolved from their own zones.
+func (r *Recursor) follow(ctx context.Context, resp *dns.Msg, name string, qtype uint16, depth int) (*dns.Msg, error) {
+	if resp.Rcode != dns.RcodeSuccess || qtype == dns.TypeCNAME || qtype == dns.TypeDNAME {
+		return resp, nil
+	}
+
+	target := name
+	for hops := 0; ; hops++ {
+		if hops > r.maxDepth {
+			return nil, errDepth
+		}
+		if owns(resp.Answer, target, qtype) {
+			return resp, nil
+		}
+
+		next := cnameTarget(resp.Answer, target)
+		if next == "" {
+			synthesized := dnameCNAME(resp.Answer, target)
+			if synthesized == nil {
+				return resp, nil // No data for the end of the chain.
+			}
+			resp.Answer = append(resp.Answer, synthesized)
+			next = synthesized.Target
+		}
+		target = next
+
+		if !owns(resp.Answer, target, dns.TypeCNAME) && !owns(resp.Answer, target, qtype) {
+			sub, err := r.resolve(ctx, target, qtype, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			resp.Answer = append(resp.Answer, sub.Answer...)
+			resp.Ns = sub.Ns
+			resp.Rcode = sub.Rcode
+			return resp, nil
+		}
+	}
+}
+
+// exchange sends a non-recursive query to addr, retrying over TCP if the
+// response is truncated. Signatures are always requested, so that answers
+// can be validated.
+func exchange(ctx context.Context, addr, name string, qtype uint16) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, serverTimeout)
+	defer cancel()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	msg.RecursionDesired = false
+	msg.SetEdns0(dns.DefaultMsgSize, true)
+
+	c := &dns.Client{Timeout: serverTimeout}
+	resp, _, err := c.ExchangeContext(ctx, msg, addr)
+	if err == nil && resp.Truncated {
+		c.Net = "tcp"
+		resp, _, err = c.ExchangeContext(ctx, msg, addr)
+	}
+	return resp, err
+}
+
+// lame reports whether a response from a server of zone is unusable: an
+// error, or neither an answer nor a referral closer to name.
+func lame(resp *dns.Msg, zone, name string) bool {
+	switch resp.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		return true
+	}
+	if resp.Authoritative || len(resp.Answer) > 0 {
+		return false
+	}
+	child, _ := referral(resp, zone, name)
+	return child == ""
+}
+
+// referral returns the zone a response from a server of zone delegates name
+// to, and its NS records. It returns an empty zone for anything else,
+// including referrals that do not lead closer to name.
+func referral(resp *dns.Msg, zone, name string) (string, []dns.RR) {
+	if resp.Authoritative || len(resp.Answer) > 0 {
+		return "", nil
+	}
+
+	var child string
+	var ns []dns.RR
+	for _, rr := range resp.Ns {
+		record, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		owner := dns.CanonicalName(record.Hdr.Name)
+		if owner == dns.CanonicalName(zone) || !dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(owner, name) {
+			continue
+		}
+		if child != "" && owner != child {
+			continue
+		}
+		child = owner
+		ns = append(ns, record)
+	}
+	return child, ns
+}
+
+// nsNames returns the name server names of NS records.
+func nsNames(records []dns.RR) []string {
+	var names []string
+	for _, rr := range records {
+		if ns, ok := rr.(*dns.NS); ok {
+			names = append(names, dns.CanonicalName(ns.Ns))
+		}
+	}
+	return names
+}
+
+// addressRecords returns the records of type qtype, A or AAAA, among records.
+func addressRecords(records []dns.RR, qtype uint16) []dns.RR {
+	var addrs []dns.RR
+	for _, rr := range records {
+		if rr.Header().Rrtype == qtype {
+			addrs = append(addrs, rr)
+		}
+	}
+	return addrs
+}
+
+// inBailiwick returns the records owned by names within zone.
+func inBailiwick(records []dns.RR, zone string) []dns.RR {
+	var kept []dns.RR
+	for _, rr := range records {
+		if dns.IsSubDomain(zone, rr.Header().Name) {
+			kept = append(kept, rr)
+		} else {
+			log.Debug().Str("zone", zone).Str("record", rr.String()).Msg("dropping out of bailiwick record")
+		}
+	}
+	return kept
+}
+
+// owns reports whether records contain a record of type qtype owned by name.
+func owns(records []dns.RR, name string, qtype uint16) bool {
+	for _, rr := range records {
+		if rr.Header().Rrtype == qtype && strings.EqualFold(rr.Header().Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// cnameTarget returns the target of the CNAME record owned by name, or "".
+func cnameTarget(records []dns.RR, name string) string {
+	for _, rr := range records {
+		if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+			return cname.Target
+		}
+	}
+	return ""
+}
+
+// dnameCNAME synthesizes the CNAME record for name from a DNAME record
+// owned by one of its ancestors, as per RFC 6672 section 2.2, or returns nil.
+func dnameCNAME(records []dns.RR, name string) *dns.CNAME {
+	for _, rr := range records {
+		dname, ok := rr.(*dns.DNAME)
+		if !ok || strings.EqualFold(dname.Hdr.Name, name) || !dns.IsSubDomain(dname.Hdr.Name, name) {
+			continue
+		}
+		prefix := name[:len(name)-len(dns.Fqdn(dname.Hdr.Name))]
+		return &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: dname.Hdr.Ttl},
+			Target: prefix + dns.Fqdn(dname.Target),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,541 @@
+package recursive
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwoff11/go-resolve/internal/cache"
+	"github.com/bwoff11/go-resolve/internal/config"
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog"
+)
+
+func TestMain(m *testing.M) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	os.Exit(m.Run())
+}
+
+// authority is a stand-in authoritative server for a set of zones. It
+// answers from the closest enclosing zone it serves, refers queries below a
+// zone cut to the child's name servers and otherwise answers NXDOMAIN or
+// NODATA, like a real authoritative server.
+type authority struct {
+	zones map[string][]dns.RR // Apex to every record of the zone, including delegations and glue.
+	// answer, if set, replaces the response to every query.
+	answer func(req *dns.Msg) *dns.Msg
+
+	mutex   sync.Mutex
+	queries []string // Names asked, in order.
+}
+
+func (a *authority) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	a.mutex.Lock()
+	a.queries = append(a.queries, dns.CanonicalName(req.Question[0].Name))
+	a.mutex.Unlock()
+
+	if a.answer != nil {
+		w.WriteMsg(a.answer(req))
+		return
+	}
+	w.WriteMsg(a.respond(req))
+}
+
+func (a *authority) respond(req *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	q := req.Question[0]
+	name := dns.CanonicalName(q.Name)
+
+	apex, found := "", false
+	for zone := range a.zones {
+		if dns.IsSubDomain(zone, name) && (!found || dns.CountLabel(zone) > dns.CountLabel(apex)) {
+			apex, found = zone, true
+		}
+	}
+	if !found {
+		resp.Rcode = dns.RcodeRefused
+		return resp
+	}
+	records := a.zones[apex]
+
+	// Delegations below the apex, closest to the apex first.
+	labels := dns.Split(name)
+	for i := len(labels) - 1; i >= 0; i-- {
+		cut := name[labels[i]:]
+		if cut == apex || !dns.IsSubDomain(apex, cut) {
+			continue
+		}
+		ns := rrsetOf(records, cut, dns.TypeNS)
+		if len(ns) == 0 {
+			continue
+		}
+		resp.Ns = ns
+		for _, rr := range ns {
+			server := rr.(*dns.NS).Ns
+			resp.Extra = append(resp.Extra, rrsetOf(records, server, dns.TypeA)...)
+			resp.Extra = append(resp.Extra, rrsetOf(records, server, dns.TypeAAAA)...)
+		}
+		return resp
+	}
+
+	resp.Authoritative = true
+	for _, rr := range records {
+		dname, ok := rr.(*dns.DNAME)
+		if ok && name != dname.Hdr.Name && dns.IsSubDomain(dname.Hdr.Name, name) {
+			resp.Answer = append(resp.Answer, dname)
+			return resp
+		}
+	}
+	if answer := rrsetOf(records, name, q.Qtype); len(answer) > 0 {
+		resp.Answer = answer
+		return resp
+	}
+	if cname := rrsetOf(records, name, dns.TypeCNAME); len(cname) > 0 {
+		resp.Answer = cname
+		return resp
+	}
+
+	resp.Ns = rrsetOf(records, apex, dns.TypeSOA)
+	exists := false
+	for _, rr := range records {
+		if dns.IsSubDomain(name, rr.Header().Name) {
+			exists = true
+		}
+	}
+	if !exists {
+		resp.Rcode = dns.RcodeNameError
+	}
+	return resp
+}
+
+// asked returns the names the authority was asked for.
+func (a *authority) asked() []string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return append([]string(nil), a.queries...)
+}
+
+func rrsetOf(records []dns.RR, name string, qtype uint16) []dns.RR {
+	var set []dns.RR
+	for _, rr := range records {
+		if rr.Header().Rrtype == qtype && strings.EqualFold(rr.Header().Name, name) {
+			set = append(set, rr)
+		}
+	}
+	return set
+}
+
+func newZone(t *testing.T, apex string, records ...string) []dns.RR {
+	t.Helper()
+	rrs := []dns.RR{mustRR(t, apex+" 300 IN SOA ns.invalid. admin.invalid. 1 3600 600 86400 300")}
+	for _, s := range records {
+		rrs = append(rrs, mustRR(t, s))
+	}
+	return rrs
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatalf("invalid record %q: %v", s, err)
+	}
+	return rr
+}
+
+// freePort returns a UDP port that is free on 127.0.0.1, to be used by every
+// stand-in server as the recursor only queries name servers on one port.
+func freePort(t *testing.T) int {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// serve starts an authority on ip and port until the test ends.
+func serve(t *testing.T, ip string, port int, a *authority) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", net.JoinHostPort(ip, strconv.Itoa(port)))
+	if err != nil {
+		t.Skipf("cannot listen on %s: %v", ip, err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: conn, Handler: a, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+}
+
+// newRecursor returns a Recursor using the stand-in root server on 127.0.0.1.
+func newRecursor(port int, cfg config.Recursion) *Recursor {
+	cfg.Roots = []string{"127.0.0.1"}
+	cfg.Port = port
+	return New(&cfg, cache.New())
+}
+
+func resolve(t *testing.T, r *Recursor, name string, qtype uint16) (*dns.Msg, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	return r.Exchange(ctx, msg)
+}
+
+// addresses returns the A and AAAA addresses in the answer of resp.
+func addresses(resp *dns.Msg) []string {
+	var addrs []string
+	for _, rr := range resp.Answer {
+		switch a := rr.(type) {
+		case *dns.A:
+			addrs = append(addrs, a.A.String())
+		case *dns.AAAA:
+			addrs = append(addrs, a.AAAA.String())
+		}
+	}
+	return addrs
+}
+
+// setup starts the root and test. servers, test. delegating to the zones
+// of the other servers started by each test.
+func setup(t *testing.T, delegations ...string) int {
+	t.Helper()
+	port := freePort(t)
+	serve(t, "127.0.0.1", port, &authority{zones: map[string][]dns.RR{
+		".": newZone(t, ".",
+			"test. 300 IN NS ns.test.",
+			"ns.test. 300 IN A 127.0.0.2",
+			"other. 300 IN NS ns.other.",
+			"ns.other. 300 IN A 127.0.0.3",
+		),
+	}})
+	serve(t, "127.0.0.2", port, &authority{zones: map[string][]dns.RR{
+		"test.": newZone(t, "test.", append([]string{
+			"test. 300 IN NS ns.test.",
+			"ns.test. 300 IN A 127.0.0.2",
+			"www.test. 300 IN A 192.0.2.1",
+		}, delegations...)...),
+	}})
+	return port
+}
+
+func TestReferrals(t *testing.T) {
+	port := setup(t,
+		"sub.test. 300 IN NS ns.sub.test.",
+		"ns.sub.test. 300 IN A 127.0.0.4",
+	)
+	serve(t, "127.0.0.4", port, &authority{zones: map[string][]dns.RR{
+		"sub.test.": newZone(t, "sub.test.", "www.sub.test. 300 IN A 192.0.2.2"),
+	}})
+
+	for _, mode := range []string{config.MinimisationOff, config.MinimisationRelaxed, config.MinimisationStrict} {
+		t.Run(mode, func(t *testing.T) {
+			r := newRecursor(port, config.Recursion{QNAMEMinimisation: mode})
+
+			resp, err := resolve(t, r, "www.sub.test.", dns.TypeA)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := addresses(resp); len(got) != 1 || got[0] != "192.0.2.2" {
+				t.Errorf("answer = %v, want [192.0.2.2]", got)
+			}
+
+			if zone, servers := r.delegation("www.sub.test."); zone != "sub.test." || len(servers) != 1 {
+				t.Errorf("cached delegation = %s %v, want sub.test. [ns.sub.test.]", zone, servers)
+			}
+
+			resp, err = resolve(t, r, "nope.sub.test.", dns.TypeA)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Rcode != dns.RcodeNameError {
+				t.Errorf("rcode = %s, want NXDOMAIN", dns.RcodeToString[resp.Rcode])
+			}
+		})
+	}
+}
+
+func TestQNAMEMinimisation(t *testing.T) {
+	port := freePort(t)
+	root := &authority{zones: map[string][]dns.RR{
+		".": newZone(t, ".", "test. 300 IN NS ns.test.", "ns.test. 300 IN A 127.0.0.2"),
+	}}
+	test := &authority{zones: map[string][]dns.RR{
+		"test.": newZone(t, "test.",
+			"test. 300 IN NS ns.test.",
+			"ns.test. 300 IN A 127.0.0.2",
+			"sub.test. 300 IN NS ns.sub.test.",
+			"ns.sub.test. 300 IN A 127.0.0.4",
+		),
+	}}
+	sub := &authority{zones: map[string][]dns.RR{
+		"sub.test.": newZone(t, "sub.test.", "a.b.www.sub.test. 300 IN A 192.0.2.2"),
+	}}
+	serve(t, "127.0.0.1", port, root)
+	serve(t, "127.0.0.2", port, test)
+	serve(t, "127.0.0.4", port, sub)
+
+	resp, err := resolve(t, newRecursor(port, config.Recursion{QNAMEMinimisation: config.MinimisationRelaxed}), "a.b.www.sub.test.", dns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := addresses(resp); len(got) != 1 || got[0] != "192.0.2.2" {
+		t.Fatalf("answer = %v, want [192.0.2.2]", got)
+	}
+
+	// Servers above sub.test. only learn the next label of the name.
+	for _, tt := range []struct {
+		server string
+		a      *authority
+		want   string
+	}{
+		{"root", root, "test."},
+		{"test.", test, "sub.test."},
+	} {
+		for _, name := range tt.a.asked() {
+			if name != tt.want {
+				t.Errorf("%s server was asked for %s, want only %s", tt.server, name, tt.want)
+			}
+		}
+	}
+	if got := sub.asked(); got[len(got)-1] != "a.b.www.sub.test." {
+		t.Errorf("sub.test. server was last asked for %v, want the full name", got)
+	}
+}
+
+func TestRelaxedMinimisation(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		rcode int // Answer to minimised queries by a broken server.
+	}{
+		{"nxdomain", dns.RcodeNameError},
+		{"servfail", dns.RcodeServerFailure},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			port := setup(t,
+				"sub.test. 300 IN NS ns.sub.test.",
+				"ns.sub.test. 300 IN A 127.0.0.4",
+			)
+			sub := &authority{zones: map[string][]dns.RR{
+				"sub.test.": newZone(t, "sub.test.", "a.b.www.sub.test. 300 IN A 192.0.2.2"),
+			}}
+			sub.answer = func(req *dns.Msg) *dns.Msg {
+				if dns.CanonicalName(req.Question[0].Name) == "a.b.www.sub.test." {
+					return sub.respond(req)
+				}
+				resp := new(dns.Msg)
+				resp.SetRcode(req, tt.rcode)
+				resp.Authoritative = true
+				resp.Ns = rrsetOf(sub.zones["sub.test."], "sub.test.", dns.TypeSOA)
+				return resp
+			}
+			serve(t, "127.0.0.4", port, sub)
+
+			resp, err := resolve(t, newRecursor(port, config.Recursion{QNAMEMinimisation: config.MinimisationRelaxed}), "a.b.www.sub.test.", dns.TypeA)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := addresses(resp); len(got) != 1 || got[0] != "192.0.2.2" {
+				t.Errorf("relaxed answer = %s %v, want [192.0.2.2] after sending the full name", dns.RcodeToString[resp.Rcode], got)
+			}
+
+			// Strict minimisation gives up instead.
+			resp, err = resolve(t, newRecursor(port, config.Recursion{QNAMEMinimisation: config.MinimisationStrict}), "a.b.www.sub.test.", dns.TypeA)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Rcode != tt.rcode {
+				t.Errorf("strict rcode = %s, want %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.rcode])
+			}
+		})
+	}
+}
+
+func TestGluelessDelegation(t *testing.T) {
+	port := setup(t, "glueless.test. 300 IN NS ns.glueless.other.")
+	serve(t, "127.0.0.3", port, &authority{zones: map[string][]dns.RR{
+		"other.": newZone(t, "other.", "ns.glueless.other. 300 IN A 127.0.0.5"),
+	}})
+	serve(t, "127.0.0.5", port, &authority{zones: map[string][]dns.RR{
+		"glueless.test.": newZone(t, "glueless.test.", "www.glueless.test. 300 IN A 192.0.2.5"),
+	}})
+
+	resp, err := resolve(t, newRecursor(port, config.Recursion{}), "www.glueless.test.", dns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := addresses(resp); len(got) != 1 || got[0] != "192.0.2.5" {
+		t.Errorf("answer = %v, want [192.0.2.5]", got)
+	}
+}
+
+func TestIPv6OnlyNameServer(t *testing.T) {
+	port := setup(t,
+		"v6.test. 300 IN NS ns.v6.test.",
+		"ns.v6.test. 300 IN AAAA ::1",
+	)
+	serve(t, "::1", port, &authority{zones: map[string][]dns.RR{
+		"v6.test.": newZone(t, "v6.test.", "www.v6.test. 300 IN AAAA 2001:db8::6"),
+	}})
+
+	resp, err := resolve(t, newRecursor(port, config.Recursion{}), "www.v6.test.", dns.TypeAAAA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := addresses(resp); len(got) != 1 || got[0] != "2001:db8::6" {
+		t.Errorf("answer = %v, want [2001:db8::6]", got)
+	}
+}
+
+func TestLameDelegation(t *testing.T) {
+	port := setup(t,
+		"lame.test. 300 IN NS ns1.lame.test.",
+		"lame.test. 300 IN NS ns2.lame.test.",
+		"ns1.lame.test. 300 IN A 127.0.0.6",
+		"ns2.lame.test. 300 IN A 127.0.0.7",
+	)
+	serve(t, "127.0.0.6", port, &authority{answer: func(req *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg)
+		return resp.SetRcode(req, dns.RcodeRefused)
+	}})
+	serve(t, "127.0.0.7", port, &authority{zones: map[string][]dns.RR{
+		"lame.test.": newZone(t, "lame.test.", "www.lame.test. 300 IN A 192.0.2.7"),
+	}})
+
+	r := newRecursor(port, config.Recursion{})
+	// The lame server is tried first about half the time.
+	for i := 0; i < 4; i++ {
+		resp, err := resolve(t, r, "www.lame.test.", dns.TypeA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := addresses(resp); len(got) != 1 || got[0] != "192.0.2.7" {
+			t.Errorf("answer = %v, want [192.0.2.7]", got)
+		}
+	}
+}
+
+func TestAliasesAcrossZones(t *testing.T) {
+	port := setup(t,
+		"alias.test. 300 IN CNAME www.other.",
+		"old.test. 300 IN DNAME other.",
+	)
+	serve(t, "127.0.0.3", port, &authority{zones: map[string][]dns.RR{
+		"other.": newZone(t, "other.",
+			"www.other. 300 IN A 192.0.2.3",
+			"host.other. 300 IN A 192.0.2.4",
+		),
+	}})
+
+	tests := []struct {
+		name   string
+		chain  int // Records in the answer before the address.
+		answer string
+	}{
+		{"alias.test.", 1, "192.0.2.3"},    // CNAME
+		{"host.old.test.", 2, "192.0.2.4"}, // DNAME and synthesized CNAME
+	}
+	r := newRecursor(port, config.Recursion{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := resolve(t, r, tt.name, dns.TypeA)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := addresses(resp); len(got) != 1 || got[0] != tt.answer {
+				t.Errorf("answer = %v, want [%s]", got, tt.answer)
+			}
+			if len(resp.Answer) != tt.chain+1 {
+				t.Errorf("answer has %d records, want %d: %v", len(resp.Answer), tt.chain+1, resp.Answer)
+			}
+		})
+	}
+}
+
+func TestOutOfBailiwickAnswer(t *testing.T) {
+	port := setup(t,
+		"evil.test. 300 IN NS ns.evil.test.",
+		"ns.evil.test. 300 IN A 127.0.0.8",
+	)
+	serve(t, "127.0.0.8", port, &authority{answer: func(req *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Authoritative = true
+		resp.Answer = []dns.RR{
+			mustRR(t, req.Question[0].Name+" 300 IN CNAME bank.other."),
+			mustRR(t, "bank.other. 300 IN A 198.51.100.66"),
+		}
+		return resp
+	}})
+	serve(t, "127.0.0.3", port, &authority{zones: map[string][]dns.RR{
+		"other.": newZone(t, "other.", "bank.other. 300 IN A 192.0.2.9"),
+	}})
+
+	resp, err := resolve(t, newRecursor(port, config.Recursion{}), "www.evil.test.", dns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := addresses(resp); len(got) != 1 || got[0] != "192.0.2.9" {
+		t.Errorf("answer = %v, want the target's own address [192.0.2.9]", got)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	port := setup(t,
+		"loop.test. 300 IN CNAME loop.other.",
+		"deep.test. 300 IN NS ns.deep.test.",
+		"ns.deep.test. 300 IN A 127.0.0.9",
+	)
+	serve(t, "127.0.0.3", port, &authority{zones: map[string][]dns.RR{
+		"other.": newZone(t, "other.", "loop.other. 300 IN CNAME loop.test."),
+	}})
+	serve(t, "127.0.0.9", port, &authority{zones: map[string][]dns.RR{
+		"deep.test.": newZone(t, "deep.test.",
+			"a.deep.test. 300 IN NS ns.a.deep.test.",
+			"ns.a.deep.test. 300 IN A 127.0.0.10",
+		),
+	}})
+	serve(t, "127.0.0.10", port, &authority{zones: map[string][]dns.RR{
+		"a.deep.test.": newZone(t, "a.deep.test.", "www.a.deep.test. 300 IN A 192.0.2.10"),
+	}})
+
+	t.Run("cname loop", func(t *testing.T) {
+		resp, err := resolve(t, newRecursor(port, config.Recursion{MaxDepth: 4}), "loop.test.", dns.TypeA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Rcode != dns.RcodeServerFailure {
+			t.Errorf("rcode = %s, want SERVFAIL", dns.RcodeToString[resp.Rcode])
+		}
+	})
+
+	t.Run("referral depth", func(t *testing.T) {
+		// Root, test., deep.test. and a.deep.test. are three referrals deep.
+		cfg := config.Recursion{MaxDepth: 2, QNAMEMinimisation: config.MinimisationOff}
+		resp, err := resolve(t, newRecursor(port, cfg), "www.a.deep.test.", dns.TypeA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Rcode != dns.RcodeServerFailure {
+			t.Errorf("rcode = %s, want SERVFAIL", dns.RcodeToString[resp.Rcode])
+		}
+
+		cfg.MaxDepth = 3
+		resp, err = resolve(t, newRecursor(port, cfg), "www.a.deep.test.", dns.TypeA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := addresses(resp); len(got) != 1 || got[0] != "192.0.2.10" {
+			t.Errorf("answer = %v, want [192.0.2.10]", got)
+		}
+	})
+}
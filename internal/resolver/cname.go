@@ -0,0 +1,74 @@
+package resolver
+
+import (
+	"errors"
+
+	"github.com/bwoff11/go-resolve/internal/client"
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	errCNAMELoop  = errors.New("cname loop")
+	errCNAMEDepth = errors.New("cname chain too long")
+)
+
+// chase follows the CNAME chain starting at q's name through answer, looking
+// up each target that answer does not already cover in the local records of
+// the client at src, the cache or upstream. It returns answer with the rest of the chain appended.
+// A loop or a chain longer than the configured depth is reported as an
+// error alongside the records gathered so far.
+func (r *Resolver) chase(q *dns.Question, answer []dns.RR, src client.Source) ([]dns.RR, error) {
+	if q.Qtype == dns.TypeCNAME {
+		return answer, nil
+	}
+
+	name := dns.CanonicalName(q.Name)
+	seen := map[string]bool{name: true}
+	for hops := 0; ; hops++ {
+		target := cnameTarget(answer, name)
+		if target == "" {
+			return answer, nil
+		}
+		if seen[target] {
+			log.Warn().Str("domain", q.Name).Str("target", target).Msg("cname loop detected")
+			return answer, errCNAMELoop
+		}
+		if hops >= r.CNAMEDepth {
+			log.Warn().Str("domain", q.Name).Int("depth", r.CNAMEDepth).Msg("cname chain exceeds maximum depth")
+			return answer, errCNAMEDepth
+		}
+		seen[target] = true
+		name = target
+
+		if owns(answer, name) {
+			continue // The source already included the next link.
+		}
+		records := r.lookup(&dns.Question{Name: name, Qtype: q.Qtype, Qclass: q.Qclass}, src)
+		if len(records) == 0 {
+			return answer, nil
+		}
+		log.Debug().Str("domain", q.Name).Str("target", name).Msg("following cname")
+		answer = append(answer, records...)
+	}
+}
+
+// cnameTarget returns the target of the CNAME owned by name in rrs, if any.
+func cnameTarget(rrs []dns.RR, name string) string {
+	for _, rr := range rrs {
+		if cname, ok := rr.(*dns.CNAME); ok && dns.CanonicalName(cname.Hdr.Name) == name {
+			return dns.CanonicalName(cname.Target)
+		}
+	}
+	return ""
+}
+
+// owns reports whether any record in rrs is owned by name.
+func owns(rrs []dns.RR, name string) bool {
+	for _, rr := range rrs {
+		if dns.CanonicalName(rr.Header().Name) == name {
+			return true
+		}
+	}
+	return false
+}
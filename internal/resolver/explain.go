@@ -0,0 +1,71 @@
+package resolver
+
+import (
+	"net"
+	"time"
+
+	"github.com/bwoff11/go-resolve/internal/blocklist"
+)
+
+// Explanation describes why a domain is or is not blocked for a client.
+type Explanation struct {
+	Domain  string   `json:"domain"`
+	Client  string   `json:"client,omitempty"`
+	Groups  []string `json:"groups"`
+	Blocked bool     `json:"blocked"`
+	Allowed bool     `json:"allowed"` // A temporary allow overrides every match.
+	Paused  bool     `json:"paused"`  // Blocking is paused for the client.
+	Matches []Match  `json:"matches"`
+}
+
+// Match is a block list entry matching the explained domain.
+type Match struct {
+	Source   string   `json:"source"`
+	Category string   `json:"category"`
+	Reason   string   `json:"reason"`
+	RuleType string   `json:"ruleType"`
+	Rules    []string `json:"rules"`    // Blocking rules selecting the entry.
+	Enforced bool     `json:"enforced"` // Whether the entry's rules apply to the client right now.
+}
+
+// Explain reports every block list entry matching domain and whether it
+// would block a query from clientIP, which may be nil, at this moment.
+func (r *Resolver) Explain(domain string, clientIP net.IP) Explanation {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	now := time.Now()
+	domain = blocklist.Normalize(domain)
+	groups := r.ClientGroups.Match(clientIP)
+
+	e := Explanation{
+		Domain:  domain,
+		Groups:  groups,
+		Allowed: r.Pause.Allowed(domain, now),
+		Paused:  r.Pause.Paused(groups, now),
+		Matches: []Match{},
+	}
+	if clientIP != nil {
+		e.Client = clientIP.String()
+	}
+
+	for _, block := range r.BlockList.QueryAll(domain) {
+		enforced := r.BlockRules.Enforced(&block, groups, now)
+		e.Matches = append(e.Matches, Match{
+			Source:   block.Source,
+			Category: block.Category,
+			Reason:   block.Reason,
+			RuleType: blocklist.RuleTypeExact,
+			Rules:    r.BlockRules.Selecting(&block),
+			Enforced: enforced,
+		})
+		if enforced {
+			e.Blocked = true
+		}
+	}
+	if e.Allowed || e.Paused {
+		e.Blocked = false
+	}
+
+	return e
+}
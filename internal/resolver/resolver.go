@@ -2,84 +2,364 @@ package resolver
 
 import (
 	"net"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/bwoff11/go-resolve/internal/blocklist"
 	"github.com/bwoff11/go-resolve/internal/cache"
+	"github.com/bwoff11/go-resolve/internal/client"
 	"github.com/bwoff11/go-resolve/internal/config"
+	"github.com/bwoff11/go-resolve/internal/dnssec"
+	"github.com/bwoff11/go-resolve/internal/ecs"
 	"github.com/bwoff11/go-resolve/internal/local"
 	"github.com/bwoff11/go-resolve/internal/metrics"
+	"github.com/bwoff11/go-resolve/internal/pause"
+	"github.com/bwoff11/go-resolve/internal/safesearch"
+	"github.com/bwoff11/go-resolve/internal/secondary"
 	"github.com/bwoff11/go-resolve/internal/transport"
+	"github.com/bwoff11/go-resolve/internal/tsig"
 	"github.com/bwoff11/go-resolve/internal/upstream"
 	"github.com/miekg/dns"
 	"github.com/rs/zerolog/log"
 )
 
+// safeSearchTTL is the TTL of synthesized safe search CNAME records.
+const safeSearchTTL = 3600
+
 type Resolver struct {
-	BlockList *blocklist.BlockList
-	Cache     *cache.Cache
-	Local     *local.LocalRecords
-	Upstream  *upstream.Upstream
-	Queue     chan transport.QueueItem
+	BlockList    *blocklist.BlockList
+	BlockRules   *blocklist.Rules
+	BlockStats   *blocklist.Stats
+	Cache        *cache.Cache
+	ClientGroups *client.Groups
+	CNAMEDepth   int // Maximum CNAME hops followed per query.
+	DNSSEC       *dnssec.Validator
+	ECS          *ecs.Policy
+	Local        *local.LocalRecords
+	Pause        *pause.State
+	Secondary    *secondary.Secondaries
+	TSIG         *tsig.Keys
+	Transfer     config.Transfer
+	Update       config.Update
+	Upstream     *upstream.Groups
+	Views        *local.Views
+	Queue        chan transport.QueueItem
+	workers      int
+	inflight     *sync.WaitGroup // Queries answered by the current components.
+	mutex        sync.RWMutex
 }
 
-// New creates a new Resolver instance.
-func New(cfg *config.Config, q chan transport.QueueItem) *Resolver {
+// New creates a new Resolver instance. The pause state is owned by the
+// caller so that it outlives configuration reloads.
+func New(cfg *config.Config, q chan transport.QueueItem, state *pause.State) *Resolver {
+	lr := local.New(&cfg.Local)
+	keys := tsig.New(cfg.TSIGKeys)
+	secondaries := secondary.New(cfg.Secondaries, keys, lr)
+	secondaries.Start()
+	c := cache.New()
+	us := upstream.NewGroups(cfg.Upstream, &cfg.Forwarding, c)
+
 	return &Resolver{
-		Upstream:  upstream.New(cfg.Upstream),
-		Local:     local.New(&cfg.Local),
-		Cache:     cache.New(),
-		BlockList: blocklist.New(cfg.BlockLists),
-		Queue:     q,
+		Upstream:     us,
+		Local:        lr,
+		Cache:        c,
+		BlockList:    blocklist.New(cfg.BlockLists),
+		BlockRules:   blocklist.NewRules(&cfg.Blocking),
+		BlockStats:   blocklist.NewStats(),
+		ClientGroups: client.New(cfg.ClientGroups),
+		CNAMEDepth:   cnameDepth(&cfg.Resolver),
+		DNSSEC:       dnssec.New(dnssecConfig(cfg), us.Exchange),
+		ECS:          ecs.New(&cfg.ECS),
+		Pause:        state,
+		Secondary:    secondaries,
+		TSIG:         keys,
+		Transfer:     cfg.Transfer,
+		Update:       cfg.Update,
+		Views:        local.NewViews(cfg.Local.Views, lr),
+		Queue:        q,
+		workers:      workers(&cfg.Resolver),
+		inflight:     new(sync.WaitGroup),
 	}
 }
 
-func (r *Resolver) Start() {
+// Reload rebuilds the configuration-derived components from cfg.
+// The cache, block statistics and pause state are kept, dynamic
+// updates are replayed onto the new local records and secondary
+// zones keep serving their last transfer.
+func (r *Resolver) Reload(cfg *config.Config) {
+	us := upstream.NewGroups(cfg.Upstream, &cfg.Forwarding, r.Cache)
+	lr := local.New(&cfg.Local)
+	bl := blocklist.New(cfg.BlockLists)
+	rules := blocklist.NewRules(&cfg.Blocking)
+	groups := client.New(cfg.ClientGroups)
+	keys := tsig.New(cfg.TSIGKeys)
+	secondaries := secondary.New(cfg.Secondaries, keys, lr)
+	views := local.NewViews(cfg.Local.Views, lr)
+	validator := dnssec.New(dnssecConfig(cfg), us.Exchange)
+
+	// Reload is the only writer, so the secondaries can be read unlocked.
+	previousSecondaries := r.Secondary
+	secondaries.Keep(previousSecondaries)
+
+	r.mutex.Lock()
+	previous, previousViews := r.Local, r.Views
+	previousUpstream, previousInflight := r.Upstream, r.inflight
+	previousSecondaries.Stop()
+	lr.Replay(previous.Journal())
+	r.Upstream = us
+	r.Local = lr
+	r.BlockList = bl
+	r.BlockRules = rules
+	r.ClientGroups = groups
+	r.CNAMEDepth = cnameDepth(&cfg.Resolver)
+	r.DNSSEC = validator
+	r.ECS = ecs.New(&cfg.ECS)
+	r.Secondary = secondaries
+	r.TSIG = keys
+	r.Transfer = cfg.Transfer
+	r.Update = cfg.Update
+	r.Views = views
+	r.inflight = new(sync.WaitGroup)
+	r.mutex.Unlock()
+	secondaries.Start()
+
+	// Queries still running on the previous components keep using them.
 	go func() {
-		for item := range r.Queue {
-			req := item.Message()
-			resp, err := r.Resolve(req)
-			if err != nil {
-				log.Error().Err(err).Msg("Failed to resolve query")
-				continue
+		previousInflight.Wait()
+		previousViews.Close()
+		previousUpstream.Close()
+	}()
+
+	log.Info().Msg("resolver configuration reloaded")
+}
+
+// Start answers queued messages with a pool of workers, so that a query
+// waiting on slow upstream servers does not hold up the others.
+func (r *Resolver) Start() {
+	for i := 0; i < r.workers; i++ {
+		go func() {
+			for item := range r.Queue {
+				r.handle(&item)
 			}
-			item.Respond(resp)
+		}()
+	}
+	log.Info().Int("workers", r.workers).Msg("Resolver started and listening on the inbound queue")
+}
+
+// handle answers a queued message according to its opcode.
+func (r *Resolver) handle(item *transport.QueueItem) {
+	req := item.Message()
+
+	switch req.Opcode {
+	case dns.OpcodeQuery:
+		if qtype := req.Question[0].Qtype; qtype == dns.TypeAXFR || qtype == dns.TypeIXFR {
+			r.handleTransfer(item)
+			return
 		}
-	}()
-	log.Info().Msg("Resolver started and listening on the inbound queue")
+		resp, err := r.Resolve(req, item.Source())
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to resolve query")
+			return
+		}
+		item.Respond(resp)
+	case dns.OpcodeUpdate:
+		r.handleUpdate(item)
+	case dns.OpcodeNotify:
+		r.handleNotify(item)
+	default:
+		resp := new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeNotImplemented)
+		item.Respond(resp)
+	}
 }
 
-// Resolve processes the DNS query and returns a response.
-func (r *Resolver) Resolve(req *dns.Msg) (*dns.Msg, error) {
+// snapshot returns a copy of the resolver's components, so that a query
+// waiting on upstream servers does not hold off a reload. The caller must
+// release the snapshot once done with it.
+func (r *Resolver) snapshot() *Resolver {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	r.inflight.Add(1)
+	return &Resolver{
+		BlockList:    r.BlockList,
+		BlockRules:   r.BlockRules,
+		BlockStats:   r.BlockStats,
+		Cache:        r.Cache,
+		ClientGroups: r.ClientGroups,
+		CNAMEDepth:   r.CNAMEDepth,
+		DNSSEC:       r.DNSSEC,
+		ECS:          r.ECS,
+		Local:        r.Local,
+		Pause:        r.Pause,
+		Secondary:    r.Secondary,
+		TSIG:         r.TSIG,
+		Transfer:     r.Transfer,
+		Update:       r.Update,
+		Upstream:     r.Upstream,
+		Views:        r.Views,
+		Queue:        r.Queue,
+		workers:      r.workers,
+		inflight:     r.inflight,
+	}
+}
+
+// release marks a snapshot as no longer in use.
+func (r *Resolver) release() {
+	r.inflight.Done()
+}
+
+// Resolve processes the DNS query from the client at src and returns a response.
+func (r *Resolver) Resolve(req *dns.Msg, src client.Source) (*dns.Msg, error) {
+	s := r.snapshot()
+	defer s.release()
+	return s.resolve(req, src)
+}
+
+// resolve answers the query using the resolver's components as they are.
+func (r *Resolver) resolve(req *dns.Msg, src client.Source) (*dns.Msg, error) {
 	log.Debug().Str("domain", req.Question[0].Name).Msg("resolving domain")
 	startTime := time.Now()
 
 	q := &req.Question[0] // Only support one question
 	qName := req.Question[0].Name
+	clientIP := client.IP(src.Addr)
+	groups := r.ClientGroups.Match(clientIP)
 
-	// Check block list
-	if block := r.BlockList.Query(qName); block != nil {
+	// Check block list, whose entries are stored normalized
+	domain := blocklist.Normalize(qName)
+	if block := r.enforcedBlock(domain, groups, startTime); block != nil {
+		r.recordBlock(domain, block)
 		return r.blockedResponse(req, startTime), nil
 	}
 
-	// Check local records
-	if records := r.Local.Query(q); len(records) > 0 {
-		return r.createResponse(req, records, true, startTime), nil
+	// Check safe search enforcement
+	if r.ClientGroups.SafeSearch(groups) {
+		if target, ok := safesearch.Target(qName); ok {
+			return r.safeSearchResponse(req, target, src, startTime), nil
+		}
+	}
+
+	// Check local records and zones
+	if resp := r.Views.Lookup(q, src); resp != nil {
+		return r.localResponse(req, resp, src, startTime), nil
 	}
 
 	// Check cache
-	if records := r.Cache.Query(q); len(records) > 0 {
-		return r.createResponse(req, records, true, startTime), nil
+	subnet := r.ECS.Subnet(req, clientIP)
+	if records, secure := r.Cache.Lookup(q, subnet); len(records) > 0 {
+		return r.dnssecResponse(req, r.chasedResponse(req, records, src, startTime), records, secure), nil
 	}
 
 	// Check upstream
-	if records := r.Upstream.Query(req); len(records) > 0 {
-		r.Cache.Add(q, records)
-		return r.createResponse(req, records, false, startTime), nil
+	resp, scope, result := r.forward(req, subnet)
+	if resp == nil {
+		log.Warn().Str("domain", qName).Msg("no valid response from upstream")
+		return r.failureResponse(req, dns.ExtendedErrorCodeNoReachableAuthority, "no valid response from upstream servers", startTime), nil
+	}
+	if result.Security == dnssec.Bogus {
+		return r.failureResponse(req, result.EDE, result.Reason, startTime), nil
+	}
+	if records := answer(resp); len(records) > 0 {
+		r.cacheAnswer(req, records, scope, result)
+		return r.dnssecResponse(req, r.chasedResponse(req, records, src, startTime), records, result.Security == dnssec.Secure), nil
+	}
+
+	// Pass on denials with the authority section proving them
+	log.Info().Str("domain", qName).Str("rcode", dns.RcodeToString[resp.Rcode]).Msg("domain not found in local, cache, or upstream")
+	msg := r.createResponse(req, resp.Answer, false, startTime)
+	msg.Rcode = resp.Rcode
+	msg.Ns = resp.Ns
+	return r.dnssecResponse(req, msg, resp.Answer, result.Security == dnssec.Secure), nil
+}
+
+// lookup answers a question for the client at src from local records, the
+// cache or upstream, in that order. It is used to complete answers the resolver
+// synthesizes itself and to follow CNAME chains. Names within authoritative
+// local zones are never forwarded.
+func (r *Resolver) lookup(q *dns.Question, src client.Source) []dns.RR {
+	if resp := r.Views.Lookup(q, src); resp != nil {
+		return resp.Answer
 	}
 
-	log.Info().Str("domain", qName).Msg("domain not found in local, cache, or upstream")
-	return r.createResponse(req, []dns.RR{}, false, startTime), nil // Need to verify this is correct for NXDOMAIN
+	req := new(dns.Msg)
+	req.SetQuestion(q.Name, q.Qtype)
+	subnet := r.ECS.Subnet(req, client.IP(src.Addr))
+	if records := r.Cache.Query(q, subnet); len(records) > 0 {
+		return records
+	}
+	resp, scope, result := r.forward(req, subnet)
+	if records := answer(resp); len(records) > 0 && result.Security != dnssec.Bogus {
+		r.cacheAnswer(req, records, scope, result)
+		return records
+	}
+	return nil
+}
+
+// forward sends a copy of req upstream with its client subnet option set to
+// subnet, returning the response, the client subnet it is scoped to and its
+// DNSSEC validation result. The response is nil if no upstream server gave
+// a valid one. Responses are validated unless the client set CD.
+func (r *Resolver) forward(req *dns.Msg, subnet *net.IPNet) (*dns.Msg, *net.IPNet, dnssec.Result) {
+	msg := req.Copy()
+	ecs.Set(msg, subnet)
+	if r.DNSSEC.Enabled() {
+		dnssec.SetDO(msg)
+	}
+
+	resp := r.Upstream.Exchange(msg)
+	if resp == nil {
+		return nil, nil, dnssec.Result{}
+	}
+	var result dnssec.Result
+	if r.DNSSEC.Enabled() && !req.CheckingDisabled {
+		result = r.DNSSEC.Validate(resp)
+	}
+	return resp, ecs.Scope(resp, subnet), result
+}
+
+// answer returns the answer section of a successful response.
+func answer(resp *dns.Msg) []dns.RR {
+	if resp == nil || resp.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+	return resp.Answer
+}
+
+// cacheAnswer caches a forwarded answer. Answers that were not validated
+// because the client set CD are not cached while validation is enabled.
+func (r *Resolver) cacheAnswer(req *dns.Msg, records []dns.RR, scope *net.IPNet, result dnssec.Result) {
+	switch {
+	case result.Security == dnssec.Secure:
+		r.Cache.AddSecure(&req.Question[0], records, scope)
+	case !r.DNSSEC.Enabled() || !req.CheckingDisabled:
+		r.Cache.Add(&req.Question[0], records, scope)
+	}
+}
+
+// enforcedBlock returns the first block list entry for the domain that is enforced
+// for a client in the given groups at time t, taking pauses and temporary
+// allows into account. It returns nil if the domain is not blocked.
+func (r *Resolver) enforcedBlock(domain string, groups []string, t time.Time) *blocklist.Block {
+	if r.Pause.Allowed(domain, t) || r.Pause.Paused(groups, t) {
+		return nil
+	}
+	for _, block := range r.BlockList.QueryAll(domain) {
+		if r.BlockRules.Enforced(&block, groups, t) {
+			return &block
+		}
+	}
+	return nil
+}
+
+// recordBlock updates the block metrics and statistics for a blocked query.
+func (r *Resolver) recordBlock(domain string, block *blocklist.Block) {
+	log.Debug().Str("domain", domain).Str("source", block.Source).Str("category", block.Category).Msg("domain blocked")
+	metrics.BlockedCount.Inc()
+	metrics.BlockedBySource.WithLabelValues(block.Source).Inc()
+	metrics.BlockedByCategory.WithLabelValues(block.Category).Inc()
+	r.BlockStats.Record(domain)
 }
 
 // createResponse builds a DNS response message.
@@ -110,6 +390,67 @@ func (r *Resolver) createResponse(req *dns.Msg, answer []dns.RR, authoritative b
 	return msg
 }
 
+// chasedResponse builds a DNS response from records, following any CNAME chain
+// they start. A chain that loops or is too long is answered with SERVFAIL.
+func (r *Resolver) chasedResponse(req *dns.Msg, records []dns.RR, src client.Source, startTime time.Time) *dns.Msg {
+	answer, err := r.chase(&req.Question[0], records, src)
+	msg := r.createResponse(req, answer, false, startTime)
+	if err != nil {
+		msg.Rcode = dns.RcodeServerFailure
+	}
+	return msg
+}
+
+// dnssecResponse sets the AD bit of msg if records, or the denial in its
+// authority section, were validated as secure and the client set DO or AD,
+// and removes DNSSEC records unless it set DO. Records added by CNAME chasing
+// were validated separately, so only answers complete as received are marked
+// secure.
+func (r *Resolver) dnssecResponse(req, msg *dns.Msg, records []dns.RR, secure bool) *dns.Msg {
+	opt := req.IsEdns0()
+	do := opt != nil && opt.Do()
+	answered := msg.Rcode == dns.RcodeSuccess || msg.Rcode == dns.RcodeNameError
+
+	msg.AuthenticatedData = secure && (do || req.AuthenticatedData) && answered && len(msg.Answer) == len(records)
+	msg.CheckingDisabled = req.CheckingDisabled
+	if do {
+		msg.SetEdns0(dns.DefaultMsgSize, true)
+	} else {
+		msg.Answer = dnssec.Strip(msg.Answer, req.Question[0].Qtype)
+		msg.Ns = dnssec.Strip(msg.Ns, dns.TypeNone)
+	}
+	return msg
+}
+
+// failureResponse builds a SERVFAIL response to a query that could not be
+// answered, such as one whose answer failed DNSSEC validation, explaining
+// why with an extended DNS error (RFC 8914) for clients using EDNS.
+func (r *Resolver) failureResponse(req *dns.Msg, code uint16, reason string, startTime time.Time) *dns.Msg {
+	msg := r.createResponse(req, []dns.RR{}, false, startTime)
+	msg.Rcode = dns.RcodeServerFailure
+	if opt := req.IsEdns0(); opt != nil {
+		msg.SetEdns0(dns.DefaultMsgSize, opt.Do())
+		ede := &dns.EDNS0_EDE{InfoCode: code, ExtraText: reason}
+		msg.IsEdns0().Option = append(msg.IsEdns0().Option, ede)
+	}
+	return msg
+}
+
+// localResponse builds a DNS response from a local answer, following any CNAME
+// chain it starts. Only answers from authoritative local zones set the AA bit.
+func (r *Resolver) localResponse(req *dns.Msg, resp *local.Response, src client.Source, startTime time.Time) *dns.Msg {
+	answer, err := r.chase(&req.Question[0], resp.Answer, src)
+	msg := r.createResponse(req, answer, resp.Authoritative, startTime)
+	msg.Rcode = resp.Rcode
+	if err != nil {
+		msg.Rcode = dns.RcodeServerFailure
+	}
+	if len(resp.Ns) > 0 {
+		msg.Ns = resp.Ns
+	}
+	return msg
+}
+
 func (r *Resolver) blockedResponse(req *dns.Msg, startTime time.Time) *dns.Msg {
 	var answer []dns.RR
 	switch req.Question[0].Qtype {
@@ -147,5 +488,49 @@ func (r *Resolver) blockedResponse(req *dns.Msg, startTime time.Time) *dns.Msg {
 		answer = []dns.RR{}
 	}
 
-	return r.createResponse(req, answer, true, startTime)
+	return r.createResponse(req, answer, false, startTime)
+}
+
+// safeSearchResponse answers with a CNAME from the queried search engine to its
+// enforced-safe endpoint, followed by the endpoint's own records.
+func (r *Resolver) safeSearchResponse(req *dns.Msg, target string, src client.Source, startTime time.Time) *dns.Msg {
+	q := req.Question[0]
+	records := []dns.RR{&dns.CNAME{
+		Hdr: dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: dns.TypeCNAME,
+			Class:  dns.ClassINET,
+			Ttl:    safeSearchTTL,
+		},
+		Target: target,
+	}}
+
+	log.Debug().Str("domain", q.Name).Str("target", target).Msg("safe search enforced")
+	return r.chasedResponse(req, records, src, startTime)
+}
+
+// workers returns the configured number of workers, or the default.
+func workers(cfg *config.Resolver) int {
+	if cfg.Workers <= 0 {
+		return config.DefaultWorkers
+	}
+	return cfg.Workers
+}
+
+// dnssecConfig returns the DNSSEC configuration with the zones of forwarding
+// routes added to the insecure domains, unless they are to be validated.
+func dnssecConfig(cfg *config.Config) *config.DNSSEC {
+	d := cfg.DNSSEC
+	if !d.ValidateForwarded {
+		d.InsecureDomains = append(slices.Clip(d.InsecureDomains), cfg.Forwarding.Zones()...)
+	}
+	return &d
+}
+
+// cnameDepth returns the configured maximum CNAME depth, or the default.
+func cnameDepth(cfg *config.Resolver) int {
+	if cfg.MaxCNAMEDepth <= 0 {
+		return config.DefaultMaxCNAMEDepth
+	}
+	return cfg.MaxCNAMEDepth
 }
@@ -0,0 +1,453 @@
+package resolver
+
+import (
+	"crypto"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bwoff11/go-resolve/internal/blocklist"
+	"github.com/bwoff11/go-resolve/internal/client"
+	"github.com/bwoff11/go-resolve/internal/config"
+	"github.com/bwoff11/go-resolve/internal/pause"
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog"
+)
+
+func TestMain(m *testing.M) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	os.Exit(m.Run())
+}
+
+// unsignedUpstream starts an upstream server answering every query with an
+// unsigned A record and returns its port.
+func unsignedUpstream(t *testing.T) int {
+	return serveUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.RecursionAvailable = true
+		if req.Question[0].Qtype == dns.TypeA {
+			rr, _ := dns.NewRR(req.Question[0].Name + " 300 IN A 192.0.2.1")
+			resp.Answer = []dns.RR{rr}
+		}
+		w.WriteMsg(resp)
+	})
+}
+
+// serveUpstream starts an upstream server answering with handler and returns its port.
+func serveUpstream(t *testing.T, handler dns.HandlerFunc) int {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: conn, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// signedRoot starts an upstream server for a root zone signed with a single
+// key, holding www. and nothing else, and returns its port and trust anchor.
+func signedRoot(t *testing.T) (int, string) {
+	t.Helper()
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: ".", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(records ...string) []dns.RR {
+		var set []dns.RR
+		for _, s := range records {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				t.Fatalf("invalid record %q: %v", s, err)
+			}
+			set = append(set, rr)
+		}
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Name: set[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: set[0].Header().Ttl},
+			Algorithm:  key.Algorithm,
+			KeyTag:     key.KeyTag(),
+			SignerName: ".",
+			Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+			Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+		}
+		if err := sig.Sign(priv.(crypto.Signer), set); err != nil {
+			t.Fatal(err)
+		}
+		return append(set, sig)
+	}
+
+	keys := append([]dns.RR{key}, sign(key.String())[1:]...)
+	www := sign("www. 300 IN A 192.0.2.3")
+	denial := append(sign(". 300 IN SOA ns.invalid. hostmaster.invalid. 1 3600 600 86400 300"),
+		append(sign(". 300 IN NSEC www. SOA RRSIG NSEC DNSKEY"), sign("www. 300 IN NSEC . A RRSIG NSEC")...)...)
+
+	port := serveUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.RecursionAvailable = true
+		switch q := req.Question[0]; {
+		case q.Name == "." && q.Qtype == dns.TypeDNSKEY:
+			resp.Answer = keys
+		case q.Name == "www." && q.Qtype == dns.TypeA:
+			resp.Answer = www
+		default:
+			resp.Rcode = dns.RcodeNameError
+			resp.Ns = denial
+		}
+		resp.SetEdns0(dns.DefaultMsgSize, true)
+		w.WriteMsg(resp)
+	})
+	return port, key.ToDS(dns.SHA256).String()
+}
+
+func TestCheckingDisabled(t *testing.T) {
+	cfg := &config.Config{
+		DNSSEC: config.DNSSEC{Validate: true},
+		Upstream: config.Upstream{
+			Servers: []config.UpstreamServer{{Name: "unsigned", IP: "127.0.0.1", Port: unsignedUpstream(t)}},
+		},
+	}
+	r := New(cfg, nil, pause.New())
+	t.Cleanup(r.Upstream.Close)
+	src := client.Source{Addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}, Protocol: "udp"}
+
+	query := func(cd bool) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.", dns.TypeA)
+		req.CheckingDisabled = cd
+		resp, err := r.Resolve(req, src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// The root keys cannot be validated, so unsigned answers are bogus.
+	if resp := query(false); resp.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("rcode without CD = %s, want SERVFAIL", dns.RcodeToString[resp.Rcode])
+	}
+
+	resp := query(true)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Fatalf("response with CD = %s %v, want the unvalidated answer", dns.RcodeToString[resp.Rcode], resp.Answer)
+	}
+	if !resp.CheckingDisabled || resp.AuthenticatedData {
+		t.Errorf("response with CD has CD=%v AD=%v, want CD only", resp.CheckingDisabled, resp.AuthenticatedData)
+	}
+
+	// Unvalidated answers are not cached for other clients.
+	if resp := query(false); resp.Rcode != dns.RcodeServerFailure {
+		t.Errorf("rcode without CD after a CD query = %s, want SERVFAIL", dns.RcodeToString[resp.Rcode])
+	}
+}
+
+func TestBlockingIgnoresCase(t *testing.T) {
+	r := New(&config.Config{}, nil, pause.New())
+	t.Cleanup(r.Upstream.Close)
+	r.BlockList = &blocklist.BlockList{{Domain: "www.ads.example.com.", Source: "test"}}
+	src := client.Source{Addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}, Protocol: "udp"}
+
+	req := new(dns.Msg)
+	req.SetQuestion("wWw.ADS.Example.COM.", dns.TypeA)
+	resp, err := r.Resolve(req, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || !resp.Answer[0].(*dns.A).A.Equal(net.IPv4zero) {
+		t.Fatalf("answer = %v, want the blocked address", resp.Answer)
+	}
+	if top := r.BlockStats.Top(1); len(top) != 1 || top[0].Domain != "www.ads.example.com." {
+		t.Errorf("top blocked domains = %v, want www.ads.example.com.", top)
+	}
+}
+
+func TestReloadDuringQuery(t *testing.T) {
+	received, answer := make(chan struct{}, 1), make(chan struct{})
+	port := unsignedUpstream(t)
+	slow := serveUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		received <- struct{}{}
+		<-answer
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 300 IN A 192.0.2.2")
+		resp.Answer = []dns.RR{rr}
+		w.WriteMsg(resp)
+	})
+	cfg := &config.Config{
+		Upstream: config.Upstream{
+			Servers: []config.UpstreamServer{{Name: "slow", IP: "127.0.0.1", Port: slow}},
+		},
+	}
+	r := New(cfg, nil, pause.New())
+	src := client.Source{Addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}, Protocol: "udp"}
+
+	done := make(chan *dns.Msg)
+	go func() {
+		req := new(dns.Msg)
+		req.SetQuestion("slow.example.", dns.TypeA)
+		resp, _ := r.Resolve(req, src)
+		done <- resp
+	}()
+	<-received
+
+	// The reload completes while the query is still waiting on the upstream.
+	reloaded := make(chan struct{})
+	go func() {
+		r.Reload(&config.Config{
+			Upstream: config.Upstream{
+				Servers: []config.UpstreamServer{{Name: "fast", IP: "127.0.0.1", Port: port}},
+			},
+		})
+		close(reloaded)
+	}()
+	select {
+	case <-reloaded:
+	case <-time.After(time.Second):
+		close(answer)
+		t.Fatal("reload waited for the query in flight")
+	}
+	t.Cleanup(r.Upstream.Close)
+
+	// The query in flight is answered by the upstream it was sent to.
+	close(answer)
+	resp := <-done
+	if resp == nil || len(resp.Answer) != 1 || !resp.Answer[0].(*dns.A).A.Equal(net.IPv4(192, 0, 2, 2)) {
+		t.Fatalf("response in flight = %v, want the previous upstream's answer", resp)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("fast.example.", dns.TypeA)
+	resp, err := r.Resolve(req, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || !resp.Answer[0].(*dns.A).A.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("response after reload = %v, want the new upstream's answer", resp.Answer)
+	}
+}
+
+func TestNoUpstreamResponse(t *testing.T) {
+	r := New(&config.Config{}, nil, pause.New())
+	t.Cleanup(r.Upstream.Close)
+	src := client.Source{Addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}, Protocol: "udp"}
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.", dns.TypeA)
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	resp, err := r.Resolve(req, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("rcode = %s, want SERVFAIL", dns.RcodeToString[resp.Rcode])
+	}
+	opt := resp.IsEdns0()
+	if opt == nil || len(opt.Option) != 1 || opt.Option[0].(*dns.EDNS0_EDE).InfoCode != dns.ExtendedErrorCodeNoReachableAuthority {
+		t.Errorf("response options = %v, want a no reachable authority extended error", opt)
+	}
+}
+
+func TestValidatedDenial(t *testing.T) {
+	port, anchor := signedRoot(t)
+	cfg := &config.Config{
+		DNSSEC: config.DNSSEC{Validate: true, TrustAnchors: []string{anchor}},
+		Upstream: config.Upstream{
+			Servers: []config.UpstreamServer{{Name: "signed", IP: "127.0.0.1", Port: port}},
+		},
+	}
+	r := New(cfg, nil, pause.New())
+	t.Cleanup(r.Upstream.Close)
+	src := client.Source{Addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}, Protocol: "udp"}
+
+	query := func(do bool) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("nope.", dns.TypeA)
+		req.SetEdns0(dns.DefaultMsgSize, do)
+		resp, err := r.Resolve(req, src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Rcode != dns.RcodeNameError {
+			t.Fatalf("rcode = %s, want NXDOMAIN", dns.RcodeToString[resp.Rcode])
+		}
+		return resp
+	}
+
+	resp := query(true)
+	if !resp.AuthenticatedData {
+		t.Error("secure denial without AD")
+	}
+	var soa, nsec bool
+	for _, rr := range resp.Ns {
+		soa = soa || rr.Header().Rrtype == dns.TypeSOA
+		nsec = nsec || rr.Header().Rrtype == dns.TypeNSEC
+	}
+	if !soa || !nsec {
+		t.Errorf("authority = %v, want the SOA and NSEC proof", resp.Ns)
+	}
+
+	resp = query(false)
+	if resp.AuthenticatedData {
+		t.Error("denial has AD without DO or AD in the query")
+	}
+	if len(resp.Ns) != 1 || resp.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("authority without DO = %v, want the SOA only", resp.Ns)
+	}
+}
+
+func TestValidationOfForwardedZones(t *testing.T) {
+	port, anchor := signedRoot(t)
+	cfg := &config.Config{
+		DNSSEC: config.DNSSEC{Validate: true, TrustAnchors: []string{anchor}},
+		Upstream: config.Upstream{
+			Servers: []config.UpstreamServer{{Name: "signed", IP: "127.0.0.1", Port: port}},
+		},
+		Forwarding: config.Forwarding{
+			Groups: []config.UpstreamGroup{{Name: "corp", Upstream: config.Upstream{
+				Servers: []config.UpstreamServer{{Name: "unsigned", IP: "127.0.0.1", Port: unsignedUpstream(t)}},
+			}}},
+			Routes: []config.Route{{Domains: []string{"corp.internal"}, Group: "corp"}},
+		},
+	}
+	src := client.Source{Addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}, Protocol: "udp"}
+	query := func(r *Resolver, name string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		req.SetEdns0(dns.DefaultMsgSize, true)
+		resp, err := r.Resolve(req, src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	r := New(cfg, nil, pause.New())
+	t.Cleanup(r.Upstream.Close)
+
+	// Forwarded zones are insecure, other names are still validated.
+	resp := query(r, "www.corp.internal.")
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 || resp.AuthenticatedData {
+		t.Errorf("forwarded answer = %s %v AD=%v, want an insecure answer", dns.RcodeToString[resp.Rcode], resp.Answer, resp.AuthenticatedData)
+	}
+	if resp := query(r, "www."); !resp.AuthenticatedData {
+		t.Errorf("answer outside forwarded zones = %s %v, want a secure answer", dns.RcodeToString[resp.Rcode], resp.Answer)
+	}
+
+	// Forwarded zones can be validated like any other, failing unsigned ones.
+	cfg.DNSSEC.ValidateForwarded = true
+	r = New(cfg, nil, pause.New())
+	t.Cleanup(r.Upstream.Close)
+	if resp := query(r, "www.corp.internal."); resp.Rcode != dns.RcodeServerFailure {
+		t.Errorf("validated forwarded answer rcode = %s, want SERVFAIL", dns.RcodeToString[resp.Rcode])
+	}
+
+	// Negative trust anchors can be configured for any domain.
+	cfg.DNSSEC.InsecureDomains = []string{"internal."}
+	r = New(cfg, nil, pause.New())
+	t.Cleanup(r.Upstream.Close)
+	if resp := query(r, "www.corp.internal."); resp.Rcode != dns.RcodeSuccess || resp.AuthenticatedData {
+		t.Errorf("answer below a negative trust anchor = %s AD=%v, want an insecure answer", dns.RcodeToString[resp.Rcode], resp.AuthenticatedData)
+	}
+}
+
+func TestForwardedReverseZone(t *testing.T) {
+	route := config.Route{Reverse: []string{"10.1.0.0/16"}, Group: "lab"}
+	zones, err := route.Zones()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		Local: config.Local{Reverse: config.Reverse{PrivateZones: true, Forwarded: zones}},
+		Forwarding: config.Forwarding{
+			Groups: []config.UpstreamGroup{{Name: "lab", Upstream: config.Upstream{
+				Servers: []config.UpstreamServer{{Name: "lab", IP: "127.0.0.1", Port: unsignedUpstream(t)}},
+			}}},
+			Routes: []config.Route{route},
+		},
+	}
+	r := New(cfg, nil, pause.New())
+	t.Cleanup(r.Upstream.Close)
+	src := client.Source{Addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}, Protocol: "udp"}
+
+	query := func(name string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypePTR)
+		resp, err := r.Resolve(req, src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// The forwarded network is answered upstream, the rest of 10/8 locally.
+	if resp := query("1.1.1.10.in-addr.arpa."); resp.Rcode != dns.RcodeSuccess || resp.Authoritative {
+		t.Errorf("forwarded name = %s AA=%v, want the upstream answer", dns.RcodeToString[resp.Rcode], resp.Authoritative)
+	}
+	if resp := query("1.1.2.10.in-addr.arpa."); resp.Rcode != dns.RcodeNameError || !resp.Authoritative {
+		t.Errorf("private name = %s AA=%v, want an authoritative NXDOMAIN", dns.RcodeToString[resp.Rcode], resp.Authoritative)
+	}
+}
+
+func TestViewInterfaces(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loopback string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			loopback = iface.Name
+		}
+	}
+	if loopback == "" {
+		t.Skip("no loopback interface")
+	}
+
+	cfg := &config.Config{Local: config.Local{
+		A: []config.AddressRecord{{Domain: "git.corp.internal", IP: "192.0.2.10", TTL: 300}},
+		Views: []config.View{{
+			Name:       "local",
+			CIDRs:      []string{"0.0.0.0/0"},
+			Interfaces: []string{loopback},
+			Records:    config.Local{A: []config.AddressRecord{{Domain: "git.corp.internal", IP: "127.0.0.10", TTL: 300}}},
+		}},
+	}}
+	r := New(cfg, nil, pause.New())
+	t.Cleanup(r.Upstream.Close)
+
+	query := func(local net.IP) string {
+		req := new(dns.Msg)
+		req.SetQuestion("git.corp.internal.", dns.TypeA)
+		src := client.Source{
+			Addr:     &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353},
+			Protocol: "udp",
+			Local:    &net.UDPAddr{IP: local, Port: 53},
+		}
+		resp, err := r.Resolve(req, src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answer) != 1 {
+			t.Fatalf("answer = %v, want one address", resp.Answer)
+		}
+		return resp.Answer[0].(*dns.A).A.String()
+	}
+
+	if got := query(net.IPv4(127, 0, 0, 1)); got != "127.0.0.10" {
+		t.Errorf("query sent to the loopback interface answered %s, want the view's 127.0.0.10", got)
+	}
+	if got := query(net.IPv4(198, 51, 100, 1)); got != "192.0.2.10" {
+		t.Errorf("query sent to another address answered %s, want the default 192.0.2.10", got)
+	}
+}
@@ -0,0 +1,203 @@
+package resolver
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/bwoff11/go-resolve/internal/client"
+	"github.com/bwoff11/go-resolve/internal/transport"
+	"github.com/bwoff11/go-resolve/internal/tsig"
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// transferChunk is the number of records sent per message of a zone transfer.
+const transferChunk = 100
+
+// handleTransfer answers an AXFR or IXFR query for an authoritative local
+// zone. Transfers need a stream transport, except for IXFR over UDP which is
+// answered with the current SOA only, prompting the client to retry over TCP.
+func (r *Resolver) handleTransfer(item *transport.QueueItem) {
+	s := r.snapshot()
+	defer s.release()
+	s.transfer(item)
+}
+
+// transfer streams the zone transfer, which may take as long as the client
+// does to read it.
+func (r *Resolver) transfer(item *transport.QueueItem) {
+	req := item.Message()
+	q := req.Question[0]
+	zone := dns.CanonicalName(q.Name)
+	resp := new(dns.Msg)
+
+	key, err := r.TSIG.Verify(req, item.Raw)
+	if err != nil && !errors.Is(err, tsig.ErrUnsigned) {
+		log.Warn().Err(err).Str("zone", zone).Str("key", key).Str("client", item.RemoteAddr().String()).Msg("transfer failed tsig verification")
+		item.Respond(resp.SetRcode(req, dns.RcodeNotAuth))
+		return
+	}
+	if !r.transferAllowed(client.IP(item.RemoteAddr()), key) {
+		log.Warn().Str("zone", zone).Str("client", item.RemoteAddr().String()).Msg("transfer refused")
+		r.respondTransfer(item, key, resp.SetRcode(req, dns.RcodeRefused))
+		return
+	}
+
+	var rrs []dns.RR
+	var ok bool
+	switch {
+	case q.Qtype == dns.TypeAXFR && !item.Stream():
+		r.respondTransfer(item, key, resp.SetRcode(req, dns.RcodeFormatError))
+		return
+	case q.Qtype == dns.TypeAXFR:
+		rrs, ok = r.Local.AXFR(zone)
+	case !item.Stream():
+		var soa *dns.SOA
+		if soa, ok = r.Local.SOA(zone); ok {
+			rrs = []dns.RR{soa}
+		}
+	default:
+		serial, found := ixfrSerial(req)
+		if !found {
+			r.respondTransfer(item, key, resp.SetRcode(req, dns.RcodeFormatError))
+			return
+		}
+		rrs, ok = r.Local.IXFR(zone, serial)
+	}
+	if !ok {
+		r.respondTransfer(item, key, resp.SetRcode(req, dns.RcodeNotAuth))
+		return
+	}
+
+	log.Info().Str("zone", zone).Str("type", dns.TypeToString[q.Qtype]).Str("client", item.RemoteAddr().String()).Int("count", len(rrs)).Msg("serving zone transfer")
+
+	mac := ""
+	if key != "" {
+		mac = req.IsTsig().MAC
+	}
+	for i := 0; i < len(rrs) || i == 0; i += transferChunk {
+		msg := new(dns.Msg)
+		msg.SetReply(req)
+		msg.Authoritative = true
+		msg.Answer = rrs[i:min(i+transferChunk, len(rrs))]
+
+		if key == "" {
+			item.Respond(msg)
+			continue
+		}
+		data, next, err := r.TSIG.Sign(msg, key, mac, i > 0)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to sign transfer response")
+			return
+		}
+		if err := item.RespondRaw(data); err != nil {
+			log.Error().Err(err).Msg("failed to send transfer response")
+			return
+		}
+		mac = next
+	}
+}
+
+// respondTransfer sends a single message response, signed if the request was.
+func (r *Resolver) respondTransfer(item *transport.QueueItem, key string, msg *dns.Msg) {
+	if key == "" {
+		item.Respond(msg)
+		return
+	}
+	data, _, err := r.TSIG.Sign(msg, key, item.Message().IsTsig().MAC, false)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to sign transfer response")
+		return
+	}
+	item.RespondRaw(data)
+}
+
+// transferAllowed reports whether a client at ip, having signed its request
+// with key, may transfer zones. Each configured condition must hold, and at
+// least one must be configured.
+func (r *Resolver) transferAllowed(ip net.IP, key string) bool {
+	if len(r.Transfer.Allow) == 0 && len(r.Transfer.Keys) == 0 {
+		return false
+	}
+	if len(r.Transfer.Allow) > 0 && !containsIP(r.Transfer.Allow, ip) {
+		return false
+	}
+	if len(r.Transfer.Keys) == 0 {
+		return true
+	}
+	for _, k := range r.Transfer.Keys {
+		if dns.CanonicalName(k) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// containsIP reports whether ip is within any of the CIDRs.
+func containsIP(cidrs []string, ip net.IP) bool {
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Error().Err(err).Str("cidr", cidr).Msg("invalid transfer cidr")
+			continue
+		}
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ixfrSerial returns the client's serial from the SOA in the authority section of an IXFR query.
+func ixfrSerial(req *dns.Msg) (uint32, bool) {
+	for _, rr := range req.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, true
+		}
+	}
+	return 0, false
+}
+
+// handleNotify accepts a NOTIFY for a secondary zone from its primary and
+// refreshes the zone.
+func (r *Resolver) handleNotify(item *transport.QueueItem) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	req := item.Message()
+	resp := new(dns.Msg)
+	if len(req.Question) != 1 || req.Question[0].Qtype != dns.TypeSOA {
+		item.Respond(resp.SetRcode(req, dns.RcodeFormatError))
+		return
+	}
+
+	zone := req.Question[0].Name
+	if !r.Secondary.Notify(zone, client.IP(item.RemoteAddr())) {
+		log.Warn().Str("zone", zone).Str("client", item.RemoteAddr().String()).Msg("notify refused")
+		item.Respond(resp.SetRcode(req, dns.RcodeRefused))
+		return
+	}
+
+	resp.SetReply(req)
+	resp.Authoritative = true
+	item.Respond(resp)
+}
+
+// notify sends a NOTIFY for zone to each configured secondary.
+func (r *Resolver) notify(zone string) {
+	for _, addr := range r.Transfer.Notify {
+		go func(addr string) {
+			msg := new(dns.Msg)
+			msg.SetNotify(zone)
+
+			c := &dns.Client{Timeout: 5 * time.Second}
+			resp, _, err := c.Exchange(msg, addr)
+			if err != nil {
+				log.Error().Err(err).Str("zone", zone).Str("secondary", addr).Msg("failed to send notify")
+				return
+			}
+			log.Debug().Str("zone", zone).Str("secondary", addr).Str("rcode", dns.RcodeToString[resp.Rcode]).Msg("notify sent")
+		}(addr)
+	}
+}
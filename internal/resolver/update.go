@@ -0,0 +1,85 @@
+package resolver
+
+import (
+	"errors"
+
+	"github.com/bwoff11/go-resolve/internal/transport"
+	"github.com/bwoff11/go-resolve/internal/tsig"
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// handleUpdate applies an RFC 2136 update message to an authoritative local
+// zone. Updates must be signed with a TSIG key allowed to update the zone,
+// and the response is signed with the same key. Configured secondaries are
+// notified when the zone changes.
+func (r *Resolver) handleUpdate(item *transport.QueueItem) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	req := item.Message()
+	resp := new(dns.Msg)
+
+	if !r.Update.Enabled {
+		item.Respond(resp.SetRcode(req, dns.RcodeRefused))
+		return
+	}
+	if len(req.Question) != 1 || req.Question[0].Qtype != dns.TypeSOA {
+		item.Respond(resp.SetRcode(req, dns.RcodeFormatError))
+		return
+	}
+	zone := dns.CanonicalName(req.Question[0].Name)
+
+	key, err := r.TSIG.Verify(req, item.Raw)
+	switch {
+	case errors.Is(err, tsig.ErrUnsigned):
+		log.Warn().Str("zone", zone).Str("client", item.RemoteAddr().String()).Msg("unsigned update refused")
+		item.Respond(resp.SetRcode(req, dns.RcodeRefused))
+		return
+	case err != nil:
+		log.Warn().Err(err).Str("zone", zone).Str("key", key).Str("client", item.RemoteAddr().String()).Msg("update failed tsig verification")
+		item.Respond(resp.SetRcode(req, dns.RcodeNotAuth))
+		return
+	}
+
+	rcode := dns.RcodeRefused
+	switch {
+	case r.Secondary.Has(zone):
+		log.Warn().Str("zone", zone).Str("key", key).Msg("update refused for secondary zone")
+		rcode = dns.RcodeNotAuth
+	case r.updateAllowed(key, zone):
+		before, _ := r.Local.SOA(zone)
+		rcode = r.Local.Update(zone, req.Answer, req.Ns)
+		if after, _ := r.Local.SOA(zone); rcode == dns.RcodeSuccess && after != before {
+			r.notify(zone)
+		}
+	default:
+		log.Warn().Str("zone", zone).Str("key", key).Msg("update refused for key")
+	}
+	resp.SetRcode(req, rcode)
+
+	data, _, err := r.TSIG.Sign(resp, key, req.IsTsig().MAC, false)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to sign update response")
+		return
+	}
+	item.RespondRaw(data)
+}
+
+// updateAllowed reports whether an update rule lets key update zone.
+func (r *Resolver) updateAllowed(key, zone string) bool {
+	for _, rule := range r.Update.Rules {
+		if dns.CanonicalName(rule.Key) != key {
+			continue
+		}
+		if len(rule.Zones) == 0 {
+			return true
+		}
+		for _, z := range rule.Zones {
+			if dns.CanonicalName(z) == zone {
+				return true
+			}
+		}
+	}
+	return false
+}
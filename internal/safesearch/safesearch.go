@@ -0,0 +1,90 @@
+package safesearch
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Enforced endpoints that serve only filtered results.
+const (
+	GoogleTarget     = "forcesafesearch.google.com."
+	YouTubeTarget    = "restrict.youtube.com."
+	BingTarget       = "strict.bing.com."
+	DuckDuckGoTarget = "safe.duckduckgo.com."
+	PixabayTarget    = "safesearch.pixabay.com."
+	YandexTarget     = "familysearch.yandex.ru."
+)
+
+// rewrites maps exact query names to their enforced endpoint.
+var rewrites = map[string]string{
+	"www.youtube.com.":          YouTubeTarget,
+	"m.youtube.com.":            YouTubeTarget,
+	"youtubei.googleapis.com.":  YouTubeTarget,
+	"youtube.googleapis.com.":   YouTubeTarget,
+	"www.youtube-nocookie.com.": YouTubeTarget,
+
+	"bing.com.":     BingTarget,
+	"www.bing.com.": BingTarget,
+
+	"duckduckgo.com.":       DuckDuckGoTarget,
+	"www.duckduckgo.com.":   DuckDuckGoTarget,
+	"start.duckduckgo.com.": DuckDuckGoTarget,
+
+	"pixabay.com.":     PixabayTarget,
+	"www.pixabay.com.": PixabayTarget,
+}
+
+// brands maps a search engine's second-level label to its endpoint and the
+// country domains it is served under, e.g. google.de. or www.google.co.uk.
+var brands = map[string]brand{
+	"google": {GoogleTarget, suffixes(`
+com ad ae com.af com.ag al am co.ao com.ar as at com.au az ba com.bd be
+bf bg com.bh bi bj com.bn com.bo com.br bs bt co.bw by com.bz ca cat cd
+cf cg ch ci co.ck cl cm cn com.co co.cr com.cu cv com.cy cz de dj dk dm
+com.do dz com.ec ee com.eg es com.et fi com.fj fm fr ga ge gg com.gh
+com.gi gl gm gr com.gt gy com.hk hn hr ht hu co.id ie co.il im co.in iq
+is it je com.jm jo co.jp co.ke com.kh ki kg co.kr com.kw kz la com.lb li
+lk co.ls lt lu lv com.ly co.ma md me mg mk ml com.mm mn com.mt mu mv mw
+com.mx com.my co.mz com.na com.ng com.ni ne nl no com.np nr nu co.nz
+com.om com.pa com.pe com.pg com.ph com.pk pl pn com.pr ps pt com.py
+com.qa ro rs ru rw com.sa com.sb sc se com.sg sh si sk com.sl sn so sm
+sr st com.sv td tg co.th com.tj tl tm tn to com.tr tt com.tw co.tz
+com.ua co.ug co.uk com.uy co.uz com.vc co.ve co.vi com.vn vu ws co.za
+co.zm co.zw`)},
+	"yandex": {YandexTarget, suffixes(`
+ru com com.tr by kz ua uz az com.am com.ge co.il ee lt lv md tj tm fr eu`)},
+}
+
+type brand struct {
+	target   string
+	suffixes map[string]bool
+}
+
+func suffixes(list string) map[string]bool {
+	set := make(map[string]bool)
+	for _, suffix := range strings.Fields(list) {
+		set[suffix] = true
+	}
+	return set
+}
+
+// Target returns the enforced-safe endpoint for a query name, if there is one.
+func Target(name string) (string, bool) {
+	name = strings.ToLower(dns.Fqdn(name))
+
+	if target, ok := rewrites[name]; ok {
+		return target, true
+	}
+
+	labels := dns.SplitDomainName(strings.TrimPrefix(name, "www."))
+	// brand.tld or brand.sld.tld, e.g. google.com or google.co.uk.
+	if len(labels) < 2 || len(labels) > 3 {
+		return "", false
+	}
+	b, ok := brands[labels[0]]
+	if !ok || !b.suffixes[strings.Join(labels[1:], ".")] {
+		return "", false
+	}
+	return b.target, true
+}
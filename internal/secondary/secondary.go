@@ -0,0 +1,257 @@
+package secondary
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bwoff11/go-resolve/internal/config"
+	"github.com/bwoff11/go-resolve/internal/local"
+	"github.com/bwoff11/go-resolve/internal/tsig"
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+var errNoSOA = errors.New("primary returned no SOA for zone")
+
+// initialRetry is the retry interval used before a zone's SOA is known.
+const initialRetry = 30 * time.Second
+
+// Secondaries pulls zones from primary servers with AXFR and serves them as
+// local records, refreshing them on the SOA refresh and retry timers or when
+// the primary sends a NOTIFY. A zone that cannot be refreshed before its
+// SOA expire time is no longer served.
+type Secondaries struct {
+	local *local.LocalRecords
+	keys  *tsig.Keys
+	zones map[string]*zone
+	done  chan struct{}
+	once  sync.Once
+}
+
+type zone struct {
+	cfg     config.Secondary
+	apex    string
+	mutex   sync.Mutex
+	records []dns.RR  // Last transferred zone, SOA first.
+	updated time.Time // Time of the last successful refresh.
+	notify  chan struct{}
+}
+
+func New(cfg []config.Secondary, keys *tsig.Keys, lr *local.LocalRecords) *Secondaries {
+	s := &Secondaries{
+		local: lr,
+		keys:  keys,
+		zones: make(map[string]*zone),
+		done:  make(chan struct{}),
+	}
+	for _, c := range cfg {
+		apex := dns.CanonicalName(c.Zone)
+		s.zones[apex] = &zone{cfg: c, apex: apex, notify: make(chan struct{}, 1)}
+	}
+	return s
+}
+
+// Keep serves any zone data kept from previous, such as the Secondaries
+// this one replaces after a configuration reload.
+func (s *Secondaries) Keep(previous *Secondaries) {
+	for apex, z := range s.zones {
+		old, ok := previous.zones[apex]
+		if !ok || old.cfg.Primary != z.cfg.Primary {
+			continue
+		}
+		old.mutex.Lock()
+		records, updated := old.records, old.updated
+		old.mutex.Unlock()
+
+		z.mutex.Lock()
+		z.records, z.updated = records, updated
+		z.mutex.Unlock()
+		if records != nil {
+			s.local.SetZone(apex, records)
+		}
+	}
+}
+
+// Start begins refreshing every zone.
+func (s *Secondaries) Start() {
+	for _, z := range s.zones {
+		go s.run(z)
+	}
+}
+
+// Stop ends refreshing. Zone data already served is left in place.
+func (s *Secondaries) Stop() {
+	s.once.Do(func() { close(s.done) })
+}
+
+// Has reports whether apex is a secondary zone.
+func (s *Secondaries) Has(apex string) bool {
+	_, ok := s.zones[dns.CanonicalName(apex)]
+	return ok
+}
+
+// Notify triggers a refresh of a zone if the NOTIFY came from its primary.
+func (s *Secondaries) Notify(apex string, from net.IP) bool {
+	z, ok := s.zones[dns.CanonicalName(apex)]
+	if !ok || !z.fromPrimary(from) {
+		return false
+	}
+	select {
+	case z.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (s *Secondaries) run(z *zone) {
+	for {
+		wait := s.refresh(z)
+		select {
+		case <-time.After(wait):
+		case <-z.notify:
+			log.Info().Str("zone", z.apex).Msg("notify received, refreshing secondary zone")
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// refresh transfers the zone if the primary's serial is newer and returns
+// the time to wait until the next refresh. The zone is only locked while
+// its records are read or replaced, not while the primary is queried.
+func (s *Secondaries) refresh(z *zone) time.Duration {
+	z.mutex.Lock()
+	var current *dns.SOA
+	if len(z.records) > 0 {
+		current = z.records[0].(*dns.SOA)
+	}
+	updated := z.updated
+	z.mutex.Unlock()
+
+	serial, err := s.primarySerial(z)
+	if err == nil && current != nil && !serialGreater(serial, current.Serial) {
+		z.mutex.Lock()
+		z.updated = time.Now()
+		z.mutex.Unlock()
+		return secondsOf(current.Refresh)
+	}
+
+	var records []dns.RR
+	if err == nil {
+		records, err = s.transfer(z)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("zone", z.apex).Str("primary", z.cfg.Primary).Msg("failed to refresh secondary zone")
+		if current == nil {
+			return initialRetry
+		}
+		if time.Since(updated) > secondsOf(current.Expire) {
+			log.Warn().Str("zone", z.apex).Msg("secondary zone expired")
+			s.local.RemoveZone(z.apex)
+		}
+		return secondsOf(current.Retry)
+	}
+
+	z.mutex.Lock()
+	z.records, z.updated = records, time.Now()
+	z.mutex.Unlock()
+	s.local.SetZone(z.apex, records)
+	soa := records[0].(*dns.SOA)
+	log.Info().Str("zone", z.apex).Uint32("serial", soa.Serial).Int("count", len(records)).Msg("secondary zone transferred")
+	return secondsOf(soa.Refresh)
+}
+
+// primarySerial queries the primary for the zone's SOA serial.
+func (s *Secondaries) primarySerial(z *zone) (uint32, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(z.apex, dns.TypeSOA)
+
+	client := &dns.Client{Net: "tcp", Timeout: 10 * time.Second}
+	s.sign(z, msg, func(name, secret string) { client.TsigSecret = map[string]string{name: secret} })
+
+	resp, _, err := client.Exchange(msg, z.cfg.Primary)
+	if err != nil {
+		return 0, err
+	}
+	for _, rr := range resp.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, nil
+		}
+	}
+	return 0, errNoSOA
+}
+
+// transfer pulls the full zone with AXFR. The returned records start with the SOA.
+func (s *Secondaries) transfer(z *zone) ([]dns.RR, error) {
+	msg := new(dns.Msg)
+	msg.SetAxfr(z.apex)
+
+	t := &dns.Transfer{}
+	s.sign(z, msg, func(name, secret string) { t.TsigSecret = map[string]string{name: secret} })
+
+	envelopes, err := t.In(msg, z.cfg.Primary)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []dns.RR
+	for e := range envelopes {
+		if e.Error != nil {
+			return nil, e.Error
+		}
+		records = append(records, e.RR...)
+	}
+	if len(records) < 2 {
+		return nil, errNoSOA
+	}
+	if _, ok := records[0].(*dns.SOA); !ok {
+		return nil, errNoSOA
+	}
+	return records[:len(records)-1], nil // Drop the closing SOA.
+}
+
+// sign adds a TSIG record to msg if the zone has a key, passing the secret to use.
+func (s *Secondaries) sign(z *zone, msg *dns.Msg, use func(name, secret string)) {
+	if z.cfg.Key == "" {
+		return
+	}
+	algorithm, secret, ok := s.keys.Secret(z.cfg.Key)
+	if !ok {
+		log.Error().Str("zone", z.apex).Str("key", z.cfg.Key).Msg("unknown tsig key for secondary zone")
+		return
+	}
+	name := dns.CanonicalName(z.cfg.Key)
+	msg.SetTsig(name, algorithm, 300, time.Now().Unix())
+	use(name, secret)
+}
+
+func (z *zone) fromPrimary(ip net.IP) bool {
+	host, _, err := net.SplitHostPort(z.cfg.Primary)
+	if err != nil {
+		host = z.cfg.Primary
+	}
+	if primary := net.ParseIP(host); primary != nil {
+		return primary.Equal(ip)
+	}
+	addrs, err := net.LookupIP(host)
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if addr.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func secondsOf(seconds uint32) time.Duration {
+	return time.Duration(seconds) * time.Second
+}
+
+// serialGreater compares SOA serials using RFC 1982 serial number arithmetic.
+func serialGreater(a, b uint32) bool {
+	return a != b && (a-b) < 1<<31
+}
@@ -1,18 +1,24 @@
 package transport
 
 import (
+	"encoding/binary"
 	"net"
+	"sync"
 
 	"github.com/miekg/dns"
 )
 
 type Connection interface {
 	SendResponse(msg *dns.Msg) error
+	SendRaw(data []byte) error
+	RemoteAddr() net.Addr
+	LocalAddr() net.Addr // Address the client sent its query to.
 }
 
 type UDPConnection struct {
-	Addr net.Addr
-	Conn net.PacketConn
+	Addr  net.Addr
+	Local net.Addr // Destination of the query, its IP nil if unknown.
+	Conn  net.PacketConn
 }
 
 func (uc *UDPConnection) SendResponse(msg *dns.Msg) error {
@@ -20,12 +26,27 @@ func (uc *UDPConnection) SendResponse(msg *dns.Msg) error {
 	if err != nil {
 		return err
 	}
-	_, err = uc.Conn.WriteTo(data, uc.Addr)
+	return uc.SendRaw(data)
+}
+
+func (uc *UDPConnection) SendRaw(data []byte) error {
+	_, err := uc.Conn.WriteTo(data, uc.Addr)
 	return err
 }
 
+func (uc *UDPConnection) RemoteAddr() net.Addr {
+	return uc.Addr
+}
+
+func (uc *UDPConnection) LocalAddr() net.Addr {
+	return uc.Local
+}
+
+// TCPConnection is shared by every query read from the same connection,
+// so concurrent responses are serialized.
 type TCPConnection struct {
-	Conn net.Conn
+	Conn  net.Conn
+	mutex sync.Mutex
 }
 
 func (tc *TCPConnection) SendResponse(msg *dns.Msg) error {
@@ -33,6 +54,25 @@ func (tc *TCPConnection) SendResponse(msg *dns.Msg) error {
 	if err != nil {
 		return err
 	}
-	_, err = tc.Conn.Write(data)
+	return tc.SendRaw(data)
+}
+
+// SendRaw writes a message prefixed with its two byte length as per RFC 1035 4.2.2.
+func (tc *TCPConnection) SendRaw(data []byte) error {
+	buf := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(buf, uint16(len(data)))
+	copy(buf[2:], data)
+
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	_, err := tc.Conn.Write(buf)
 	return err
 }
+
+func (tc *TCPConnection) RemoteAddr() net.Addr {
+	return tc.Conn.RemoteAddr()
+}
+
+func (tc *TCPConnection) LocalAddr() net.Addr {
+	return tc.Conn.LocalAddr()
+}
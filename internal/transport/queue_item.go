@@ -1,12 +1,18 @@
 package transport
 
 import (
+	"net"
+
+	"github.com/bwoff11/go-resolve/internal/client"
+	"github.com/bwoff11/go-resolve/internal/common"
 	"github.com/miekg/dns"
 )
 
 type QueueItem struct {
 	Msg        dns.Msg
+	Raw        []byte // The message as received, needed to verify TSIG signatures.
 	Connection Connection
+	Protocol   common.Protocol // Transport the message was received on.
 }
 
 func (qi *QueueItem) Message() *dns.Msg {
@@ -20,3 +26,25 @@ func (qi *QueueItem) Question() *dns.Question {
 func (qi *QueueItem) Respond(msg *dns.Msg) error {
 	return qi.Connection.SendResponse(msg)
 }
+
+// RespondRaw sends an already packed response, such as a TSIG signed one.
+func (qi *QueueItem) RespondRaw(data []byte) error {
+	return qi.Connection.SendRaw(data)
+}
+
+func (qi *QueueItem) RemoteAddr() net.Addr {
+	return qi.Connection.RemoteAddr()
+}
+
+// Source returns the client that sent the message, the transport it used
+// and the address it sent the message to.
+func (qi *QueueItem) Source() client.Source {
+	return client.Source{Addr: qi.RemoteAddr(), Protocol: qi.Protocol, Local: qi.Connection.LocalAddr()}
+}
+
+// Stream reports whether the message was received over a stream transport,
+// which can carry multi-message responses such as zone transfers.
+func (qi *QueueItem) Stream() bool {
+	_, ok := qi.Connection.(*TCPConnection)
+	return ok
+}
@@ -6,6 +6,7 @@ import (
 	"net"
 	"strconv"
 
+	"github.com/bwoff11/go-resolve/internal/common"
 	"github.com/bwoff11/go-resolve/internal/config"
 	"github.com/miekg/dns"
 	"github.com/rs/zerolog/log"
@@ -24,6 +25,7 @@ func NewTCP(c config.Protocol, q chan QueueItem) (*TCPTransport, error) {
 	}
 	return &TCPTransport{
 		Listener: listener,
+		Queue:    q,
 	}, nil
 }
 
@@ -47,44 +49,49 @@ func (t *TCPTransport) Listen() error {
 func (tt *TCPTransport) handleTCPConnection(conn net.Conn) {
 	defer conn.Close()
 
+	tcpConn := &TCPConnection{Conn: conn}
 	for {
-		req, err := tt.readDNSMessage(conn)
+		req, raw, err := tt.readDNSMessage(conn)
+		if err == io.EOF {
+			return
+		}
 		if err != nil {
 			log.Error().Err(err).Msg("error handling TCP connection")
 			return
 		}
 
-		tt.queueDNSRequest(req, conn)
+		tt.queueDNSRequest(req, raw, tcpConn)
 	}
 }
 
-func (tt *TCPTransport) readDNSMessage(conn net.Conn) (*dns.Msg, error) {
+func (tt *TCPTransport) readDNSMessage(conn net.Conn) (*dns.Msg, []byte, error) {
 	lenBuf := make([]byte, 2)
 	_, err := io.ReadFull(conn, lenBuf)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	length := binary.BigEndian.Uint16(lenBuf)
 	msgBuf := make([]byte, length)
 	_, err = io.ReadFull(conn, msgBuf)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	var req dns.Msg
 	if err := req.Unpack(msgBuf); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return &req, nil
+	return &req, msgBuf, nil
 }
 
-func (tt *TCPTransport) queueDNSRequest(req *dns.Msg, conn net.Conn) {
-	tcpConn := &TCPConnection{Conn: conn}
+func (tt *TCPTransport) queueDNSRequest(req *dns.Msg, raw []byte, tcpConn *TCPConnection) {
 	tt.Queue <- QueueItem{
 		Msg:        *req,
+		Raw:        raw,
 		Connection: tcpConn,
+		Protocol:   common.ProtocolTCP,
 	}
 }
 
@@ -4,22 +4,37 @@ import (
 	"net"
 	"strconv"
 
+	"github.com/bwoff11/go-resolve/internal/common"
 	"github.com/bwoff11/go-resolve/internal/config"
 	"github.com/miekg/dns"
 	"github.com/rs/zerolog/log"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 type UDPTransport struct {
-	Conn  net.PacketConn
+	Conn  *net.UDPConn
 	Queue chan QueueItem
 }
 
 func NewUDP(c config.Protocol, q chan QueueItem) (Transport, error) {
-	addr := net.JoinHostPort("", strconv.Itoa(c.Port))
-	conn, err := net.ListenPacket("udp", addr)
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort("", strconv.Itoa(c.Port)))
 	if err != nil {
 		return nil, err
 	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Report the address each query was sent to, which the wildcard
+	// listening address does not tell.
+	err6 := ipv6.NewPacketConn(conn).SetControlMessage(ipv6.FlagDst, true)
+	err4 := ipv4.NewPacketConn(conn).SetControlMessage(ipv4.FlagDst, true)
+	if err6 != nil && err4 != nil {
+		log.Warn().Err(err4).Msg("udp query destination addresses unavailable, views cannot match interfaces")
+	}
+
 	return &UDPTransport{
 		Conn:  conn,
 		Queue: q,
@@ -31,8 +46,9 @@ func (ut *UDPTransport) Listen() error {
 
 	go func() {
 		buf := make([]byte, UDPBufferSize)
+		oob := make([]byte, oobSize)
 		for {
-			n, clientAddr, err := ut.Conn.ReadFrom(buf)
+			n, oobn, _, clientAddr, err := ut.Conn.ReadMsgUDP(buf, oob)
 			if err != nil {
 				log.Error().Err(err).Msg("error reading from udp connection")
 				return
@@ -40,8 +56,9 @@ func (ut *UDPTransport) Listen() error {
 
 			query := make([]byte, n)
 			copy(query, buf[:n])
+			local := &net.UDPAddr{IP: destination(oob[:oobn]), Port: ut.Conn.LocalAddr().(*net.UDPAddr).Port}
 
-			go ut.handleUDPQuery(query, clientAddr)
+			go ut.handleUDPQuery(query, clientAddr, local)
 		}
 	}()
 
@@ -49,7 +66,7 @@ func (ut *UDPTransport) Listen() error {
 	return nil
 }
 
-func (ut *UDPTransport) handleUDPQuery(query []byte, clientAddr net.Addr) {
+func (ut *UDPTransport) handleUDPQuery(query []byte, clientAddr, local net.Addr) {
 	var req dns.Msg
 	if err := req.Unpack(query); err != nil {
 		log.Error().Err(err).Str("protocol", "udp").Msg("error unpacking dns query")
@@ -58,17 +75,40 @@ func (ut *UDPTransport) handleUDPQuery(query []byte, clientAddr net.Addr) {
 
 	// Create a UDPConnection adapter
 	udpConn := &UDPConnection{
-		Addr: clientAddr,
-		Conn: ut.Conn,
+		Addr:  clientAddr,
+		Local: local,
+		Conn:  ut.Conn,
 	}
 
 	// Enqueue the query with the generic QueueItem structure
 	ut.Queue <- QueueItem{
 		Msg:        req,
+		Raw:        query,
 		Connection: udpConn,
+		Protocol:   common.ProtocolUDP,
 	}
 }
 
+// oobSize fits the IPv4 or IPv6 packet information control message.
+var oobSize = max(len(ipv4.NewControlMessage(ipv4.FlagDst)), len(ipv6.NewControlMessage(ipv6.FlagDst)))
+
+// destination returns the address a query was sent to from its control
+// message, or nil if there is none.
+func destination(oob []byte) net.IP {
+	if len(oob) == 0 {
+		return nil
+	}
+	var cm6 ipv6.ControlMessage
+	if err := cm6.Parse(oob); err == nil && cm6.Dst != nil {
+		return cm6.Dst
+	}
+	var cm4 ipv4.ControlMessage
+	if err := cm4.Parse(oob); err == nil && cm4.Dst != nil {
+		return cm4.Dst
+	}
+	return nil
+}
+
 func (ut *UDPTransport) Close() error {
 	return ut.Conn.Close()
 }
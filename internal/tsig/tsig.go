@@ -0,0 +1,97 @@
+package tsig
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/bwoff11/go-resolve/internal/config"
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// fudge is the permitted clock skew in seconds.
+const fudge = 300
+
+var (
+	ErrUnsigned   = errors.New("message is not signed")
+	ErrUnknownKey = errors.New("unknown tsig key")
+)
+
+var algorithms = map[string]string{
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha224": dns.HmacSHA224,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha384": dns.HmacSHA384,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// Keys holds the configured TSIG keys by their fully qualified name.
+type Keys struct {
+	keys map[string]key
+}
+
+type key struct {
+	algorithm string
+	secret    string
+}
+
+// New parses the configured keys. Invalid keys are logged and skipped.
+func New(cfg []config.TSIGKey) *Keys {
+	k := &Keys{keys: make(map[string]key)}
+	for _, c := range cfg {
+		if _, err := base64.StdEncoding.DecodeString(c.Secret); err != nil {
+			log.Error().Err(err).Str("key", c.Name).Msg("invalid tsig secret")
+			continue
+		}
+
+		name := strings.ToLower(c.Algorithm)
+		if name == "" {
+			name = "hmac-sha256"
+		}
+		algorithm, ok := algorithms[name]
+		if !ok {
+			log.Error().Str("key", c.Name).Str("algorithm", c.Algorithm).Msg("unsupported tsig algorithm")
+			continue
+		}
+
+		k.keys[dns.CanonicalName(c.Name)] = key{algorithm: algorithm, secret: c.Secret}
+	}
+	return k
+}
+
+// Verify checks the TSIG signature of a message as received in raw and
+// returns the name of the key it was signed with.
+func (k *Keys) Verify(msg *dns.Msg, raw []byte) (string, error) {
+	t := msg.IsTsig()
+	if t == nil {
+		return "", ErrUnsigned
+	}
+
+	name := dns.CanonicalName(t.Hdr.Name)
+	key, ok := k.keys[name]
+	if !ok || !strings.EqualFold(key.algorithm, t.Algorithm) {
+		return name, ErrUnknownKey
+	}
+	return name, dns.TsigVerify(raw, key.secret, "", false)
+}
+
+// Sign packs a message signed with the named key. requestMAC is the MAC of
+// the request being answered, or of the previous message of a multi-message
+// response, in which case timersOnly is set as per RFC 8945 5.3.1.
+func (k *Keys) Sign(msg *dns.Msg, name, requestMAC string, timersOnly bool) ([]byte, string, error) {
+	key, ok := k.keys[name]
+	if !ok {
+		return nil, "", ErrUnknownKey
+	}
+
+	msg.SetTsig(name, key.algorithm, fudge, time.Now().Unix())
+	return dns.TsigGenerate(msg, key.secret, requestMAC, timersOnly)
+}
+
+// Secret returns the algorithm and secret of the named key for use with a dns.Client.
+func (k *Keys) Secret(name string) (algorithm, secret string, ok bool) {
+	key, ok := k.keys[dns.CanonicalName(name)]
+	return key.algorithm, key.secret, ok
+}
@@ -0,0 +1,97 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	minBootstrapTTL   = 30 * time.Second // Lower bound on how long a resolved address is used.
+	systemTTL         = 5 * time.Minute  // Lifetime of addresses from the system resolver, which reports no TTL.
+	bootstrapTimeout  = 2 * time.Second
+	bootstrapRetryTTL = 30 * time.Second // Wait before retrying a failed resolution when an old address is kept.
+)
+
+var errNoAddress = errors.New("no address found for upstream host")
+
+// Bootstrap resolves the hostnames of upstream servers. It queries the
+// configured bootstrap servers, or the system resolver if there are none.
+type Bootstrap struct {
+	servers []string
+}
+
+// NewBootstrap creates a Bootstrap from IP or IP:port addresses; port 53 is assumed if none is given.
+func NewBootstrap(servers []string) *Bootstrap {
+	b := &Bootstrap{}
+	for _, s := range servers {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(s, "53")
+		}
+		b.servers = append(b.servers, s)
+	}
+	return b
+}
+
+// Resolve returns an address of host and how long it may be used.
+// IPv4 addresses are preferred.
+func (b *Bootstrap) Resolve(host string) (net.IP, time.Duration, error) {
+	if len(b.servers) == 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), bootstrapTimeout)
+		defer cancel()
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				return ip, systemTTL, nil
+			}
+		}
+		return ips[0], systemTTL, nil
+	}
+
+	var lastErr error = errNoAddress
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		for _, server := range b.servers {
+			ip, ttl, err := b.query(server, host, qtype)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if ip != nil {
+				return ip, ttl, nil
+			}
+			break // The server answered without addresses of this type.
+		}
+	}
+	return nil, 0, lastErr
+}
+
+// query asks a bootstrap server for the addresses of host of type qtype.
+func (b *Bootstrap) query(server, host string, qtype uint16) (net.IP, time.Duration, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(host), qtype)
+
+	client := &dns.Client{Timeout: bootstrapTimeout}
+	resp, _, err := client.Exchange(msg, server)
+	if err != nil {
+		log.Warn().Err(err).Str("host", host).Str("bootstrap", server).Msg("bootstrap query failed")
+		return nil, 0, err
+	}
+
+	for _, rr := range resp.Answer {
+		ttl := max(time.Duration(rr.Header().Ttl)*time.Second, minBootstrapTTL)
+		switch a := rr.(type) {
+		case *dns.A:
+			return a.A, ttl, nil
+		case *dns.AAAA:
+			return a.AAAA, ttl, nil
+		}
+	}
+	return nil, 0, nil
+}
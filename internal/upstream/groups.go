@@ -0,0 +1,80 @@
+package upstream
+
+import (
+	"github.com/bwoff11/go-resolve/internal/cache"
+	"github.com/bwoff11/go-resolve/internal/config"
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// Groups forwards each query to the upstream group routed for its name, by
+// longest matching zone, or to the default upstream.
+type Groups struct {
+	Default *Upstream
+	groups  map[string]*Upstream
+	routes  map[string]string // Zone to group name.
+}
+
+// NewGroups builds the default upstream and every forwarding group, sharing
+// c for recursive servers. Routes to unknown groups are logged and skipped.
+func NewGroups(def config.Upstream, cfg *config.Forwarding, c *cache.Cache) *Groups {
+	g := &Groups{
+		Default: New(def, c),
+		groups:  make(map[string]*Upstream),
+		routes:  make(map[string]string),
+	}
+	for _, group := range cfg.Groups {
+		g.groups[group.Name] = New(group.Upstream, c)
+	}
+
+	for _, route := range cfg.Routes {
+		if _, ok := g.groups[route.Group]; !ok {
+			log.Error().Str("group", route.Group).Msg("forwarding route to unknown upstream group")
+			continue
+		}
+		zones, err := route.Zones()
+		if err != nil {
+			log.Error().Err(err).Str("group", route.Group).Msg("invalid forwarding route")
+			continue
+		}
+		for _, zone := range zones {
+			g.routes[zone] = route.Group
+			log.Debug().Str("zone", zone).Str("group", route.Group).Msg("added forwarding route")
+		}
+	}
+	return g
+}
+
+// Route returns the upstream for name and the name of its group, empty for the default.
+func (g *Groups) Route(name string) (*Upstream, string) {
+	name = dns.CanonicalName(name)
+	for _, i := range append(dns.Split(name), len(name)-1) {
+		if group, ok := g.routes[name[i:]]; ok {
+			return g.groups[group], group
+		}
+	}
+	return g.Default, ""
+}
+
+// Query forwards the query to the upstream routed for its name.
+func (g *Groups) Query(msg *dns.Msg) []dns.RR {
+	return answer(g.Exchange(msg))
+}
+
+// Exchange forwards the query to the upstream routed for its name and returns
+// the full response, or nil if no server gave a valid one.
+func (g *Groups) Exchange(msg *dns.Msg) *dns.Msg {
+	u, group := g.Route(msg.Question[0].Name)
+	if group != "" {
+		log.Debug().Str("domain", msg.Question[0].Name).Str("group", group).Msg("forwarding query to upstream group")
+	}
+	return u.Exchange(msg)
+}
+
+// Close stops the health checkers of every group.
+func (g *Groups) Close() {
+	g.Default.Close()
+	for _, u := range g.groups {
+		u.Close()
+	}
+}
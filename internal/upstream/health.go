@@ -0,0 +1,157 @@
+package upstream
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bwoff11/go-resolve/internal/config"
+	"github.com/bwoff11/go-resolve/internal/metrics"
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// health tracks consecutive failures of an upstream server. A server is
+// marked down after threshold failures in a row and is retried once its
+// backoff has passed; each failed retry doubles the backoff up to maxBackoff.
+type health struct {
+	mutex      sync.Mutex
+	address    string
+	threshold  int
+	backoff    time.Duration // Initial backoff.
+	maxBackoff time.Duration
+	failures   int
+	down       bool
+	retryAt    time.Time
+	current    time.Duration // Backoff applied at the last failure.
+	closed     bool          // The metric series may have been deleted.
+}
+
+// seriesUsers counts the servers reporting metrics under each address, so
+// that the series of a server are only deleted once no upstream uses it,
+// e.g. after a reload removed it from the configuration.
+var seriesUsers = struct {
+	sync.Mutex
+	count map[string]int
+}{count: make(map[string]int)}
+
+func newHealth(address string, cfg *config.HealthCheck) *health {
+	h := &health{
+		address:    address,
+		threshold:  orDefault(cfg.Failures, 3),
+		backoff:    time.Duration(orDefault(cfg.Backoff, 5)) * time.Second,
+		maxBackoff: time.Duration(orDefault(cfg.MaxBackoff, 300)) * time.Second,
+	}
+	seriesUsers.Lock()
+	seriesUsers.count[address]++
+	seriesUsers.Unlock()
+
+	metrics.UpstreamUp.WithLabelValues(address).Set(1)
+	return h
+}
+
+// close deletes the server's metric series unless another server reports
+// under the same address.
+func (h *health) close() {
+	h.mutex.Lock()
+	h.closed = true
+	h.mutex.Unlock()
+
+	seriesUsers.Lock()
+	defer seriesUsers.Unlock()
+
+	if seriesUsers.count[h.address]--; seriesUsers.count[h.address] > 0 {
+		return
+	}
+	delete(seriesUsers.count, h.address)
+	metrics.UpstreamUp.DeleteLabelValues(h.address)
+	metrics.UpstreamRTT.DeleteLabelValues(h.address)
+	metrics.UpstreamWins.DeleteLabelValues(h.address)
+}
+
+// available reports whether the server may be queried at t: it is up, or its
+// backoff has passed and it is due a retry.
+func (h *health) available(t time.Time) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return !h.down || !t.Before(h.retryAt)
+}
+
+func (h *health) success() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.down {
+		log.Info().Str("server", h.address).Msg("upstream server recovered")
+	}
+	h.failures, h.down, h.current = 0, false, 0
+	if !h.closed {
+		metrics.UpstreamUp.WithLabelValues(h.address).Set(1)
+	}
+}
+
+func (h *health) failure() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.failures++
+	switch {
+	case h.down && time.Now().Before(h.retryAt):
+		return // Another query already failed the retry.
+	case h.down:
+		h.current = min(2*h.current, h.maxBackoff)
+	case h.failures >= h.threshold:
+		h.down, h.current = true, h.backoff
+		log.Warn().Str("server", h.address).Int("failures", h.failures).Msg("upstream server marked down")
+		if !h.closed {
+			metrics.UpstreamUp.WithLabelValues(h.address).Set(0)
+		}
+	default:
+		return
+	}
+	h.retryAt = time.Now().Add(h.current)
+}
+
+// startHealthChecker probes every available server at the configured interval
+// until the upstream is closed.
+func (u *Upstream) startHealthChecker(cfg *config.HealthCheck) {
+	name := cfg.Name
+	if name == "" {
+		name = "."
+	}
+	interval := time.Duration(orDefault(cfg.Interval, 10)) * time.Second
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				u.probe(dns.Fqdn(name))
+			case <-u.done:
+				return
+			}
+		}
+	}()
+}
+
+// probe queries every server due a check. The outcome is recorded by Query.
+func (u *Upstream) probe(name string) {
+	now := time.Now()
+	for _, server := range u.Servers {
+		if !server.health.available(now) {
+			continue
+		}
+		go func(server *UpstreamServer) {
+			msg := new(dns.Msg)
+			msg.SetQuestion(name, dns.TypeNS)
+			server.Query(msg)
+		}(server)
+	}
+}
+
+func orDefault(value, fallback int) int {
+	if value <= 0 {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,108 @@
+package upstream
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ewmaWeight is the weight of each new sample in the smoothed latency.
+const ewmaWeight = 0.3
+
+// latency is an exponentially weighted moving average of a server's round
+// trip time. Failures are sampled as the server's full timeout.
+type latency struct {
+	mutex   sync.Mutex
+	value   time.Duration
+	sampled bool
+}
+
+func (l *latency) observe(rtt time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if !l.sampled {
+		l.value, l.sampled = rtt, true
+		return
+	}
+	l.value = time.Duration(ewmaWeight*float64(rtt) + (1-ewmaWeight)*float64(l.value))
+}
+
+// get returns the smoothed latency and whether the server has been sampled yet.
+func (l *latency) get() (time.Duration, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.value, l.sampled
+}
+
+// Latency returns the smoothed round trip time of the server, or 0 if it has not been queried.
+func (us *UpstreamServer) Latency() time.Duration {
+	value, _ := us.latency.get()
+	return value
+}
+
+// latencyServer selects the available server with the lowest smoothed latency.
+// Servers that have not been sampled yet are selected first so they can be
+// measured, and a share of queries explores another server at random so a
+// recovered server is noticed.
+func (u *Upstream) latencyServer() *UpstreamServer {
+	servers := u.available()
+
+	var selected *UpstreamServer
+	var best time.Duration
+	for _, server := range servers {
+		value, sampled := server.latency.get()
+		if !sampled {
+			return server
+		}
+		if selected == nil || value < best {
+			selected, best = server, value
+		}
+	}
+
+	if len(servers) > 1 && rand.Float64() < u.exploration {
+		others := make([]*UpstreamServer, 0, len(servers)-1)
+		for _, server := range servers {
+			if server != selected {
+				others = append(others, server)
+			}
+		}
+		return others[rand.Intn(len(others))]
+	}
+	return selected
+}
+
+// weightedServer selects an available server at random in proportion to its
+// configured weight divided by its smoothed latency, so faster servers get a
+// larger share of queries. Servers not sampled yet are assumed to be as fast
+// as the fastest server.
+func (u *Upstream) weightedServer() *UpstreamServer {
+	servers := u.available()
+
+	var fastest time.Duration
+	for _, server := range servers {
+		if value, sampled := server.latency.get(); sampled && (fastest == 0 || value < fastest) {
+			fastest = value
+		}
+	}
+
+	scores := make([]float64, len(servers))
+	var total float64
+	for i, server := range servers {
+		value, sampled := server.latency.get()
+		if !sampled || value <= 0 {
+			value = max(fastest, time.Millisecond)
+		}
+		scores[i] = float64(server.Weight) / value.Seconds()
+		total += scores[i]
+	}
+
+	pick := rand.Float64() * total
+	for i, score := range scores {
+		if pick < score {
+			return servers[i]
+		}
+		pick -= score
+	}
+	return servers[len(servers)-1]
+}
@@ -0,0 +1,43 @@
+package upstream
+
+import (
+	"context"
+
+	"github.com/bwoff11/go-resolve/internal/metrics"
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// race sends the query to fanOut available servers at once and returns the
+// first valid response, cancelling the others. It returns nil if none of
+// them answers validly before ctx is done.
+func (u *Upstream) race(ctx context.Context, msg *dns.Msg) *dns.Msg {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	servers := u.failoverOrder()
+	servers = servers[:min(u.fanOut, len(servers))]
+
+	type result struct {
+		server *UpstreamServer
+		resp   *dns.Msg
+		err    error
+	}
+	results := make(chan result, len(servers)) // Buffered so losers never block.
+	for _, server := range servers {
+		go func(server *UpstreamServer) {
+			resp, err := server.Exchange(ctx, msg.Copy())
+			results <- result{server, resp, err}
+		}(server)
+	}
+
+	for range servers {
+		r := <-results
+		if valid(r.resp, r.err) {
+			log.Debug().Str("domain", msg.Question[0].Name).Str("server", r.server.Address).Msg("upstream won parallel query")
+			metrics.UpstreamWins.WithLabelValues(r.server.Address).Inc()
+			return r.resp
+		}
+	}
+	return nil
+}
@@ -0,0 +1,441 @@
+package upstream
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	udpSocketUses  = 100 // Queries sent from a UDP socket before it is rebound to a new random port.
+	maxMessageSize = dns.MaxMsgSize
+)
+
+var errConnClosed = errors.New("upstream connection closed")
+
+// udpPool keeps pre-bound UDP sockets for queries to one server. Each socket
+// is bound to a random ephemeral port and rebound after udpSocketUses
+// queries; every query gets a random ID. Responses are only accepted from the
+// queried address with the query's ID and question.
+type udpPool struct {
+	mutex   sync.Mutex
+	sockets []*net.UDPConn
+	uses    map[*net.UDPConn]int
+	size    int
+	closed  bool
+}
+
+func newUDPPool(size int) *udpPool {
+	return &udpPool{size: size, uses: make(map[*net.UDPConn]int)}
+}
+
+func (p *udpPool) get() (*net.UDPConn, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if n := len(p.sockets); n > 0 {
+		conn := p.sockets[n-1]
+		p.sockets = p.sockets[:n-1]
+		return conn, nil
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	p.uses[conn] = 0
+	return conn, nil
+}
+
+// put returns a socket to the pool, closing it if it failed, has been used
+// enough or the pool is full or closed.
+func (p *udpPool) put(conn *net.UDPConn, failed bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.uses[conn]++
+	if failed || p.closed || p.uses[conn] >= udpSocketUses || len(p.sockets) >= p.size {
+		delete(p.uses, conn)
+		conn.Close()
+		return
+	}
+	p.sockets = append(p.sockets, conn)
+}
+
+func (p *udpPool) exchange(ctx context.Context, msg *dns.Msg, addr string) (*dns.Msg, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := p.roundTrip(ctx, conn, msg, raddr)
+	var netErr net.Error
+	p.put(conn, err != nil && !(errors.As(err, &netErr) && netErr.Timeout()))
+	return resp, err
+}
+
+func (p *udpPool) roundTrip(ctx context.Context, conn *net.UDPConn, msg *dns.Msg, raddr *net.UDPAddr) (*dns.Msg, error) {
+	query := msg.Copy()
+	query.Id = dns.Id()
+	data, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Time{})
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) }) // Unblocks the read on cancellation.
+	defer stop()
+
+	if _, err := conn.WriteToUDP(data, raddr); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		if !from.IP.Equal(raddr.IP) || from.Port != raddr.Port {
+			continue
+		}
+		resp := new(dns.Msg)
+		if err := resp.Unpack(buf[:n]); err != nil || !matches(query, resp) {
+			continue // A late answer to an earlier query on this socket, or spoofed.
+		}
+		resp.Id = msg.Id
+		return resp, nil
+	}
+}
+
+// matches reports whether resp answers query.
+func matches(query, resp *dns.Msg) bool {
+	if resp.Id != query.Id || len(resp.Question) != len(query.Question) {
+		return false
+	}
+	for i, q := range query.Question {
+		r := resp.Question[i]
+		if !strings.EqualFold(q.Name, r.Name) || q.Qtype != r.Qtype || q.Qclass != r.Qclass {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *udpPool) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.closed = true
+	for _, conn := range p.sockets {
+		conn.Close()
+	}
+	p.sockets = nil
+}
+
+// streamPool keeps up to maxConns TCP or TLS connections to one server and
+// pipelines queries over them as per RFC 7766: many queries may be
+// outstanding on a connection at once, their responses matched by ID.
+// Connections without outstanding queries are closed after idle.
+type streamPool struct {
+	dial     func(ctx context.Context) (net.Conn, error)
+	maxConns int
+	idle     time.Duration
+
+	mutex   sync.Mutex
+	conns   []*pipelinedConn
+	dialing int           // Slots reserved by connections being dialed.
+	dialed  chan struct{} // Closed when a dial finishes.
+	closed  bool
+}
+
+type pipelinedConn struct {
+	conn  net.Conn
+	pool  *streamPool
+	write sync.Mutex // Serializes writes of whole messages.
+
+	mutex     sync.Mutex
+	pending   map[uint16]chan *dns.Msg
+	idleTimer *time.Timer
+	dead      bool
+}
+
+func newStreamPool(dial func(ctx context.Context) (net.Conn, error), maxConns int, idle time.Duration) *streamPool {
+	return &streamPool{dial: dial, maxConns: maxConns, idle: idle, dialed: make(chan struct{})}
+}
+
+// conn returns the connection with the fewest outstanding queries, dialing a
+// new one if every connection is busy and the pool is not full. Dials run
+// without holding the pool lock, so a slow handshake only delays the queries
+// waiting for that connection.
+func (p *streamPool) conn(ctx context.Context) (*pipelinedConn, error) {
+	for {
+		p.mutex.Lock()
+		if p.closed {
+			p.mutex.Unlock()
+			return nil, errConnClosed
+		}
+
+		best, load := p.leastLoaded()
+		full := len(p.conns)+p.dialing >= p.maxConns
+		if best != nil && (load == 0 || full) {
+			p.mutex.Unlock()
+			return best, nil
+		}
+		if !full {
+			p.dialing++ // Reserve the slot for the new connection.
+			p.mutex.Unlock()
+			return p.dialConn(ctx)
+		}
+
+		// Every slot is taken by a connection being dialed; wait for one.
+		dialed := p.dialed
+		p.mutex.Unlock()
+		select {
+		case <-dialed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// dialConn dials a connection into a slot reserved by conn. If dialing
+// fails, an existing connection is used if there is one.
+func (p *streamPool) dialConn(ctx context.Context) (*pipelinedConn, error) {
+	conn, err := p.dial(ctx)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.dialing--
+	close(p.dialed) // Wake queries waiting for a slot.
+	p.dialed = make(chan struct{})
+
+	if err != nil {
+		if best, _ := p.leastLoaded(); best != nil {
+			return best, nil
+		}
+		return nil, err
+	}
+	if p.closed {
+		conn.Close()
+		return nil, errConnClosed
+	}
+
+	c := &pipelinedConn{conn: conn, pool: p, pending: make(map[uint16]chan *dns.Msg)}
+	p.conns = append(p.conns, c)
+	go c.read()
+	return c, nil
+}
+
+// leastLoaded returns the connection with the fewest outstanding queries and
+// their number. The caller must hold the pool lock.
+func (p *streamPool) leastLoaded() (*pipelinedConn, int) {
+	var best *pipelinedConn
+	bestLoad := 0
+	for _, c := range p.conns {
+		if load := c.load(); best == nil || load < bestLoad {
+			best, bestLoad = c, load
+		}
+	}
+	return best, bestLoad
+}
+
+func (p *streamPool) remove(c *pipelinedConn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for i, existing := range p.conns {
+		if existing == c {
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+func (p *streamPool) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	c, err := p.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	id, ch, err := c.register()
+	if err != nil {
+		return nil, err
+	}
+	defer c.unregister(id)
+
+	query := msg.Copy()
+	query.Id = id
+	if err := c.send(ctx, query); err != nil {
+		c.fail(err)
+		return nil, err
+	}
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, errConnClosed
+		}
+		if !matches(query, resp) {
+			return nil, errors.New("upstream response does not match query")
+		}
+		resp.Id = msg.Id
+		return resp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *streamPool) close() {
+	p.mutex.Lock()
+	conns := p.conns
+	p.conns, p.closed = nil, true
+	p.mutex.Unlock()
+
+	for _, c := range conns {
+		c.fail(errConnClosed)
+	}
+}
+
+func (c *pipelinedConn) load() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.pending)
+}
+
+// register reserves a random ID not outstanding on the connection.
+func (c *pipelinedConn) register() (uint16, chan *dns.Msg, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.dead {
+		return 0, nil, errConnClosed
+	}
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+	}
+	for {
+		id := dns.Id()
+		if _, taken := c.pending[id]; !taken {
+			ch := make(chan *dns.Msg, 1)
+			c.pending[id] = ch
+			return id, ch, nil
+		}
+	}
+}
+
+// unregister releases an ID and starts the idle timer if nothing is outstanding.
+func (c *pipelinedConn) unregister(id uint16) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.pending, id)
+	if len(c.pending) == 0 && !c.dead {
+		c.idleTimer = time.AfterFunc(c.pool.idle, c.closeIfIdle)
+	}
+}
+
+func (c *pipelinedConn) closeIfIdle() {
+	c.mutex.Lock()
+	if len(c.pending) > 0 || c.dead {
+		c.mutex.Unlock()
+		return
+	}
+	c.dead = true // Checked with the lock held so no query registers in between.
+	c.mutex.Unlock()
+
+	log.Debug().Str("address", c.conn.RemoteAddr().String()).Msg("closing idle upstream connection")
+	c.conn.Close()
+	c.pool.remove(c)
+}
+
+// send writes a message prefixed with its two byte length.
+func (c *pipelinedConn) send(ctx context.Context, msg *dns.Msg) error {
+	data, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(buf, uint16(len(data)))
+	copy(buf[2:], data)
+
+	c.write.Lock()
+	defer c.write.Unlock()
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetWriteDeadline(deadline)
+	}
+	_, err = c.conn.Write(buf)
+	return err
+}
+
+// read dispatches responses to the queries waiting for them until the connection fails.
+func (c *pipelinedConn) read() {
+	length := make([]byte, 2)
+	for {
+		if _, err := io.ReadFull(c.conn, length); err != nil {
+			c.fail(err)
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(length))
+		if _, err := io.ReadFull(c.conn, buf); err != nil {
+			c.fail(err)
+			return
+		}
+
+		resp := new(dns.Msg)
+		if err := resp.Unpack(buf); err != nil {
+			log.Warn().Err(err).Str("address", c.conn.RemoteAddr().String()).Msg("invalid upstream response")
+			continue
+		}
+
+		c.mutex.Lock()
+		if ch, ok := c.pending[resp.Id]; ok {
+			delete(c.pending, resp.Id) // Before the receiver owns resp.
+			ch <- resp
+		}
+		c.mutex.Unlock()
+	}
+}
+
+// fail closes the connection, removes it from the pool and wakes every query waiting on it.
+func (c *pipelinedConn) fail(err error) {
+	c.mutex.Lock()
+	if c.dead {
+		c.mutex.Unlock()
+		return
+	}
+	c.dead = true
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+	}
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+	c.mutex.Unlock()
+
+	c.conn.Close()
+	c.pool.remove(c)
+	if !errors.Is(err, errConnClosed) && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		log.Debug().Err(err).Str("address", c.conn.RemoteAddr().String()).Msg("upstream connection failed")
+	}
+}
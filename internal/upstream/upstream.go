@@ -1,12 +1,18 @@
 package upstream
 
 import (
+	"context"
 	"math/rand"
+	"slices"
 	"sync"
 	"time"
 
+	"github.com/bwoff11/go-resolve/internal/cache"
 	"github.com/bwoff11/go-resolve/internal/config"
+	"github.com/bwoff11/go-resolve/internal/metrics"
+	"github.com/bwoff11/go-resolve/internal/recursive"
 	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
 )
 
 type Upstream struct {
@@ -15,18 +21,42 @@ type Upstream struct {
 	selectServerFunc func() *UpstreamServer // Function pointer for server selection
 	counter          int
 	mutex            sync.Mutex
+	done             chan struct{}
+	attempts         int           // Servers tried per query.
+	deadline         time.Duration // Time allowed for every attempt of a query.
+	fanOut           int           // Servers raced by the parallel strategy.
+	exploration      float64       // Share of latency strategy queries sent to another server.
 }
 
 // NewUpstream creates a new Upstream instance based on the given config.
-func New(cfg config.Upstream) *Upstream {
+// Recursive servers keep delegations in c.
+func New(cfg config.Upstream, c *cache.Cache) *Upstream {
+	bootstrap := NewBootstrap(cfg.Bootstrap)
+	recursor := recursive.New(&cfg.Recursion, c)
 	servers := make([]*UpstreamServer, 0, len(cfg.Servers))
 	for _, server := range cfg.Servers {
-		servers = append(servers, NewUpstreamServer(server.IP, server.Port, server.Timeout))
+		server.Weight = orDefault(server.Weight, 1)
+		us := NewUpstreamServer(server, &cfg.HealthCheck, bootstrap, &cfg.Pool)
+		if us.protocol == "recursive" {
+			us.recursor = recursor
+		}
+		servers = append(servers, us)
 	}
 
 	upstream := &Upstream{
-		Servers:  servers,
-		Strategy: cfg.Strategy,
+		Servers:     servers,
+		Strategy:    cfg.Strategy,
+		done:        make(chan struct{}),
+		attempts:    cfg.Retry.Attempts,
+		fanOut:      orDefault(cfg.FanOut, 2),
+		exploration: cfg.Exploration,
+		deadline:    deadline(cfg.Retry.Deadline, servers),
+	}
+	if upstream.exploration == 0 {
+		upstream.exploration = 0.05
+	}
+	if upstream.attempts <= 0 {
+		upstream.attempts = len(servers)
 	}
 
 	// Assign the server selection function based on strategy
@@ -39,57 +69,161 @@ func New(cfg config.Upstream) *Upstream {
 		upstream.selectServerFunc = upstream.latencyServer
 	case config.StrategySequential:
 		upstream.selectServerFunc = upstream.sequentialServer
+	case config.StrategyWeighted:
+		upstream.selectServerFunc = upstream.weightedServer
+	case config.StrategyParallel:
+		upstream.selectServerFunc = upstream.randomServer // Used to order the race participants.
 	default:
 		upstream.selectServerFunc = upstream.randomServer
 	}
 
+	if cfg.HealthCheck.Enabled {
+		upstream.startHealthChecker(&cfg.HealthCheck)
+	}
+
 	return upstream
 }
 
-// Query forwards the DNS query to an appropriate upstream server.
+// deadline returns the time allowed for every attempt of a query: the
+// configured seconds, or 5 seconds but at least the timeout of any recursive
+// server, as iterative resolution may take many round trips. A configured
+// deadline cutting recursive servers short is logged.
+func deadline(seconds int, servers []*UpstreamServer) time.Duration {
+	var recursive time.Duration
+	for _, server := range servers {
+		if server.recursor != nil {
+			recursive = max(recursive, server.timeout())
+		}
+	}
+
+	if seconds <= 0 {
+		return max(5*time.Second, recursive)
+	}
+	d := time.Duration(seconds) * time.Second
+	if d < recursive {
+		log.Warn().Dur("deadline", d).Dur("recursionTimeout", recursive).Msg("upstream retry deadline is shorter than the recursive server timeout, recursive queries may be cut short")
+	}
+	return d
+}
+
+// Close stops the health checker and closes the servers' pooled connections.
+func (u *Upstream) Close() {
+	close(u.done)
+	for _, server := range u.Servers {
+		server.close()
+	}
+}
+
+// available returns the servers that are not marked down. If every server
+// is down, all of them are returned rather than failing every query.
+func (u *Upstream) available() []*UpstreamServer {
+	now := time.Now()
+	var servers []*UpstreamServer
+	for _, server := range u.Servers {
+		if server.health.available(now) {
+			servers = append(servers, server)
+		}
+	}
+	if len(servers) == 0 {
+		return u.Servers
+	}
+	return servers
+}
+
+// Query forwards the DNS query and returns the answer of a successful response.
 func (u *Upstream) Query(msg *dns.Msg) []dns.RR {
-	server := u.selectServerFunc() // Use the assigned function
-	return server.Query(msg)
+	return answer(u.Exchange(msg))
+}
+
+// Exchange forwards the DNS query to the server chosen by the strategy and
+// returns the full response, or nil if no server gave a valid one. After a
+// timeout, SERVFAIL or REFUSED the next server is tried, in the order the
+// strategy prefers, until the attempts or the query deadline run out.
+// An upstream without servers answers nothing.
+func (u *Upstream) Exchange(msg *dns.Msg) *dns.Msg {
+	if len(u.Servers) == 0 {
+		log.Debug().Str("domain", msg.Question[0].Name).Msg("no upstream servers configured")
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), u.deadline)
+	defer cancel()
+
+	if u.Strategy == config.StrategyParallel {
+		return u.race(ctx, msg)
+	}
+
+	for i, server := range u.failoverOrder() {
+		if i >= u.attempts {
+			break
+		}
+		if ctx.Err() != nil {
+			log.Warn().Str("domain", msg.Question[0].Name).Int("attempts", i).Msg("upstream query deadline exceeded")
+			break
+		}
+		if i > 0 {
+			log.Debug().Str("domain", msg.Question[0].Name).Str("server", server.Address).Msg("retrying query on next upstream server")
+			metrics.UpstreamRetries.Inc()
+		}
+
+		if resp, err := server.Exchange(ctx, msg); valid(resp, err) {
+			return resp
+		}
+	}
+	return nil
+}
+
+// valid reports whether a response ends a query: anything but an error,
+// SERVFAIL or REFUSED, which are retried on another server.
+func valid(resp *dns.Msg, err error) bool {
+	return err == nil && resp.Rcode != dns.RcodeServerFailure && resp.Rcode != dns.RcodeRefused
+}
+
+// answer returns the answer section of a successful response.
+func answer(resp *dns.Msg) []dns.RR {
+	if resp == nil || resp.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+	return resp.Answer
+}
+
+// failoverOrder returns the server chosen by the strategy followed by the
+// other available servers, starting after it.
+func (u *Upstream) failoverOrder() []*UpstreamServer {
+	first := u.selectServerFunc()
+	order := []*UpstreamServer{first}
+
+	servers := u.available()
+	start := slices.Index(servers, first)
+	for i := 1; i <= len(servers); i++ {
+		if server := servers[(start+i)%len(servers)]; server != first {
+			order = append(order, server)
+		}
+	}
+	return order
 }
 
 // randomServer selects a random server from the list.
 func (u *Upstream) randomServer() *UpstreamServer {
+	servers := u.available()
 	rand.Seed(time.Now().UnixNano())
-	index := rand.Intn(len(u.Servers))
-	return u.Servers[index]
+	index := rand.Intn(len(servers))
+	return servers[index]
 }
 
 // roundRobinServer selects servers in a round-robin fashion.
 func (u *Upstream) roundRobinServer() *UpstreamServer {
+	servers := u.available()
 	u.mutex.Lock()
 	defer u.mutex.Unlock()
 
-	server := u.Servers[u.counter%len(u.Servers)]
+	server := servers[u.counter%len(servers)]
 	u.counter++
 	return server
 }
 
-// latencyServer selects the server based on latency.
-// Placeholder implementation, should be replaced with actual latency measurement logic.
-func (u *Upstream) latencyServer() *UpstreamServer {
-	var minLatency time.Duration
-	var selected *UpstreamServer
-	for _, server := range u.Servers {
-		if selected == nil || server.Latency < minLatency {
-			minLatency = server.Latency
-			selected = server
-		}
-	}
-	return selected
-}
-
-// sequentialServer selects servers sequentially.
-// Placeholder implementation for demonstration.
+// sequentialServer selects the first available server in configured order,
+// so later servers act as secondaries to the first.
 func (u *Upstream) sequentialServer() *UpstreamServer {
-	u.mutex.Lock()
-	defer u.mutex.Unlock()
-
-	server := u.Servers[u.counter%len(u.Servers)]
-	u.counter++
-	return server
+	return u.available()[0]
 }
@@ -1,72 +1,251 @@
 package upstream
 
 import (
-	"fmt"
+	"context"
+	"crypto/tls"
+	"errors"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/bwoff11/go-resolve/internal/config"
 	"github.com/bwoff11/go-resolve/internal/metrics"
+	"github.com/bwoff11/go-resolve/internal/recursive"
 	"github.com/miekg/dns"
 	"github.com/rs/zerolog/log"
 )
 
 // Upstream represents an upstream DNS server.
 type UpstreamServer struct {
-	IP      net.IP
-	Address string // IP:Port
+	IP      net.IP // Nil for servers configured by hostname.
+	Address string // IP:Port, or Host:Port for servers configured by hostname.
 	Timeout int
+	Weight  int // Relative share of queries under the weighted strategy.
 
-	Latency time.Duration
+	latency latency
+	health  *health
+
+	protocol string // udp, tcp, tls or recursive.
+	udp      *udpPool
+	stream   *streamPool // Used for tcp and tls, and for udp responses that were truncated.
+	tls      *tls.Config
+	recursor *recursive.Recursor // Resolves queries itself under the recursive protocol.
+
+	host      string // Hostname resolved through bootstrap, if the server has no IP.
+	port      string
+	bootstrap *Bootstrap
+	mutex     sync.Mutex
+	resolved  string    // Last resolved IP:Port of host.
+	expires   time.Time // When resolved must be refreshed.
+}
+
+// New creates a new Upstream object from its configuration. A server
+// configured by hostname is resolved through bootstrap when first queried
+// and again whenever the resolved address's TTL expires.
+func NewUpstreamServer(cfg config.UpstreamServer, hc *config.HealthCheck, bootstrap *Bootstrap, pc *config.Pool) *UpstreamServer {
+	protocol := strings.ToLower(cfg.Protocol)
+	if protocol == "" {
+		protocol = "udp"
+	}
+
+	port := strconv.Itoa(cfg.Port)
+	switch {
+	case cfg.Port != 0:
+	case protocol == "tls":
+		port = "853"
+	default:
+		port = "53"
+	}
+
+	us := &UpstreamServer{
+		Timeout:   cfg.Timeout,
+		Weight:    cfg.Weight,
+		port:      port,
+		bootstrap: bootstrap,
+		protocol:  protocol,
+	}
+
+	if protocol == "recursive" {
+		us.Address = "recursive"
+		if cfg.Name != "" {
+			us.Address = cfg.Name
+		}
+	} else if ip := net.ParseIP(cfg.IP); ip != nil {
+		us.IP = ip
+		us.Address = net.JoinHostPort(ip.String(), port)
+	} else {
+		us.host = cfg.Host
+		if us.host == "" {
+			us.host = cfg.IP
+		}
+		us.Address = net.JoinHostPort(us.host, port)
+	}
+
+	if protocol == "tls" {
+		serverName := cfg.TLSServerName
+		if serverName == "" {
+			serverName = us.host
+		}
+		if serverName == "" {
+			serverName = cfg.IP
+		}
+		us.tls = &tls.Config{ServerName: serverName}
+	}
+
+	idle := time.Duration(orDefault(pc.IdleTimeout, 30)) * time.Second
+	us.udp = newUDPPool(orDefault(pc.UDPSockets, 8))
+	us.stream = newStreamPool(us.dial, orDefault(pc.Connections, 2), idle)
+	us.health = newHealth(us.Address, hc)
+	return us
 }
 
-// New creates a new Upstream object with the specified IP address.
-func NewUpstreamServer(host string, port int, timeout int) *UpstreamServer {
+// dial opens a TCP or TLS connection to the server.
+func (us *UpstreamServer) dial(ctx context.Context) (net.Conn, error) {
+	target, err := us.target()
+	if err != nil {
+		return nil, err
+	}
+	if us.tls != nil {
+		d := &tls.Dialer{Config: us.tls}
+		return d.DialContext(ctx, "tcp", target)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", target)
+}
+
+// close closes the server's pooled sockets and connections.
+func (us *UpstreamServer) close() {
+	us.udp.close()
+	us.stream.close()
+	us.health.close()
+}
 
-	// Parse IP address
-	ip := net.ParseIP(host)
-	if ip == nil {
-		log.Fatal().
-			Str("msg", "failed to parse IP address").
-			Str("host", host).
-			Send()
+// target returns the IP:Port to send queries to, resolving the server's
+// hostname if needed. When re-resolving fails, the previous address is kept
+// and resolution is retried later.
+func (us *UpstreamServer) target() (string, error) {
+	if us.host == "" {
+		return us.Address, nil
+	}
+
+	us.mutex.Lock()
+	defer us.mutex.Unlock()
+
+	if us.resolved != "" && time.Now().Before(us.expires) {
+		return us.resolved, nil
+	}
+
+	ip, ttl, err := us.bootstrap.Resolve(us.host)
+	if err != nil {
+		log.Error().Err(err).Str("host", us.host).Msg("failed to resolve upstream host")
+		if us.resolved == "" {
+			return "", err
+		}
+		us.expires = time.Now().Add(bootstrapRetryTTL)
+		return us.resolved, nil
 	}
 
-	// Return new Upstream
-	return &UpstreamServer{
-		IP:      ip,
-		Address: fmt.Sprintf("%s:53", ip.String()),
-		Timeout: timeout,
+	resolved := net.JoinHostPort(ip.String(), us.port)
+	if resolved != us.resolved {
+		log.Info().Str("host", us.host).Str("address", resolved).Dur("ttl", ttl).Msg("resolved upstream host")
 	}
+	us.resolved, us.expires = resolved, time.Now().Add(ttl)
+	return us.resolved, nil
 }
 
 // Query sends the given DNS query message to the upstream DNS server and returns the response.
 func (us *UpstreamServer) Query(msg *dns.Msg) (response []dns.RR) {
+	resp, err := us.Exchange(context.Background(), msg)
+	if err != nil || resp.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+	return resp.Answer
+}
+
+// Exchange sends the given DNS query message to the upstream DNS server and
+// returns the full response. It waits at most the server's timeout or until
+// ctx is done, whichever comes first. Errors and SERVFAIL responses count
+// against the server's health; cancellation and SERVFAIL responses of
+// recursive servers do not.
+func (us *UpstreamServer) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
 	startTime := time.Now()
 	defer func() { metrics.UpstreamDuration.Observe(time.Since(startTime).Seconds()) }()
 
-	client := &dns.Client{
-		Net:     "udp",
-		Timeout: time.Duration(us.Timeout) * time.Second,
-	}
+	ctx, cancel := context.WithTimeout(ctx, us.timeout())
+	defer cancel()
 
-	resp, rtt, err := client.Exchange(msg, us.Address)
+	resp, err := us.roundTrip(ctx, msg)
+	rtt := time.Since(startTime)
 	metrics.UpstreamRTT.WithLabelValues(us.Address).Observe(rtt.Seconds())
-	us.Latency = rtt
+	if errors.Is(err, context.Canceled) {
+		return nil, err
+	}
 
 	if err != nil {
 		log.Error().Str("msg", "Failed to query upstream DNS server").Str("address", us.Address).Err(err).Send()
-		return nil
+		us.failure()
+		return nil, err
 	}
 
-	if resp == nil {
-		return nil
+	// A recursive server answers SERVFAIL for names it could not resolve,
+	// which says nothing of its own health.
+	switch {
+	case resp.Rcode != dns.RcodeServerFailure:
+		us.latency.observe(rtt)
+		us.health.success()
+	case us.recursor == nil:
+		us.failure()
 	}
 
 	if resp.Rcode != dns.RcodeSuccess {
 		log.Debug().Str("msg", "Upstream DNS server responded with error").Str("address", us.Address).Int("rcode", resp.Rcode).Send()
-		return nil
+		return resp, nil
 	}
 
 	log.Debug().Str("msg", "Upstream DNS server responded").Str("address", us.Address).Send()
-	return resp.Answer
+	return resp, nil
+}
+
+// roundTrip sends the query over the server's protocol through its pools.
+// Truncated UDP responses are retried over TCP.
+func (us *UpstreamServer) roundTrip(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if us.recursor != nil {
+		return us.recursor.Exchange(ctx, msg)
+	}
+	if us.protocol != "udp" {
+		return us.stream.exchange(ctx, msg)
+	}
+
+	target, err := us.target()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := us.udp.exchange(ctx, msg, target)
+	if err == nil && resp.Truncated {
+		log.Debug().Str("address", us.Address).Msg("truncated upstream response, retrying over tcp")
+		return us.stream.exchange(ctx, msg)
+	}
+	return resp, err
+}
+
+// failure records a failed query against the server's health, and as a
+// sample of its full timeout against its latency.
+func (us *UpstreamServer) failure() {
+	us.latency.observe(us.timeout())
+	us.health.failure()
+}
+
+// timeout returns the configured timeout, or the dns.Client default of two
+// seconds. Recursive servers may need many round trips and default to the
+// recursion timeout.
+func (us *UpstreamServer) timeout() time.Duration {
+	if us.Timeout <= 0 && us.recursor != nil {
+		return us.recursor.Timeout()
+	}
+	if us.Timeout <= 0 {
+		return 2 * time.Second
+	}
+	return time.Duration(us.Timeout) * time.Second
 }
@@ -1,10 +1,17 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 
+	"github.com/bwoff11/go-resolve/internal/api"
+	"github.com/bwoff11/go-resolve/internal/cli"
 	"github.com/bwoff11/go-resolve/internal/config"
+	"github.com/bwoff11/go-resolve/internal/pause"
 	"github.com/bwoff11/go-resolve/internal/resolver"
 	"github.com/bwoff11/go-resolve/internal/transport"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -13,19 +20,53 @@ import (
 
 func main() {
 
-	// No error handling on these functions because
-	// if they fail, the program should exit.
+	// Any arguments are a command for an already running server.
+	if len(os.Args) > 1 {
+		if err := cli.Run(os.Args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	cfg, _ := config.Load()
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load configuration")
+	}
 
 	startMetricsServer(&cfg.Metrics)
 
 	transports := transport.New(&cfg.Transport)
 	transports.Start()
-	resolver := resolver.New(cfg, transports.Queue)
+	resolver := resolver.New(cfg, transports.Queue, pause.New())
 	resolver.Start()
 
-	select {} // replace with a signal handler
+	if cfg.API.Enabled {
+		api.New(&cfg.API, resolver).Start()
+	}
+
+	handleSignals(resolver, transports)
+}
+
+// handleSignals reloads the configuration on SIGHUP and stops on SIGINT or SIGTERM.
+func handleSignals(r *resolver.Resolver, t *transport.Transports) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			log.Info().Str("signal", sig.String()).Msg("Shutting down")
+			t.Stop()
+			return
+		}
+
+		cfg, err := config.Load()
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to reload configuration, keeping current configuration")
+			continue
+		}
+		r.Reload(cfg)
+	}
 }
 
 func startMetricsServer(cfg *config.Metrics) {